@@ -0,0 +1,130 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// Error types of the Prometheus HTTP API.
+const (
+	errorBadData  = "bad_data"
+	errorInternal = "internal"
+)
+
+// apiResponse is the envelope of the responses of the Prometheus HTTP API,
+// which the adapter mimics for the endpoints Grafana and other clients use.
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+func respond(logger log.Logger, w http.ResponseWriter, data interface{}) {
+	writeAPIResponse(logger, w, http.StatusOK, &apiResponse{Status: "success", Data: data})
+}
+
+func respondError(logger log.Logger, w http.ResponseWriter, code int, errorType string, err error) {
+	writeAPIResponse(logger, w, code, &apiResponse{Status: "error", ErrorType: errorType, Error: err.Error()})
+}
+
+func writeAPIResponse(logger log.Logger, w http.ResponseWriter, code int, resp *apiResponse) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error marshaling API response", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(b); err != nil {
+		level.Warn(logger).Log("msg", "Error writing response", "err", err)
+	}
+}
+
+// exemplarQuery parses the parameters of an /api/v1/query_exemplars request
+// into a query. Unlike Prometheus, which accepts any expression, the query
+// must be a single series selector. The time range defaults to everything
+// up to now.
+func exemplarQuery(r *http.Request, now time.Time) (*prompb.Query, error) {
+	matchers, err := parser.ParseMetricSelector(r.FormValue("query"))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid query, expected a series selector")
+	}
+
+	start, end := model.Time(0), model.TimeFromUnixNano(now.UnixNano())
+	if s := r.FormValue("start"); s != "" {
+		if start, err = parseTime(s); err != nil {
+			return nil, errors.Wrap(err, "invalid start")
+		}
+	}
+	if s := r.FormValue("end"); s != "" {
+		if end, err = parseTime(s); err != nil {
+			return nil, errors.Wrap(err, "invalid end")
+		}
+	}
+	if end < start {
+		return nil, errors.New("end timestamp must not be before start timestamp")
+	}
+
+	q := &prompb.Query{
+		StartTimestampMs: int64(start),
+		EndTimestampMs:   int64(end),
+		Matchers:         make([]*prompb.LabelMatcher, 0, len(matchers)),
+	}
+	for _, m := range matchers {
+		q.Matchers = append(q.Matchers, &prompb.LabelMatcher{
+			Type:  matchTypes[m.Type],
+			Name:  m.Name,
+			Value: m.Value,
+		})
+	}
+	return q, nil
+}
+
+var matchTypes = map[labels.MatchType]prompb.LabelMatcher_Type{
+	labels.MatchEqual:     prompb.LabelMatcher_EQ,
+	labels.MatchNotEqual:  prompb.LabelMatcher_NEQ,
+	labels.MatchRegexp:    prompb.LabelMatcher_RE,
+	labels.MatchNotRegexp: prompb.LabelMatcher_NRE,
+}
+
+// parseTime parses a timestamp of the Prometheus HTTP API, given either in
+// seconds since the epoch or in RFC 3339 format.
+func parseTime(s string) (model.Time, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, errors.Errorf("cannot parse %q to a valid timestamp", s)
+		}
+		return model.TimeFromUnixNano(int64(f * float64(time.Second))), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return model.TimeFromUnixNano(t.UnixNano()), nil
+	}
+	return 0, errors.Errorf("cannot parse %q to a valid timestamp", s)
+}
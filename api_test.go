@@ -0,0 +1,97 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestExemplarQuery(t *testing.T) {
+	now := time.Unix(3600, 0)
+
+	r := httptest.NewRequest("GET", `/api/v1/query_exemplars?query=rpc_seconds_bucket{job=~"api.*"}&start=1000.5&end=1970-01-01T00:30:00Z`, nil)
+	q, err := exemplarQuery(r, now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := &prompb.Query{
+		StartTimestampMs: 1000500,
+		EndTimestampMs:   1800000,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "rpc_seconds_bucket"},
+			{Type: prompb.LabelMatcher_RE, Name: "job", Value: "api.*"},
+		},
+	}
+	if !reflect.DeepEqual(q, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, q)
+	}
+
+	r = httptest.NewRequest("GET", `/api/v1/query_exemplars?query=up`, nil)
+	if q, err = exemplarQuery(r, now); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if q.StartTimestampMs != 0 || q.EndTimestampMs != 3600000 {
+		t.Errorf("Expected range to default to [0, now], got [%d, %d]", q.StartTimestampMs, q.EndTimestampMs)
+	}
+
+	for _, query := range []string{
+		`query=`,
+		`query=up&start=yesterday`,
+		`query=up&start=20&end=10`,
+	} {
+		r := httptest.NewRequest("GET", "/api/v1/query_exemplars?"+query, nil)
+		if _, err := exemplarQuery(r, now); err == nil {
+			t.Errorf("Expected error for %q, got none", query)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	for s, expected := range map[string]model.Time{
+		"1600096945.479":           1600096945479,
+		"2020-09-14T15:22:25.479Z": 1600096945479,
+	} {
+		ts, err := parseTime(s)
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %s", s, err)
+		}
+		if ts != expected {
+			t.Errorf("Expected %v for %q, got %v", expected, s, ts)
+		}
+	}
+	if _, err := parseTime("NaN"); err == nil {
+		t.Error("Expected error for NaN, got none")
+	}
+}
+
+func TestRespondError(t *testing.T) {
+	w := httptest.NewRecorder()
+	respondError(log.NewNopLogger(), w, 400, errorBadData, errors.New("invalid query"))
+	if w.Code != 400 {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+	expected := `{"status":"error","errorType":"bad_data","error":"invalid query"}`
+	if w.Body.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, w.Body.String())
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// Endpoints which are authenticated separately. The read endpoint covers the
+// exemplar and metadata APIs as well, the admin endpoint covers reloads and
+// profiling.
+const (
+	endpointWrite     = "write"
+	endpointRead      = "read"
+	endpointTelemetry = "telemetry"
+	endpointAdmin     = "admin"
+)
+
+// Reasons for rejecting requests, used as label values of
+// rejected_requests_total.
+const (
+	reasonMissingCredentials = "missing_credentials"
+	reasonInvalidBasicAuth   = "invalid_basic_auth"
+	reasonInvalidBearerToken = "invalid_bearer_token"
+	reasonInvalidClientCert  = "invalid_client_certificate"
+)
+
+// authConfig is the format of the authentication configuration file. Each
+// endpoint is open to anyone, unless it configures at least one way to
+// authenticate.
+type authConfig struct {
+	Write     *endpointAuthConfig `yaml:"write,omitempty"`
+	Read      *endpointAuthConfig `yaml:"read,omitempty"`
+	Telemetry *endpointAuthConfig `yaml:"telemetry,omitempty"`
+	Admin     *endpointAuthConfig `yaml:"admin,omitempty"`
+}
+
+// endpointAuthConfig configures how requests to an endpoint authenticate.
+// Requests are accepted if they pass any of the configured methods.
+type endpointAuthConfig struct {
+	// BasicAuthUsersFile holds a user and the bcrypt hash of its password
+	// per line, separated by a colon, as written by htpasswd -B.
+	BasicAuthUsersFile string `yaml:"basic_auth_users_file,omitempty"`
+	// BearerTokensFile holds a token per line.
+	BearerTokensFile string `yaml:"bearer_tokens_file,omitempty"`
+	// ClientCAFile holds the PEM encoded certificates of the authorities
+	// which issue client certificates.
+	ClientCAFile string `yaml:"client_ca_file,omitempty"`
+}
+
+// endpointAuth authenticates the requests to an endpoint.
+type endpointAuth struct {
+	users     map[string][]byte
+	tokens    [][]byte
+	clientCAs *x509.CertPool
+
+	// Checking bcrypt hashes is slow by design, so the credentials which
+	// were accepted are remembered by their hash.
+	mtx      sync.Mutex
+	accepted map[[sha256.Size]byte]struct{}
+}
+
+// authenticator authenticates requests as configured by the authentication
+// configuration file, which is read again on reload.
+type authenticator struct {
+	filename string
+
+	mtx       sync.RWMutex
+	endpoints map[string]*endpointAuth
+}
+
+func newAuthenticator(filename string) *authenticator {
+	return &authenticator{filename: filename, endpoints: map[string]*endpointAuth{}}
+}
+
+// reload reads the authentication configuration file and the files it
+// refers to. If any of them is invalid, the current configuration stays in
+// effect.
+func (a *authenticator) reload() error {
+	if a.filename == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(a.filename)
+	if err != nil {
+		return err
+	}
+	ac := &authConfig{}
+	if err := yaml.UnmarshalStrict(b, ac); err != nil {
+		return errors.Wrapf(err, "error parsing %s", a.filename)
+	}
+
+	endpoints := map[string]*endpointAuth{}
+	for endpoint, c := range map[string]*endpointAuthConfig{
+		endpointWrite:     ac.Write,
+		endpointRead:      ac.Read,
+		endpointTelemetry: ac.Telemetry,
+		endpointAdmin:     ac.Admin,
+	} {
+		if c == nil {
+			continue
+		}
+		ea, err := c.load()
+		if err != nil {
+			return errors.Wrapf(err, "invalid authentication of %s endpoint in %s", endpoint, a.filename)
+		}
+		if ea != nil {
+			endpoints[endpoint] = ea
+		}
+	}
+
+	a.mtx.Lock()
+	a.endpoints = endpoints
+	a.mtx.Unlock()
+	return nil
+}
+
+// load reads the files of the configuration. It returns nil if no method to
+// authenticate is configured.
+func (c *endpointAuthConfig) load() (*endpointAuth, error) {
+	if c.BasicAuthUsersFile == "" && c.BearerTokensFile == "" && c.ClientCAFile == "" {
+		return nil, nil
+	}
+	ea := &endpointAuth{accepted: map[[sha256.Size]byte]struct{}{}}
+	if c.BasicAuthUsersFile != "" {
+		lines, err := readLines(c.BasicAuthUsersFile)
+		if err != nil {
+			return nil, err
+		}
+		ea.users = map[string][]byte{}
+		for i, line := range lines {
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return nil, errors.Errorf("invalid user on line %d of %s", i+1, c.BasicAuthUsersFile)
+			}
+			if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+				return nil, errors.Wrapf(err, "invalid bcrypt hash of user %q in %s", parts[0], c.BasicAuthUsersFile)
+			}
+			ea.users[parts[0]] = []byte(parts[1])
+		}
+	}
+	if c.BearerTokensFile != "" {
+		lines, err := readLines(c.BearerTokensFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(lines) == 0 {
+			return nil, errors.Errorf("no bearer tokens in %s", c.BearerTokensFile)
+		}
+		for _, line := range lines {
+			ea.tokens = append(ea.tokens, []byte(line))
+		}
+	}
+	if c.ClientCAFile != "" {
+		b, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		ea.clientCAs = x509.NewCertPool()
+		if !ea.clientCAs.AppendCertsFromPEM(b) {
+			return nil, errors.Errorf("no certificates in %s", c.ClientCAFile)
+		}
+	}
+	return ea, nil
+}
+
+// readLines returns the lines of a file which aren't empty.
+func readLines(filename string) ([]string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, s.Err()
+}
+
+// protect returns a handler which passes the requests to h which
+// authenticate for the endpoint, and rejects the others.
+func (a *authenticator) protect(endpoint string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.mtx.RLock()
+		ea := a.endpoints[endpoint]
+		a.mtx.RUnlock()
+		if ea == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if reason := ea.authenticate(r); reason != "" {
+			rejectedRequests.WithLabelValues(endpoint, reason).Inc()
+			if ea.users != nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="remote storage adapter"`)
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// authenticate returns why a request is rejected, or an empty string if it
+// is accepted.
+func (ea *endpointAuth) authenticate(r *http.Request) string {
+	reason := reasonMissingCredentials
+	if ea.clientCAs != nil && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		if ea.verifyClientCert(r) {
+			return ""
+		}
+		reason = reasonInvalidClientCert
+	}
+	if user, password, ok := r.BasicAuth(); ok && ea.users != nil {
+		if ea.verifyBasicAuth(user, password) {
+			return ""
+		}
+		return reasonInvalidBasicAuth
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") && ea.tokens != nil {
+		if ea.verifyBearerToken(strings.TrimPrefix(auth, "Bearer ")) {
+			return ""
+		}
+		return reasonInvalidBearerToken
+	}
+	return reason
+}
+
+func (ea *endpointAuth) verifyClientCert(r *http.Request) bool {
+	certs := r.TLS.PeerCertificates
+	opts := x509.VerifyOptions{
+		Roots:         ea.clientCAs,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err == nil
+}
+
+func (ea *endpointAuth) verifyBasicAuth(user, password string) bool {
+	hash, ok := ea.users[user]
+	if !ok {
+		return false
+	}
+	key := sha256.Sum256([]byte(user + ":" + password))
+	ea.mtx.Lock()
+	_, ok = ea.accepted[key]
+	ea.mtx.Unlock()
+	if ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	ea.mtx.Lock()
+	ea.accepted[key] = struct{}{}
+	ea.mtx.Unlock()
+	return true
+}
+
+func (ea *endpointAuth) verifyBearerToken(token string) bool {
+	valid := false
+	for _, t := range ea.tokens {
+		if subtle.ConstantTimeCompare(t, []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
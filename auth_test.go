@@ -0,0 +1,222 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// The bcrypt hash of "secret".
+const secretHash = "$2a$04$Y/jEXLuaxgmuvLFgQfP62eXhl.F1z9U/ySd8isskJcHrcXfN5Htc."
+
+// newCert creates a certificate signed by parent, or a self-signed CA
+// certificate if parent is nil.
+func newCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.Subject.CommonName = "ca"
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := newCert(t, nil, nil)
+	client, _ := newCert(t, ca, caKey)
+	otherCA, otherKey := newCert(t, nil, nil)
+	otherClient, _ := newCert(t, otherCA, otherKey)
+
+	files := map[string]string{
+		"users":  "alice:" + secretHash + "\n",
+		"tokens": "token-1\n\ntoken-2\n",
+		"ca.pem": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})),
+		"auth.yml": `
+write:
+  basic_auth_users_file: ` + filepath.Join(dir, "users") + `
+  bearer_tokens_file: ` + filepath.Join(dir, "tokens") + `
+  client_ca_file: ` + filepath.Join(dir, "ca.pem") + `
+read: {}
+admin:
+  bearer_tokens_file: ` + filepath.Join(dir, "tokens") + `
+`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a := newAuthenticator(filepath.Join(dir, "auth.yml"))
+	if err := a.reload(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, tc := range []struct {
+		name     string
+		endpoint string
+		prepare  func(r *http.Request)
+		reason   string
+	}{
+		{name: "no credentials", endpoint: endpointWrite, reason: reasonMissingCredentials},
+		{name: "open endpoint", endpoint: endpointRead},
+		{name: "unconfigured endpoint", endpoint: endpointTelemetry},
+		{name: "admin without credentials", endpoint: endpointAdmin, reason: reasonMissingCredentials},
+		{
+			name:     "admin bearer token",
+			endpoint: endpointAdmin,
+			prepare:  func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-1") },
+		},
+		{
+			name:     "basic auth",
+			endpoint: endpointWrite,
+			prepare:  func(r *http.Request) { r.SetBasicAuth("alice", "secret") },
+		},
+		{
+			name:     "cached basic auth",
+			endpoint: endpointWrite,
+			prepare:  func(r *http.Request) { r.SetBasicAuth("alice", "secret") },
+		},
+		{
+			name:     "wrong password",
+			endpoint: endpointWrite,
+			prepare:  func(r *http.Request) { r.SetBasicAuth("alice", "guess") },
+			reason:   reasonInvalidBasicAuth,
+		},
+		{
+			name:     "unknown user",
+			endpoint: endpointWrite,
+			prepare:  func(r *http.Request) { r.SetBasicAuth("bob", "secret") },
+			reason:   reasonInvalidBasicAuth,
+		},
+		{
+			name:     "bearer token",
+			endpoint: endpointWrite,
+			prepare:  func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-2") },
+		},
+		{
+			name:     "wrong bearer token",
+			endpoint: endpointWrite,
+			prepare:  func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-3") },
+			reason:   reasonInvalidBearerToken,
+		},
+		{
+			name:     "client certificate",
+			endpoint: endpointWrite,
+			prepare:  func(r *http.Request) { r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client}} },
+		},
+		{
+			name:     "client certificate of other CA",
+			endpoint: endpointWrite,
+			prepare: func(r *http.Request) {
+				r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{otherClient}}
+			},
+			reason: reasonInvalidClientCert,
+		},
+	} {
+		r := httptest.NewRequest("POST", "/", nil)
+		if tc.prepare != nil {
+			tc.prepare(r)
+		}
+		rejected := rejectedRequests.WithLabelValues(tc.endpoint, tc.reason)
+		before := testutil.ToFloat64(rejected)
+		w := httptest.NewRecorder()
+		a.protect(tc.endpoint, ok).ServeHTTP(w, r)
+
+		if tc.reason == "" {
+			if w.Code != http.StatusOK {
+				t.Errorf("%s: expected status 200, got %d", tc.name, w.Code)
+			}
+			continue
+		}
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected status 401, got %d", tc.name, w.Code)
+		}
+		if got := testutil.ToFloat64(rejected) - before; got != 1 {
+			t.Errorf("%s: expected 1 rejected request with reason %s, got %v", tc.name, tc.reason, got)
+		}
+	}
+}
+
+func TestAuthenticatorInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, files := range []map[string]string{
+		// Unknown field.
+		{"auth.yml": "write:\n  users: x\n"},
+		// Password which isn't hashed.
+		{"auth.yml": "write:\n  basic_auth_users_file: " + filepath.Join(dir, "users") + "\n", "users": "alice:secret\n"},
+		// No tokens.
+		{"auth.yml": "read:\n  bearer_tokens_file: " + filepath.Join(dir, "tokens") + "\n", "tokens": "\n"},
+		// No certificates.
+		{"auth.yml": "telemetry:\n  client_ca_file: " + filepath.Join(dir, "ca.pem") + "\n", "ca.pem": "none\n"},
+	} {
+		for name, content := range files {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		a := newAuthenticator(filepath.Join(dir, "auth.yml"))
+		if err := a.reload(); err == nil {
+			t.Errorf("Expected error for %v, got none", files)
+		}
+	}
+}
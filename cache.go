@@ -0,0 +1,518 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/gogo/protobuf/proto"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"exemplar"
+)
+
+// lru tracks entries in least recently used order, evicting the least
+// recently used ones once their total size exceeds maxBytes.
+type lru struct {
+	maxBytes int64
+	bytes    int64
+	order    *list.List
+	entries  map[string]*list.Element
+	// onEvict, if set, is called with the key of each evicted entry.
+	onEvict func(key string)
+}
+
+type lruEntry struct {
+	key   string
+	value []byte
+	size  int64
+}
+
+func newLRU(maxBytes int64, onEvict func(key string)) *lru {
+	return &lru{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+		onEvict:  onEvict,
+	}
+}
+
+// get returns the value of key and marks it as most recently used.
+func (l *lru) get(key string) ([]byte, bool) {
+	e, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+// add adds or replaces the entry of key as the most recently used one.
+// Entries larger than maxBytes are evicted right away.
+func (l *lru) add(key string, value []byte, size int64) {
+	if e, ok := l.entries[key]; ok {
+		l.bytes -= e.Value.(*lruEntry).size
+		l.order.Remove(e)
+		delete(l.entries, key)
+	}
+	if size > l.maxBytes {
+		if l.onEvict != nil {
+			l.onEvict(key)
+		}
+		return
+	}
+	l.entries[key] = l.order.PushFront(&lruEntry{key: key, value: value, size: size})
+	l.bytes += size
+	for l.bytes > l.maxBytes {
+		e := l.order.Back()
+		entry := e.Value.(*lruEntry)
+		l.order.Remove(e)
+		delete(l.entries, entry.key)
+		l.bytes -= entry.size
+		if l.onEvict != nil {
+			l.onEvict(entry.key)
+		}
+	}
+}
+
+// readCache holds the results of read queries per time bucket, in memory
+// and optionally in a directory on disk. Only buckets which are complete,
+// whose end is at least minAge old, are cached.
+type readCache struct {
+	logger     log.Logger
+	bucketSize time.Duration
+	minAge     time.Duration
+	now        func() time.Time
+
+	// mtx protects the stores, but not the files on disk, which are read
+	// and written without holding it.
+	mtx    sync.Mutex
+	memory *lru
+	// dir and disk are only set with an on-disk store. The disk LRU only
+	// tracks the sizes of the files.
+	dir  string
+	disk *lru
+	// evicted holds the files evicted from the disk store which are yet
+	// to be removed.
+	evicted []string
+}
+
+// newReadCache creates a read cache holding up to maxSize bytes in memory,
+// and up to maxDiskSize bytes in dir if it isn't empty. Files left in dir by
+// a previous run are used again.
+func newReadCache(logger log.Logger, bucketSize, minAge time.Duration, maxSize int64, dir string, maxDiskSize int64) (*readCache, error) {
+	if bucketSize < time.Millisecond {
+		return nil, errors.Errorf("invalid read cache bucket size %s", bucketSize)
+	}
+	c := &readCache{
+		logger:     logger,
+		bucketSize: bucketSize,
+		minAge:     minAge,
+		now:        time.Now,
+		memory:     newLRU(maxSize, nil),
+	}
+	if dir == "" {
+		return c, nil
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, errors.Wrap(err, "failed to create read cache directory")
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read read cache directory")
+	}
+	c.dir = dir
+	c.disk = newLRU(maxDiskSize, func(key string) { c.evicted = append(c.evicted, key) })
+	// Files are added from the oldest to the newest, so the newest are
+	// kept if the maximum size was lowered.
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, f := range files {
+		if _, err := hex.DecodeString(f.Name()); err != nil || len(f.Name()) != 2*sha256.Size {
+			// Files of interrupted writes.
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		c.disk.add(f.Name(), nil, f.Size())
+	}
+	c.updateSize()
+	c.removeEvicted()
+	return c, nil
+}
+
+// removeEvicted removes the files evicted from the disk store. It must be
+// called without holding mtx.
+func (c *readCache) removeEvicted() {
+	c.mtx.Lock()
+	evicted := c.evicted
+	c.evicted = nil
+	c.mtx.Unlock()
+	for _, key := range evicted {
+		if err := os.Remove(filepath.Join(c.dir, key)); err != nil && !os.IsNotExist(err) {
+			level.Warn(c.logger).Log("msg", "Failed to remove evicted read cache file", "file", key, "err", err)
+		}
+	}
+}
+
+// updateSize updates the size metrics of the stores.
+func (c *readCache) updateSize() {
+	readCacheSize.WithLabelValues("memory").Set(float64(c.memory.bytes))
+	if c.disk != nil {
+		readCacheSize.WithLabelValues("disk").Set(float64(c.disk.bytes))
+	}
+}
+
+// get returns the cached series of a bucket, from memory or from disk.
+func (c *readCache) get(key string) ([]*prompb.TimeSeries, bool) {
+	c.mtx.Lock()
+	b, ok := c.memory.get(key)
+	onDisk := false
+	if !ok && c.disk != nil {
+		_, onDisk = c.disk.get(key)
+	}
+	c.mtx.Unlock()
+
+	store := "memory"
+	if onDisk {
+		store = "disk"
+		var err error
+		// The file may have been evicted in the meantime.
+		if b, err = ioutil.ReadFile(filepath.Join(c.dir, key)); err != nil {
+			if !os.IsNotExist(err) {
+				level.Warn(c.logger).Log("msg", "Failed to read read cache file", "file", key, "err", err)
+			}
+		} else {
+			ok = true
+			c.mtx.Lock()
+			c.memory.add(key, b, int64(len(b)))
+			c.updateSize()
+			c.mtx.Unlock()
+		}
+	}
+	if !ok {
+		readCacheMisses.Inc()
+		return nil, false
+	}
+
+	var res prompb.QueryResult
+	if err := proto.Unmarshal(b, &res); err != nil {
+		level.Warn(c.logger).Log("msg", "Failed to decode cached read results", "store", store, "err", err)
+		readCacheMisses.Inc()
+		return nil, false
+	}
+	readCacheHits.WithLabelValues(store).Inc()
+	return res.Timeseries, true
+}
+
+// put caches the series of a bucket.
+func (c *readCache) put(key string, series []*prompb.TimeSeries) {
+	b, err := proto.Marshal(&prompb.QueryResult{Timeseries: series})
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "Failed to encode read results", "err", err)
+		return
+	}
+
+	c.mtx.Lock()
+	c.memory.add(key, b, int64(len(b)))
+	c.updateSize()
+	c.mtx.Unlock()
+	if c.disk == nil || int64(len(b)) > c.disk.maxBytes {
+		return
+	}
+	if err := c.writeFile(key, b); err != nil {
+		level.Warn(c.logger).Log("msg", "Failed to write read cache file", "file", key, "err", err)
+		return
+	}
+	c.mtx.Lock()
+	c.disk.add(key, nil, int64(len(b)))
+	c.updateSize()
+	c.mtx.Unlock()
+	c.removeEvicted()
+}
+
+// writeFile writes the file of a key. It writes to a temporary file first,
+// so that a crash doesn't leave an incomplete file behind under the key, and
+// concurrent writes of the same key don't interfere.
+func (c *readCache) writeFile(key string, b []byte) error {
+	f, err := ioutil.TempFile(c.dir, key+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(c.dir, key)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// bucket returns the size of the buckets and the start of the first one
+// which isn't complete yet, in milliseconds.
+func (c *readCache) bucket() (size, incomplete int64) {
+	size = int64(c.bucketSize / time.Millisecond)
+	complete := c.now().Add(-c.minAge).UnixNano() / int64(time.Millisecond)
+	return size, floorDiv(complete, size) * size
+}
+
+// floorDiv divides a by b, rounding towards negative infinity.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// cachingReader answers read queries from the results of the complete time
+// buckets they cover, which are read from the reader once and cached. Only
+// the buckets which aren't complete yet are read each time.
+//
+// Read hints are dropped for queries which are split into buckets, as the
+// points a storage downsamples them to may span several buckets.
+type cachingReader struct {
+	reader
+	cache *readCache
+	// scope identifies the remote storage, its configuration and the
+	// tenant in the keys of the cache.
+	scope string
+	// queued, if set, returns whether samples for the remote storage are
+	// still queued. Buckets aren't cached then, as the queued samples may
+	// belong to them however old they are.
+	queued func() bool
+}
+
+// cacheScope returns the scope of the cached results of a remote storage of
+// a tenant, which changes along with its configuration.
+func cacheScope(tenant string, sc storageConfig) (string, error) {
+	b, err := yaml.Marshal(sc)
+	if err != nil {
+		return "", err
+	}
+	return tenant + "\xff" + sc.name() + "\xff" + string(b), nil
+}
+
+func (r cachingReader) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	resp := &prompb.ReadResponse{Results: make([]*prompb.QueryResult, 0, len(req.Queries))}
+	for _, q := range req.Queries {
+		series, err := r.query(q)
+		if err != nil {
+			return nil, err
+		}
+		resp.Results = append(resp.Results, &prompb.QueryResult{Timeseries: series})
+	}
+	return resp, nil
+}
+
+// ReadStream answers the queries covering a complete bucket once all of
+// their buckets were read. The others are then streamed from the reader in a
+// single request, so that they share its read limits.
+func (r cachingReader) ReadStream(req *prompb.ReadRequest, send func(int, *prompb.TimeSeries) error) error {
+	size, incomplete := r.cache.bucket()
+	var (
+		streamed = &prompb.ReadRequest{}
+		indexes  []int
+	)
+	for i, q := range req.Queries {
+		if floorDiv(q.StartTimestampMs, size)*size >= incomplete {
+			streamed.Queries = append(streamed.Queries, q)
+			indexes = append(indexes, i)
+			continue
+		}
+		series, err := r.query(q)
+		if err != nil {
+			return err
+		}
+		for _, ts := range series {
+			if err := send(i, ts); err != nil {
+				return err
+			}
+		}
+	}
+	if len(streamed.Queries) == 0 {
+		return nil
+	}
+	return readStream(r.reader, streamed, func(i int, ts *prompb.TimeSeries) error {
+		return send(indexes[i], ts)
+	})
+}
+
+func (r cachingReader) ReadExemplars(q *prompb.Query) ([]exemplar.Series, error) {
+	return readExemplars(r.reader, q)
+}
+
+// query answers a single query from the cached buckets it covers, reading
+// missing buckets and the ones which aren't complete from the reader.
+// Contiguous missing buckets are read with a single query.
+func (r cachingReader) query(q *prompb.Query) ([]*prompb.TimeSeries, error) {
+	size, incomplete := r.cache.bucket()
+	b := floorDiv(q.StartTimestampMs, size) * size
+	if b >= incomplete {
+		return readSeries(r.reader, q)
+	}
+
+	series := map[string]*prompb.TimeSeries{}
+	var missing []int64
+	// fetch reads the missing buckets, caches them and adds them to the
+	// result.
+	fetch := func() error {
+		if len(missing) == 0 {
+			return nil
+		}
+		fetched, err := readSeries(r.reader, &prompb.Query{
+			StartTimestampMs: missing[0],
+			EndTimestampMs:   missing[len(missing)-1] + size - 1,
+			Matchers:         q.Matchers,
+		})
+		if err != nil {
+			return err
+		}
+		cache := r.queued == nil || !r.queued()
+		for _, start := range missing {
+			bucket := sliceSeries(fetched, start, start+size-1)
+			if cache {
+				r.cache.put(r.key(q.Matchers, start, size), bucket)
+			}
+			addSeries(series, bucket, q.StartTimestampMs, q.EndTimestampMs)
+		}
+		missing = missing[:0]
+		return nil
+	}
+
+	for ; b < incomplete && b <= q.EndTimestampMs; b += size {
+		bucket, ok := r.cache.get(r.key(q.Matchers, b, size))
+		if !ok {
+			missing = append(missing, b)
+			continue
+		}
+		if err := fetch(); err != nil {
+			return nil, err
+		}
+		addSeries(series, bucket, q.StartTimestampMs, q.EndTimestampMs)
+	}
+	if err := fetch(); err != nil {
+		return nil, err
+	}
+	if b <= q.EndTimestampMs {
+		recent, err := readSeries(r.reader, &prompb.Query{
+			StartTimestampMs: b,
+			EndTimestampMs:   q.EndTimestampMs,
+			Matchers:         q.Matchers,
+		})
+		if err != nil {
+			return nil, err
+		}
+		addSeries(series, recent, q.StartTimestampMs, q.EndTimestampMs)
+	}
+
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([]*prompb.TimeSeries, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, series[k])
+	}
+	return result, nil
+}
+
+// key returns the cache key of a bucket of the series selected by matchers.
+// Matchers are normalized, so that their order doesn't matter.
+func (r cachingReader) key(matchers []*prompb.LabelMatcher, start, size int64) string {
+	ms := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		ms = append(ms, m.Name+"\xff"+m.Type.String()+"\xff"+m.Value)
+	}
+	sort.Strings(ms)
+
+	h := sha256.New()
+	h.Write([]byte(r.scope))
+	for i, m := range ms {
+		if i > 0 && m == ms[i-1] {
+			continue
+		}
+		h.Write([]byte("\xff" + m))
+	}
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(start))
+	binary.BigEndian.PutUint64(b[8:], uint64(size))
+	h.Write(b[:])
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readSeries returns the series of a single query.
+func readSeries(r reader, q *prompb.Query) ([]*prompb.TimeSeries, error) {
+	resp, err := r.Read(&prompb.ReadRequest{Queries: []*prompb.Query{q}})
+	if err != nil {
+		return nil, err
+	}
+	var series []*prompb.TimeSeries
+	for _, res := range resp.Results {
+		series = append(series, res.Timeseries...)
+	}
+	return series, nil
+}
+
+// sliceSeries returns the samples of series within [start, end], leaving
+// out series without any.
+func sliceSeries(series []*prompb.TimeSeries, start, end int64) []*prompb.TimeSeries {
+	result := []*prompb.TimeSeries{}
+	for _, ts := range series {
+		i := sort.Search(len(ts.Samples), func(i int) bool { return ts.Samples[i].Timestamp >= start })
+		j := sort.Search(len(ts.Samples), func(i int) bool { return ts.Samples[i].Timestamp > end })
+		if i < j {
+			result = append(result, &prompb.TimeSeries{Labels: ts.Labels, Samples: ts.Samples[i:j]})
+		}
+	}
+	return result
+}
+
+// addSeries appends the samples of series within [start, end] to the series
+// with the same labels in labelsToSeries. Series must be added in the order
+// of their time buckets.
+func addSeries(labelsToSeries map[string]*prompb.TimeSeries, series []*prompb.TimeSeries, start, end int64) {
+	for _, ts := range sliceSeries(series, start, end) {
+		k := labelsKey(ts.Labels)
+		if s, ok := labelsToSeries[k]; ok {
+			s.Samples = append(s.Samples, ts.Samples...)
+			continue
+		}
+		labelsToSeries[k] = &prompb.TimeSeries{
+			Labels:  ts.Labels,
+			Samples: append([]prompb.Sample{}, ts.Samples...),
+		}
+	}
+}
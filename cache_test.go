@@ -0,0 +1,275 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestLRU(t *testing.T) {
+	var evicted []string
+	l := newLRU(10, func(key string) { evicted = append(evicted, key) })
+	l.add("a", []byte("a"), 4)
+	l.add("b", []byte("b"), 4)
+	if _, ok := l.get("a"); !ok {
+		t.Fatal("Expected a to be cached")
+	}
+	// b is the least recently used entry now.
+	l.add("c", []byte("c"), 4)
+	if !reflect.DeepEqual(evicted, []string{"b"}) {
+		t.Errorf("Expected b to be evicted, got %v", evicted)
+	}
+	// Entries larger than the maximum size are evicted right away.
+	l.add("d", []byte("d"), 11)
+	if _, ok := l.get("d"); ok || l.bytes != 8 || !reflect.DeepEqual(evicted, []string{"b", "d"}) {
+		t.Errorf("Expected d not to be cached, got %d bytes and evicted %v", l.bytes, evicted)
+	}
+	// Replacing an entry updates its size.
+	l.add("a", []byte("A"), 6)
+	if v, _ := l.get("a"); string(v) != "A" || l.bytes != 10 {
+		t.Errorf("Unexpected value %q with %d bytes", v, l.bytes)
+	}
+}
+
+// rangeReader returns the samples of its series within the time range of
+// the queries, and records the queries. Queries spanning more than maxRange
+// milliseconds are rejected, if it is set.
+type rangeReader struct {
+	series   []*prompb.TimeSeries
+	queries  []*prompb.Query
+	maxRange int64
+}
+
+func (r *rangeReader) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	resp := &prompb.ReadResponse{}
+	for _, q := range req.Queries {
+		r.queries = append(r.queries, q)
+		if r.maxRange > 0 && q.EndTimestampMs-q.StartTimestampMs > r.maxRange {
+			return nil, limitError("time range exceeds the limit")
+		}
+		resp.Results = append(resp.Results, &prompb.QueryResult{Timeseries: sliceSeries(r.series, q.StartTimestampMs, q.EndTimestampMs)})
+	}
+	return resp, nil
+}
+
+func (r *rangeReader) Name() string {
+	return "range"
+}
+
+// minuteSeries returns a series with a sample per minute within [start, end).
+func minuteSeries(job string, start, end int64) *prompb.TimeSeries {
+	ts := &prompb.TimeSeries{Labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: job}}}
+	for t := start; t < end; t += 60000 {
+		ts.Samples = append(ts.Samples, prompb.Sample{Timestamp: t, Value: float64(t / 60000)})
+	}
+	return ts
+}
+
+func TestCachingReader(t *testing.T) {
+	const hour = int64(time.Hour / time.Millisecond)
+	now := 100 * hour
+	r := &rangeReader{series: []*prompb.TimeSeries{
+		minuteSeries("a", 90*hour, now),
+		// Only in the first bucket of the query.
+		minuteSeries("b", 90*hour, 96*hour),
+	}}
+	cache, err := newReadCache(log.NewNopLogger(), time.Hour, 10*time.Minute, 1<<20, "", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cache.now = func() time.Time { return time.Unix(0, now*int64(time.Millisecond)) }
+	cr := cachingReader{reader: r, cache: cache, scope: "range"}
+
+	query := &prompb.Query{
+		StartTimestampMs: 95*hour + 30*60000,
+		EndTimestampMs:   now,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+			{Type: prompb.LabelMatcher_RE, Name: "job", Value: ".+"},
+		},
+		Hints: &prompb.ReadHints{Func: "max_over_time", StepMs: 60000, RangeMs: 60000},
+	}
+	expected := []*prompb.TimeSeries{
+		minuteSeries("a", query.StartTimestampMs, now),
+		minuteSeries("b", query.StartTimestampMs, 96*hour),
+	}
+
+	hits := testutil.ToFloat64(readCacheHits.WithLabelValues("memory"))
+	misses := testutil.ToFloat64(readCacheMisses)
+	for i, matchers := range [][]*prompb.LabelMatcher{
+		query.Matchers,
+		// The order of the matchers doesn't matter.
+		{query.Matchers[1], query.Matchers[0]},
+	} {
+		r.queries = nil
+		q := *query
+		q.Matchers = matchers
+		resp, err := cr.Read(&prompb.ReadRequest{Queries: []*prompb.Query{&q}})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if len(resp.Results) != 1 || !reflect.DeepEqual(resp.Results[0].Timeseries, expected) {
+			t.Errorf("Unexpected result of read %d: %v", i, resp.Results)
+		}
+
+		// The buckets ending until 10 minutes ago are cached, the
+		// last one is read each time.
+		var expectedQueries []*prompb.Query
+		if i == 0 {
+			expectedQueries = append(expectedQueries, &prompb.Query{StartTimestampMs: 95 * hour, EndTimestampMs: 99*hour - 1, Matchers: matchers})
+		}
+		expectedQueries = append(expectedQueries, &prompb.Query{StartTimestampMs: 99 * hour, EndTimestampMs: now, Matchers: matchers})
+		if !reflect.DeepEqual(r.queries, expectedQueries) {
+			t.Errorf("Unexpected queries of read %d: %v", i, r.queries)
+		}
+	}
+	if got := testutil.ToFloat64(readCacheMisses) - misses; got != 4 {
+		t.Errorf("Expected 4 misses, got %v", got)
+	}
+	if got := testutil.ToFloat64(readCacheHits.WithLabelValues("memory")) - hits; got != 4 {
+		t.Errorf("Expected 4 hits, got %v", got)
+	}
+
+	// Queries within the last bucket aren't split.
+	r.queries = nil
+	recent := &prompb.Query{StartTimestampMs: 99*hour + 60000, EndTimestampMs: now, Matchers: query.Matchers, Hints: query.Hints}
+	if _, err := cr.Read(&prompb.ReadRequest{Queries: []*prompb.Query{recent}}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(r.queries) != 1 || r.queries[0] != recent {
+		t.Errorf("Expected the query to be passed on, got %v", r.queries)
+	}
+}
+
+func TestCachingReaderWithQueuedSamples(t *testing.T) {
+	const hour = int64(time.Hour / time.Millisecond)
+	now := 100 * hour
+	r := &rangeReader{series: []*prompb.TimeSeries{minuteSeries("a", 90*hour, now)}}
+	cache, err := newReadCache(log.NewNopLogger(), time.Hour, 0, 1<<20, "", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cache.now = func() time.Time { return time.Unix(0, now*int64(time.Millisecond)) }
+	queued := true
+	cr := cachingReader{reader: r, cache: cache, scope: "range", queued: func() bool { return queued }}
+
+	query := &prompb.Query{
+		StartTimestampMs: 95 * hour,
+		EndTimestampMs:   97*hour - 1,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+	}
+	// Buckets are only cached once no samples are queued anymore.
+	for i, expected := range []int{1, 1, 0} {
+		if i == 1 {
+			queued = false
+		}
+		r.queries = nil
+		if _, err := cr.Read(&prompb.ReadRequest{Queries: []*prompb.Query{query}}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if len(r.queries) != expected {
+			t.Errorf("Expected %d queries for read %d, got %d", expected, i, len(r.queries))
+		}
+	}
+}
+
+func TestReadCacheDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	series := []*prompb.TimeSeries{minuteSeries("a", 0, 600000)}
+	cache, err := newReadCache(log.NewNopLogger(), time.Hour, 0, 1<<20, dir, 1<<20)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cr := cachingReader{cache: cache, scope: "disk"}
+	key := cr.key(nil, 0, 3600000)
+	cache.put(key, series)
+
+	// A new cache finds the results of the previous one on disk, and
+	// evicts them once they exceed its maximum size.
+	cache, err = newReadCache(log.NewNopLogger(), time.Hour, 0, 1<<20, dir, 1<<20)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	hits := testutil.ToFloat64(readCacheHits.WithLabelValues("disk"))
+	got, ok := cache.get(key)
+	if !ok || !reflect.DeepEqual(got, series) {
+		t.Fatalf("Expected %v from disk, got %v", series, got)
+	}
+	if testutil.ToFloat64(readCacheHits.WithLabelValues("disk")) != hits+1 {
+		t.Error("Expected a disk hit")
+	}
+
+	if _, err := newReadCache(log.NewNopLogger(), time.Hour, 0, 1<<20, dir, 1); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected evicted files to be removed, got %d files", len(files))
+	}
+}
+
+func TestReadCacheDiskConcurrency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	series := []*prompb.TimeSeries{minuteSeries("a", 0, 600000)}
+	b, err := (&prompb.QueryResult{Timeseries: series}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Memory holds nothing and disk holds two buckets, so that buckets
+	// are read from disk while others are written and evicted.
+	cache, err := newReadCache(log.NewNopLogger(), time.Hour, 0, 0, dir, int64(2*len(b)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cr := cachingReader{cache: cache, scope: "disk"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				key := cr.key(nil, int64((i+j)%4)*3600000, int64((i+j)%4+1)*3600000)
+				cache.put(key, series)
+				if got, ok := cache.get(key); ok && !reflect.DeepEqual(got, series) {
+					t.Errorf("Expected %v, got %v", series, got)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if files, _ := ioutil.ReadDir(dir); len(files) > 2 {
+		t.Errorf("Expected at most 2 files, got %d", len(files))
+	}
+}
@@ -0,0 +1,517 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+
+	influx "github.com/influxdata/influxdb/client/v2"
+
+	"graphite"
+	"influxdb"
+	"opentsdb"
+
+	"github.com/prometheus/prometheus/pkg/relabel"
+)
+
+// Names of remote storages are used as metric label values and as directory
+// names of their queues.
+var storageNameRE = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]*$`)
+
+// fileConfig is the format of the configuration file. It declares any number
+// of named remote storages of each type.
+type fileConfig struct {
+	Graphite []*graphiteConfig `yaml:"graphite,omitempty"`
+	OpenTSDB []*opentsdbConfig `yaml:"opentsdb,omitempty"`
+	InfluxDB []*influxdbConfig `yaml:"influxdb,omitempty"`
+
+	InfluxDB2 []*influxdb2Config `yaml:"influxdb2,omitempty"`
+
+	Tenants map[string]*tenantConfig `yaml:"tenants,omitempty"`
+}
+
+// tenantConfig overrides where the data of a tenant is stored. Settings which
+// are left empty are derived from the tenant ID.
+type tenantConfig struct {
+	InfluxDBDatabase        string `yaml:"influxdb_database,omitempty"`
+	InfluxDBRetentionPolicy string `yaml:"influxdb_retention_policy,omitempty"`
+	InfluxDB2Bucket         string `yaml:"influxdb2_bucket,omitempty"`
+	GraphitePrefix          string `yaml:"graphite_prefix,omitempty"`
+}
+
+// storageConfig is the configuration of a single remote storage.
+type storageConfig interface {
+	// name returns the name of the remote storage.
+	name() string
+	// build creates the clients for the remote storage.
+	build(logger log.Logger) (*remoteStorage, error)
+	// forTenant returns the configuration of the remote storage for the
+	// data of a tenant, with the overrides of tc, which may be nil.
+	forTenant(tenant string, tc *tenantConfig) (storageConfig, error)
+}
+
+// graphiteConfig configures a Graphite remote storage.
+type graphiteConfig struct {
+	Name      string          `yaml:"name"`
+	Address   string          `yaml:"address"`
+	Transport string          `yaml:"transport,omitempty"`
+	Prefix    string          `yaml:"prefix,omitempty"`
+	Format    graphite.Format `yaml:"format,omitempty"`
+	WebURL    string          `yaml:"web_url,omitempty"`
+	Timeout   model.Duration  `yaml:"timeout,omitempty"`
+
+	MaxConnections int            `yaml:"max_connections,omitempty"`
+	BatchSize      int            `yaml:"batch_size,omitempty"`
+	FlushInterval  model.Duration `yaml:"flush_interval,omitempty"`
+
+	WriteRelabelConfigs []*relabel.Config `yaml:"write_relabel_configs,omitempty"`
+}
+
+// opentsdbConfig configures an OpenTSDB remote storage.
+type opentsdbConfig struct {
+	Name      string         `yaml:"name"`
+	URL       string         `yaml:"url"`
+	Timeout   model.Duration `yaml:"timeout,omitempty"`
+	TenantTag string         `yaml:"tenant_tag,omitempty"`
+
+	WriteRelabelConfigs []*relabel.Config `yaml:"write_relabel_configs,omitempty"`
+
+	// tenant is set for the configurations returned by forTenant.
+	tenant string
+}
+
+// influxdbConfig configures an InfluxDB remote storage.
+type influxdbConfig struct {
+	Name            string         `yaml:"name"`
+	URL             string         `yaml:"url"`
+	Database        string         `yaml:"database,omitempty"`
+	RetentionPolicy string         `yaml:"retention_policy,omitempty"`
+	Username        string         `yaml:"username,omitempty"`
+	Password        string         `yaml:"password,omitempty"`
+	Timeout         model.Duration `yaml:"timeout,omitempty"`
+	UDPPayloadSize  int            `yaml:"udp_payload_size,omitempty"`
+	GroupHistograms bool           `yaml:"group_histograms,omitempty"`
+	WriteMetadata   bool           `yaml:"write_metadata,omitempty"`
+	PushDownHints   bool           `yaml:"push_down_read_hints,omitempty"`
+	MaxReadSeries   int            `yaml:"max_read_series,omitempty"`
+	MaxReadSamples  int            `yaml:"max_read_samples,omitempty"`
+	MaxReadRange    model.Duration `yaml:"max_read_time_range,omitempty"`
+
+	WriteRelabelConfigs []*relabel.Config `yaml:"write_relabel_configs,omitempty"`
+}
+
+// influxdb2Config configures an InfluxDB 2.x remote storage.
+type influxdb2Config struct {
+	Name    string         `yaml:"name"`
+	URL     string         `yaml:"url"`
+	Org     string         `yaml:"org"`
+	Bucket  string         `yaml:"bucket"`
+	Token   string         `yaml:"token,omitempty"`
+	Timeout model.Duration `yaml:"timeout,omitempty"`
+
+	WriteRelabelConfigs []*relabel.Config `yaml:"write_relabel_configs,omitempty"`
+}
+
+// loadConfigFile reads and validates the configuration file. Remote storages
+// which don't configure a timeout use the given one.
+func loadConfigFile(filename string, timeout time.Duration) (*fileConfig, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	fc := &fileConfig{}
+	if err := yaml.UnmarshalStrict(b, fc); err != nil {
+		return nil, errors.Wrapf(err, "error parsing %s", filename)
+	}
+	fc.setDefaults(timeout)
+	if err := fc.validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid configuration in %s", filename)
+	}
+	return fc, nil
+}
+
+// fileConfigFromFlags returns the configuration of the remote storages given
+// by the command-line flags, which allow a single remote storage of each
+// type. The storages are named after their type.
+func fileConfigFromFlags(cfg *config) *fileConfig {
+	fc := &fileConfig{}
+	if cfg.graphiteAddress != "" {
+		fc.Graphite = append(fc.Graphite, &graphiteConfig{
+			Name:      "graphite",
+			Address:   cfg.graphiteAddress,
+			Transport: cfg.graphiteTransport,
+			Prefix:    cfg.graphitePrefix,
+			Format:    graphite.Format(cfg.graphiteFormat),
+			WebURL:    cfg.graphiteWebURL,
+		})
+	}
+	if cfg.opentsdbURL != "" {
+		fc.OpenTSDB = append(fc.OpenTSDB, &opentsdbConfig{
+			Name: "opentsdb",
+			URL:  cfg.opentsdbURL,
+		})
+	}
+	if cfg.influxdbURL != "" {
+		fc.InfluxDB = append(fc.InfluxDB, &influxdbConfig{
+			Name:            "influxdb",
+			URL:             cfg.influxdbURL,
+			Database:        cfg.influxdbDatabase,
+			RetentionPolicy: cfg.influxdbRetentionPolicy,
+			Username:        cfg.influxdbUsername,
+			Password:        cfg.influxdbPassword,
+			UDPPayloadSize:  cfg.influxdbUDPPayloadSize,
+			GroupHistograms: cfg.influxdbGroupHistograms,
+			WriteMetadata:   cfg.influxdbWriteMetadata,
+			PushDownHints:   cfg.influxdbPushDownHints,
+			MaxReadSeries:   cfg.influxdbMaxReadSeries,
+			MaxReadSamples:  cfg.influxdbMaxReadSamples,
+			MaxReadRange:    model.Duration(cfg.influxdbMaxReadRange),
+		})
+	}
+	if cfg.influxdb2URL != "" {
+		fc.InfluxDB2 = append(fc.InfluxDB2, &influxdb2Config{
+			Name:   "influxdb2",
+			URL:    cfg.influxdb2URL,
+			Org:    cfg.influxdb2Org,
+			Bucket: cfg.influxdb2Bucket,
+			Token:  cfg.influxdb2Token,
+		})
+	}
+	fc.setDefaults(cfg.remoteTimeout)
+	return fc
+}
+
+func (fc *fileConfig) setDefaults(timeout time.Duration) {
+	for _, c := range fc.Graphite {
+		if c.Transport == "" {
+			c.Transport = "tcp"
+		}
+		if c.Format == "" {
+			c.Format = graphite.FormatPath
+		}
+		if c.MaxConnections == 0 {
+			c.MaxConnections = 4
+		}
+		if c.BatchSize == 0 {
+			c.BatchSize = 5000
+		}
+		if c.Timeout == 0 {
+			c.Timeout = model.Duration(timeout)
+		}
+	}
+	for _, c := range fc.OpenTSDB {
+		if c.Timeout == 0 {
+			c.Timeout = model.Duration(timeout)
+		}
+		if c.TenantTag == "" {
+			c.TenantTag = "tenant"
+		}
+	}
+	for _, c := range fc.InfluxDB {
+		if c.Database == "" {
+			c.Database = "prometheus"
+		}
+		if c.RetentionPolicy == "" {
+			c.RetentionPolicy = "autogen"
+		}
+		if c.Timeout == 0 {
+			c.Timeout = model.Duration(timeout)
+		}
+	}
+	for _, c := range fc.InfluxDB2 {
+		if c.Timeout == 0 {
+			c.Timeout = model.Duration(timeout)
+		}
+	}
+}
+
+// storages returns the configurations of all remote storages, in the order
+// in which they are declared.
+func (fc *fileConfig) storages() []storageConfig {
+	var scs []storageConfig
+	for _, c := range fc.Graphite {
+		scs = append(scs, c)
+	}
+	for _, c := range fc.OpenTSDB {
+		scs = append(scs, c)
+	}
+	for _, c := range fc.InfluxDB {
+		scs = append(scs, c)
+	}
+	for _, c := range fc.InfluxDB2 {
+		scs = append(scs, c)
+	}
+	return scs
+}
+
+func (fc *fileConfig) validate() error {
+	names := map[string]struct{}{}
+	for _, sc := range fc.storages() {
+		name := sc.name()
+		if !storageNameRE.MatchString(name) {
+			return errors.Errorf("invalid remote storage name %q", name)
+		}
+		if _, ok := names[name]; ok {
+			return errors.Errorf("duplicate remote storage name %q", name)
+		}
+		names[name] = struct{}{}
+	}
+	for tenant := range fc.Tenants {
+		if !tenantIDRE.MatchString(tenant) {
+			return errors.Errorf("invalid tenant ID %q", tenant)
+		}
+	}
+	for _, c := range fc.Graphite {
+		if c.Address == "" {
+			return errors.Errorf("missing address for Graphite storage %q", c.Name)
+		}
+		if c.MaxConnections < 0 || c.BatchSize < 0 || c.FlushInterval < 0 {
+			return errors.Errorf("negative connection or batch settings for Graphite storage %q", c.Name)
+		}
+		if c.Format != graphite.FormatPath && c.Format != graphite.FormatTagged {
+			return errors.Errorf("invalid format %q for Graphite storage %q", c.Format, c.Name)
+		}
+		if _, err := url.Parse(c.WebURL); err != nil {
+			return errors.Errorf("invalid web URL %q for Graphite storage %q", c.WebURL, c.Name)
+		}
+		if c.WebURL != "" && c.Format == graphite.FormatTagged {
+			return errors.Errorf("reading is not supported with the tagged format for Graphite storage %q", c.Name)
+		}
+	}
+	for _, c := range fc.OpenTSDB {
+		if _, err := url.Parse(c.URL); err != nil || c.URL == "" {
+			return errors.Errorf("invalid URL %q for OpenTSDB storage %q", c.URL, c.Name)
+		}
+		if !model.LabelName(c.TenantTag).IsValid() {
+			return errors.Errorf("invalid tenant tag %q for OpenTSDB storage %q", c.TenantTag, c.Name)
+		}
+	}
+	for _, c := range fc.InfluxDB {
+		if _, err := url.Parse(c.URL); err != nil || c.URL == "" {
+			return errors.Errorf("invalid URL %q for InfluxDB storage %q", c.URL, c.Name)
+		}
+		if c.UDPPayloadSize < 0 {
+			return errors.Errorf("negative UDP payload size for InfluxDB storage %q", c.Name)
+		}
+		if c.MaxReadSeries < 0 || c.MaxReadSamples < 0 || c.MaxReadRange < 0 {
+			return errors.Errorf("negative read limits for InfluxDB storage %q", c.Name)
+		}
+	}
+	for _, c := range fc.InfluxDB2 {
+		if _, err := url.Parse(c.URL); err != nil || c.URL == "" {
+			return errors.Errorf("invalid URL %q for InfluxDB 2.x storage %q", c.URL, c.Name)
+		}
+		if c.Org == "" || c.Bucket == "" {
+			return errors.Errorf("missing org or bucket for InfluxDB 2.x storage %q", c.Name)
+		}
+	}
+	return nil
+}
+
+func (c *graphiteConfig) name() string { return c.Name }
+
+func (c *graphiteConfig) forTenant(tenant string, tc *tenantConfig) (storageConfig, error) {
+	tcfg := *c
+	tcfg.Prefix = c.Prefix + tenant + "."
+	if tc != nil && tc.GraphitePrefix != "" {
+		tcfg.Prefix = tc.GraphitePrefix
+	}
+	return &tcfg, nil
+}
+
+func (c *graphiteConfig) build(logger log.Logger) (*remoteStorage, error) {
+	client := graphite.NewClient(
+		log.With(logger, "storage", "Graphite", "name", c.Name),
+		graphite.Config{
+			Address:        c.Address,
+			Transport:      c.Transport,
+			Timeout:        time.Duration(c.Timeout),
+			Prefix:         c.Prefix,
+			Format:         c.Format,
+			WebURL:         c.WebURL,
+			MaxConnections: c.MaxConnections,
+			BatchSize:      c.BatchSize,
+			FlushInterval:  time.Duration(c.FlushInterval),
+		},
+	)
+	rs := &remoteStorage{
+		config: c,
+		writer: newRelabelWriter(namedWriter{writer: client, name: c.Name}, c.WriteRelabelConfigs),
+		closer: client,
+	}
+	if c.WebURL != "" {
+		rs.reader = namedReader{reader: client, name: c.Name}
+	}
+	return rs, nil
+}
+
+func (c *opentsdbConfig) name() string { return c.Name }
+
+// The series of all tenants share OpenTSDB, so they are told apart by a tag
+// which is set on write and matched on read.
+func (c *opentsdbConfig) forTenant(tenant string, tc *tenantConfig) (storageConfig, error) {
+	tcfg := *c
+	tcfg.tenant = tenant
+	return &tcfg, nil
+}
+
+func (c *opentsdbConfig) build(logger log.Logger) (*remoteStorage, error) {
+	client := opentsdb.NewClient(
+		log.With(logger, "storage", "OpenTSDB", "name", c.Name),
+		c.URL,
+		time.Duration(c.Timeout),
+	)
+	// Series of tenants are stored alongside the others, so reads without
+	// a tenant are restricted to series without the tenant tag.
+	reader := namedReader{reader: tenantTagReader{reader: client, tag: c.TenantTag, tenant: c.tenant}, name: c.Name}
+	if c.tenant == "" {
+		return &remoteStorage{
+			config: c,
+			writer: newRelabelWriter(namedWriter{writer: client, name: c.Name}, c.WriteRelabelConfigs),
+			reader: reader,
+		}, nil
+	}
+
+	// The tenant tag is set after the write relabeling, so that it can't
+	// be dropped or overwritten by it.
+	relabelConfigs := append([]*relabel.Config{}, c.WriteRelabelConfigs...)
+	relabelConfigs = append(relabelConfigs, &relabel.Config{
+		Regex:       relabel.MustNewRegexp("(.*)"),
+		Separator:   ";",
+		TargetLabel: c.TenantTag,
+		Replacement: c.tenant,
+		Action:      relabel.Replace,
+	})
+	return &remoteStorage{
+		config: c,
+		writer: newRelabelWriter(namedWriter{writer: client, name: c.Name}, relabelConfigs),
+		reader: reader,
+	}, nil
+}
+
+func (c *influxdbConfig) name() string { return c.Name }
+
+func (c *influxdbConfig) forTenant(tenant string, tc *tenantConfig) (storageConfig, error) {
+	if strings.HasPrefix(c.URL, "udp://") {
+		return nil, errors.Errorf("InfluxDB storage %q can't store the data of tenants over UDP", c.Name)
+	}
+	tcfg := *c
+	tcfg.Database = tenant
+	if tc != nil && tc.InfluxDBDatabase != "" {
+		tcfg.Database = tc.InfluxDBDatabase
+	}
+	if tc != nil && tc.InfluxDBRetentionPolicy != "" {
+		tcfg.RetentionPolicy = tc.InfluxDBRetentionPolicy
+	}
+	return &tcfg, nil
+}
+
+func (c *influxdbConfig) readLimited() bool {
+	return c.MaxReadSeries > 0 || c.MaxReadSamples > 0 || c.MaxReadRange > 0
+}
+
+func (c *influxdbConfig) build(logger log.Logger) (*remoteStorage, error) {
+	url, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse InfluxDB URL %q", c.URL)
+	}
+	logger = log.With(logger, "storage", "InfluxDB", "name", c.Name)
+	opts := influxdb.Options{
+		GroupHistograms:   c.GroupHistograms,
+		WriteMetadata:     c.WriteMetadata,
+		PushDownReadHints: c.PushDownHints,
+		ReadLimits: influxdb.ReadLimits{
+			MaxSeries:    c.MaxReadSeries,
+			MaxSamples:   c.MaxReadSamples,
+			MaxTimeRange: time.Duration(c.MaxReadRange),
+		},
+	}
+
+	// UDP is write-only.
+	if url.Scheme == "udp" {
+		client, err := influxdb.NewUDPClient(logger, influx.UDPConfig{
+			Addr:        url.Host,
+			PayloadSize: c.UDPPayloadSize,
+		}, opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create InfluxDB UDP client for %q", c.URL)
+		}
+		return &remoteStorage{
+			config:    c,
+			writer:    newRelabelWriter(namedWriter{writer: client, name: c.Name}, c.WriteRelabelConfigs),
+			collector: client,
+			closer:    client,
+		}, nil
+	}
+
+	conf := influx.HTTPConfig{
+		Addr:     url.String(),
+		Username: c.Username,
+		Password: c.Password,
+		Timeout:  time.Duration(c.Timeout),
+	}
+	client := influxdb.NewClient(
+		logger,
+		conf,
+		c.Database,
+		c.RetentionPolicy,
+		opts,
+	)
+	return &remoteStorage{
+		config:    c,
+		writer:    newRelabelWriter(namedWriter{writer: client, name: c.Name}, c.WriteRelabelConfigs),
+		reader:    namedReader{reader: client, name: c.Name},
+		collector: client,
+		closer:    client,
+	}, nil
+}
+
+func (c *influxdb2Config) name() string { return c.Name }
+
+func (c *influxdb2Config) forTenant(tenant string, tc *tenantConfig) (storageConfig, error) {
+	tcfg := *c
+	tcfg.Bucket = tenant
+	if tc != nil && tc.InfluxDB2Bucket != "" {
+		tcfg.Bucket = tc.InfluxDB2Bucket
+	}
+	return &tcfg, nil
+}
+
+func (c *influxdb2Config) build(logger log.Logger) (*remoteStorage, error) {
+	client := influxdb.NewV2Client(
+		log.With(logger, "storage", "InfluxDB2", "name", c.Name),
+		influxdb.V2Config{
+			URL:     c.URL,
+			Org:     c.Org,
+			Bucket:  c.Bucket,
+			Token:   c.Token,
+			Timeout: time.Duration(c.Timeout),
+		},
+	)
+	return &remoteStorage{
+		config:    c,
+		writer:    newRelabelWriter(namedWriter{writer: client, name: c.Name}, c.WriteRelabelConfigs),
+		reader:    namedReader{reader: client, name: c.Name},
+		collector: client,
+	}, nil
+}
@@ -0,0 +1,193 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"graphite"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	filename := writeConfigFile(t, `
+graphite:
+  - name: carbon
+    address: localhost:2003
+    prefix: prom.
+influxdb:
+  - name: old-cluster
+    url: http://old:8086/
+  - name: new-cluster
+    url: http://new:8086/
+    database: metrics
+    timeout: 5s
+    write_metadata: true
+    push_down_read_hints: true
+    max_read_series: 10000
+    max_read_time_range: 1d
+influxdb2:
+  - name: influx2
+    url: http://influx2:8086/
+    org: example
+    bucket: prometheus
+`)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	fc, err := loadConfigFile(filename, 30*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := &fileConfig{
+		Graphite: []*graphiteConfig{
+			{Name: "carbon", Address: "localhost:2003", Transport: "tcp", Prefix: "prom.", Format: graphite.FormatPath, Timeout: model.Duration(30 * time.Second), MaxConnections: 4, BatchSize: 5000},
+		},
+		InfluxDB: []*influxdbConfig{
+			{Name: "old-cluster", URL: "http://old:8086/", Database: "prometheus", RetentionPolicy: "autogen", Timeout: model.Duration(30 * time.Second)},
+			{Name: "new-cluster", URL: "http://new:8086/", Database: "metrics", RetentionPolicy: "autogen", Timeout: model.Duration(5 * time.Second), WriteMetadata: true, PushDownHints: true, MaxReadSeries: 10000, MaxReadRange: model.Duration(24 * time.Hour)},
+		},
+		InfluxDB2: []*influxdb2Config{
+			{Name: "influx2", URL: "http://influx2:8086/", Org: "example", Bucket: "prometheus", Timeout: model.Duration(30 * time.Second)},
+		},
+	}
+	if !reflect.DeepEqual(fc, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, fc)
+	}
+}
+
+func TestLoadConfigFileInvalid(t *testing.T) {
+	for _, content := range []string{
+		// Unknown field.
+		"influxdb:\n  - name: a\n    url: http://a/\n    db: x\n",
+		// Missing address.
+		"graphite:\n  - name: a\n",
+		// Duplicate name across types.
+		"graphite:\n  - name: a\n    address: localhost:2003\nopentsdb:\n  - name: a\n    url: http://a/\n",
+		// Unknown Graphite format.
+		"graphite:\n  - name: a\n    address: localhost:2003\n    format: dotted\n",
+		// Missing InfluxDB 2.x org.
+		"influxdb2:\n  - name: a\n    url: http://a/\n    bucket: b\n",
+		// Invalid name.
+		"opentsdb:\n  - name: ../a\n    url: http://a/\n",
+		// Negative read limit.
+		"influxdb:\n  - name: a\n    url: http://a/\n    max_read_samples: -1\n",
+		// Invalid tenant ID.
+		"tenants:\n  team.a:\n    influxdb_database: a\n",
+	} {
+		filename := writeConfigFile(t, content)
+		if _, err := loadConfigFile(filename, time.Second); err == nil {
+			t.Errorf("Expected error for %q, got none", content)
+		}
+		os.RemoveAll(filepath.Dir(filename))
+	}
+}
+
+func TestFileConfigFromFlags(t *testing.T) {
+	cfg := &config{
+		graphiteAddress:         "localhost:2003",
+		graphiteTransport:       "udp",
+		influxdbURL:             "http://localhost:8086/",
+		influxdbDatabase:        "prometheus",
+		influxdbRetentionPolicy: "autogen",
+		remoteTimeout:           time.Second,
+	}
+	fc := fileConfigFromFlags(cfg)
+	if err := fc.validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var names []string
+	for _, sc := range fc.storages() {
+		names = append(names, sc.name())
+	}
+	if expected := []string{"graphite", "influxdb"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected storages %v, got %v", expected, names)
+	}
+	if fc.Graphite[0].Transport != "udp" || fc.Graphite[0].Timeout != model.Duration(time.Second) {
+		t.Errorf("Unexpected Graphite configuration %+v", fc.Graphite[0])
+	}
+}
+
+func TestStorageConfigForTenant(t *testing.T) {
+	fc := &fileConfig{
+		Graphite: []*graphiteConfig{{Name: "carbon", Address: "localhost:2003", Prefix: "prom."}},
+		OpenTSDB: []*opentsdbConfig{{Name: "tsdb", URL: "http://tsdb/"}},
+		InfluxDB: []*influxdbConfig{{Name: "influx", URL: "http://influx:8086/", RetentionPolicy: "weeks"}},
+	}
+	fc.setDefaults(time.Second)
+
+	for _, tc := range []struct {
+		tenant   string
+		config   *tenantConfig
+		expected []storageConfig
+	}{
+		{
+			tenant: "team-a",
+			expected: []storageConfig{
+				&graphiteConfig{Name: "carbon", Address: "localhost:2003", Transport: "tcp", Prefix: "prom.team-a.", Format: graphite.FormatPath, Timeout: model.Duration(time.Second), MaxConnections: 4, BatchSize: 5000},
+				&opentsdbConfig{Name: "tsdb", URL: "http://tsdb/", Timeout: model.Duration(time.Second), TenantTag: "tenant", tenant: "team-a"},
+				&influxdbConfig{Name: "influx", URL: "http://influx:8086/", Database: "team-a", RetentionPolicy: "weeks", Timeout: model.Duration(time.Second)},
+			},
+		},
+		{
+			tenant: "team-b",
+			config: &tenantConfig{InfluxDBDatabase: "b", InfluxDBRetentionPolicy: "days", GraphitePrefix: "b."},
+			expected: []storageConfig{
+				&graphiteConfig{Name: "carbon", Address: "localhost:2003", Transport: "tcp", Prefix: "b.", Format: graphite.FormatPath, Timeout: model.Duration(time.Second), MaxConnections: 4, BatchSize: 5000},
+				&opentsdbConfig{Name: "tsdb", URL: "http://tsdb/", Timeout: model.Duration(time.Second), TenantTag: "tenant", tenant: "team-b"},
+				&influxdbConfig{Name: "influx", URL: "http://influx:8086/", Database: "b", RetentionPolicy: "days", Timeout: model.Duration(time.Second)},
+			},
+		},
+	} {
+		var got []storageConfig
+		for _, sc := range fc.storages() {
+			tsc, err := sc.forTenant(tc.tenant, tc.config)
+			if err != nil {
+				t.Fatalf("Unexpected error for %s: %s", tc.tenant, err)
+			}
+			got = append(got, tsc)
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Expected %+v for %s, got %+v", tc.expected, tc.tenant, got)
+		}
+	}
+
+	// The base configuration is left as it is.
+	if fc.InfluxDB[0].Database != "prometheus" || fc.OpenTSDB[0].tenant != "" {
+		t.Errorf("Unexpected change of the base configuration %+v", fc)
+	}
+
+	udp := &influxdbConfig{Name: "udp", URL: "udp://localhost:8089"}
+	if _, err := udp.forTenant("team-a", nil); err == nil {
+		t.Error("Expected error for InfluxDB over UDP, got none")
+	}
+}
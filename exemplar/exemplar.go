@@ -0,0 +1,77 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package exemplar holds the exemplars of series, as they are received by
+// remote write and returned by the exemplar query API of Prometheus.
+package exemplar
+
+import (
+	"sort"
+
+	"github.com/prometheus/common/model"
+)
+
+// Exemplar is a sample with its own labels, like the ID of a trace which
+// contributed to the sample.
+type Exemplar struct {
+	Labels    model.LabelSet    `json:"labels"`
+	Value     model.SampleValue `json:"value"`
+	Timestamp model.Time        `json:"timestamp"`
+}
+
+// Series is a series with its exemplars. It marshals to the JSON of a result
+// of the /api/v1/query_exemplars endpoint of Prometheus.
+type Series struct {
+	SeriesLabels model.LabelSet `json:"seriesLabels"`
+	Exemplars    []Exemplar     `json:"exemplars"`
+}
+
+// Merge merges series with the same labels, as returned by several
+// storages, keeping the exemplars of each series sorted by timestamp.
+// Exemplars with the same labels and timestamp are only kept once.
+func Merge(series ...[]Series) []Series {
+	byLabels := map[model.Fingerprint]*Series{}
+	var result []*Series
+	for _, ss := range series {
+		for _, s := range ss {
+			fp := s.SeriesLabels.Fingerprint()
+			m, ok := byLabels[fp]
+			if !ok {
+				m = &Series{SeriesLabels: s.SeriesLabels}
+				byLabels[fp] = m
+				result = append(result, m)
+			}
+			m.Exemplars = append(m.Exemplars, s.Exemplars...)
+		}
+	}
+
+	merged := make([]Series, 0, len(result))
+	for _, s := range result {
+		sort.SliceStable(s.Exemplars, func(i, j int) bool {
+			return s.Exemplars[i].Timestamp < s.Exemplars[j].Timestamp
+		})
+		exemplars := s.Exemplars[:0]
+		for i, e := range s.Exemplars {
+			if i > 0 {
+				prev := exemplars[len(exemplars)-1]
+				if prev.Timestamp == e.Timestamp && prev.Labels.Equal(e.Labels) {
+					continue
+				}
+			}
+			exemplars = append(exemplars, e)
+		}
+		s.Exemplars = exemplars
+		merged = append(merged, *s)
+	}
+	return merged
+}
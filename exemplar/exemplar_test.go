@@ -0,0 +1,57 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exemplar
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestMerge(t *testing.T) {
+	up := model.LabelSet{"__name__": "up"}
+	a := model.LabelSet{"trace_id": "a"}
+	b := model.LabelSet{"trace_id": "b"}
+
+	merged := Merge(
+		[]Series{{SeriesLabels: up, Exemplars: []Exemplar{{Labels: a, Value: 1, Timestamp: 2000}}}},
+		[]Series{
+			{SeriesLabels: up, Exemplars: []Exemplar{{Labels: b, Value: 2, Timestamp: 1000}, {Labels: a, Value: 1, Timestamp: 2000}}},
+			{SeriesLabels: model.LabelSet{"__name__": "down"}, Exemplars: []Exemplar{{Labels: a, Value: 3, Timestamp: 1000}}},
+		},
+	)
+	expected := []Series{
+		{SeriesLabels: up, Exemplars: []Exemplar{{Labels: b, Value: 2, Timestamp: 1000}, {Labels: a, Value: 1, Timestamp: 2000}}},
+		{SeriesLabels: model.LabelSet{"__name__": "down"}, Exemplars: []Exemplar{{Labels: a, Value: 3, Timestamp: 1000}}},
+	}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Expected %v, got %v", expected, merged)
+	}
+}
+
+func TestSeriesJSON(t *testing.T) {
+	b, err := json.Marshal(Series{
+		SeriesLabels: model.LabelSet{"__name__": "rpc_seconds_bucket"},
+		Exemplars:    []Exemplar{{Labels: model.LabelSet{"trace_id": "abc"}, Value: 0.5, Timestamp: 1600096945479}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := `{"seriesLabels":{"__name__":"rpc_seconds_bucket"},"exemplars":[{"labels":{"trace_id":"abc"},"value":"0.5","timestamp":1600096945.479}]}`
+	if string(b) != expected {
+		t.Errorf("Expected %s, got %s", expected, b)
+	}
+}
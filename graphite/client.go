@@ -19,6 +19,7 @@ import (
 	"math"
 	"net"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -34,19 +35,85 @@ type Client struct {
 	transport string
 	timeout   time.Duration
 	prefix    string
+	format    Format
+	webURL    string
+
+	batchSize     int
+	flushInterval time.Duration
+
+	// conns holds idle connections, sem limits the number of connections
+	// in use.
+	mtx    sync.Mutex
+	batch  *batch
+	conns  chan net.Conn
+	sem    chan struct{}
+	closed bool
+}
+
+// Format is the format in which metrics are sent to Graphite.
+type Format string
+
+const (
+	// FormatPath encodes all labels into the dotted metric path.
+	FormatPath Format = "path"
+	// FormatTagged sends labels as Graphite tags, which are supported
+	// since Graphite 1.1.
+	FormatTagged Format = "tagged"
+)
+
+// TransportPickle is the transport which sends samples to the pickle
+// receiver of Carbon over TCP.
+const TransportPickle = "pickle"
+
+// Config configures a Client.
+type Config struct {
+	// Address is the host:port of the Graphite server.
+	Address string
+	// Transport is the network used to connect to Address, like "tcp" or
+	// "udp", which use the plaintext protocol, or TransportPickle.
+	Transport string
+	// Timeout is used for connecting, writing and reading.
+	Timeout time.Duration
+	// Prefix is prepended to all metric paths.
+	Prefix string
+	// Format is the format of the metric paths.
+	Format Format
+	// WebURL is the URL of the Graphite web API. Samples can only be read
+	// back if it is set and the path format is used.
+	WebURL string
+
+	// MaxConnections limits the number of connections to Graphite, which
+	// are kept open between writes.
+	MaxConnections int
+	// BatchSize is the number of samples at which a batch is sent right
+	// away.
+	BatchSize int
+	// FlushInterval is the time samples are held back so that they can be
+	// sent together with the samples of concurrent writes. Each write is
+	// sent separately, if zero.
+	FlushInterval time.Duration
 }
 
 // NewClient creates a new Client.
-func NewClient(logger log.Logger, address string, transport string, timeout time.Duration, prefix string) *Client {
+func NewClient(logger log.Logger, conf Config) *Client {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
+	if conf.MaxConnections <= 0 {
+		conf.MaxConnections = 1
+	}
 	return &Client{
-		logger:    logger,
-		address:   address,
-		transport: transport,
-		timeout:   timeout,
-		prefix:    prefix,
+		logger:        logger,
+		address:       conf.Address,
+		transport:     conf.Transport,
+		timeout:       conf.Timeout,
+		prefix:        conf.Prefix,
+		format:        conf.Format,
+		webURL:        conf.WebURL,
+		batchSize:     conf.BatchSize,
+		flushInterval: conf.FlushInterval,
+		conns:         make(chan net.Conn, conf.MaxConnections),
+		sem:           make(chan struct{}, conf.MaxConnections),
 	}
 }
 
@@ -79,31 +146,67 @@ func pathFromMetric(m model.Metric, prefix string) string {
 	return buffer.String()
 }
 
-// Write sends a batch of samples to Graphite.
-func (c *Client) Write(samples model.Samples) error {
-	conn, err := net.DialTimeout(c.transport, c.address, c.timeout)
-	if err != nil {
-		return err
+// taggedPathFromMetric returns the tagged series name of a metric, like
+// "name;label1=value1;label2=value2". Labels with empty values are left out,
+// as Graphite doesn't allow empty tag values.
+func taggedPathFromMetric(m model.Metric, prefix string) string {
+	var buffer bytes.Buffer
+
+	buffer.WriteString(escapeTag(model.LabelValue(prefix) + m[model.MetricNameLabel]))
+
+	labels := make(model.LabelNames, 0, len(m))
+	for l := range m {
+		labels = append(labels, l)
 	}
-	defer conn.Close()
+	sort.Sort(labels)
 
-	var buf bytes.Buffer
+	for _, l := range labels {
+		v := m[l]
+		if l == model.MetricNameLabel || len(l) == 0 || len(v) == 0 {
+			continue
+		}
+		// Label names only contain characters which are valid in tag
+		// names.
+		buffer.WriteString(fmt.Sprintf(
+			";%s=%s", string(l), escapeTag(v)))
+	}
+	return buffer.String()
+}
+
+func (c *Client) path(m model.Metric) string {
+	if c.format == FormatTagged {
+		return taggedPathFromMetric(m, c.prefix)
+	}
+	return pathFromMetric(m, c.prefix)
+}
+
+// Write sends a batch of samples to Graphite. The samples may be sent
+// together with the ones of concurrent writes, Write returns once they were
+// sent.
+func (c *Client) Write(samples model.Samples) error {
+	points := make([]point, 0, len(samples))
 	for _, s := range samples {
-		k := pathFromMetric(s.Metric, c.prefix)
-		t := float64(s.Timestamp.UnixNano()) / 1e9
 		v := float64(s.Value)
 		if math.IsNaN(v) || math.IsInf(v, 0) {
 			level.Debug(c.logger).Log("msg", "Cannot send value to Graphite, skipping sample", "value", v, "sample", s)
 			continue
 		}
-		fmt.Fprintf(&buf, "%s %f %f\n", k, v, t)
+		points = append(points, point{
+			path:      c.path(s.Metric),
+			timestamp: float64(s.Timestamp.UnixNano()) / 1e9,
+			value:     v,
+		})
 	}
-
-	_, err = conn.Write(buf.Bytes())
-	return err
+	if len(points) == 0 {
+		return nil
+	}
+	if c.flushInterval <= 0 {
+		return c.send(points)
+	}
+	return c.enqueue(points)
 }
 
 // Name identifies the client as a Graphite client.
-func (c Client) Name() string {
+func (c *Client) Name() string {
 	return "graphite"
 }
@@ -43,6 +43,17 @@ func TestEscape(t *testing.T) {
 	if expected != actual {
 		t.Errorf("Expected %s, got %s", expected, actual)
 	}
+
+	// Control characters are encoded with two hexadecimal digits too.
+	value = "a\tb\x01"
+	expected = "a%09b%01"
+	actual = escape(model.LabelValue(value))
+	if expected != actual {
+		t.Errorf("Expected %s, got %s", expected, actual)
+	}
+	if actual := escapeTag(model.LabelValue(value)); expected != actual {
+		t.Errorf("Expected %s, got %s", expected, actual)
+	}
 }
 
 func TestPathFromMetric(t *testing.T) {
@@ -55,3 +66,19 @@ func TestPathFromMetric(t *testing.T) {
 		t.Errorf("Expected %s, got %s", expected, actual)
 	}
 }
+
+func TestTaggedPathFromMetric(t *testing.T) {
+	m := model.Metric{
+		model.MetricNameLabel: "test:metric",
+		"testlabel":           "test:value",
+		"many_chars":          "abc!ABC:012-3!45ö67~89./;=",
+		"empty":               "",
+	}
+	expected := ("prefix.test:metric" +
+		";many_chars=abc!ABC:012-3!45%C3%B667%7E89./%3B=" +
+		";testlabel=test:value")
+	actual := taggedPathFromMetric(m, "prefix.")
+	if expected != actual {
+		t.Errorf("Expected %s, got %s", expected, actual)
+	}
+}
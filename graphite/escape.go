@@ -87,7 +87,7 @@ func escape(tv model.LabelValue) string {
 		switch {
 		// . is reserved by graphite, % is used to escape other bytes.
 		case b == '.' || b == '%' || b == '/' || b == '=':
-			fmt.Fprintf(result, "%%%X", b)
+			fmt.Fprintf(result, "%%%02X", b)
 		// These symbols are ok only if backslash escaped.
 		case strings.IndexByte(symbols, b) != -1:
 			result.WriteString("\\" + string(b))
@@ -96,7 +96,49 @@ func escape(tv model.LabelValue) string {
 			result.WriteByte(b)
 		// Defaults to percent-encoding.
 		default:
-			fmt.Fprintf(result, "%%%X", b)
+			fmt.Fprintf(result, "%%%02X", b)
+		}
+	}
+	return result.String()
+}
+
+// escapeTag escapes a model.LabelValue into runes allowed in the names and
+// values of Graphite tags. Tagged series are sent as
+// "name;tag1=value1;tag2=value2", so ';' separates tags and can't be used,
+// and values must not start with '~'. As the plaintext protocol separates
+// fields by whitespace, spaces can't be used either.
+//
+// Like escape, this function uses percent-encoding:
+//
+// - If a byte is a printable ASCII character other than ';', '~' and '%', it
+//   is copied to the result as is.
+//
+// - All other bytes are replaced by '%' followed by two bytes containing the
+//   uppercase ASCII representation of their hexadecimal value.
+//
+// Examples:
+//
+// "foo-bar-42" -> "foo-bar-42"
+//
+// "a;b=c" -> "a%3Bb=c"
+//
+// "~home" -> "%7Ehome"
+//
+// "Björn's email" -> "Bj%C3%B6rn's%20email"
+func escapeTag(tv model.LabelValue) string {
+	length := len(tv)
+	result := bytes.NewBuffer(make([]byte, 0, length))
+	for i := 0; i < length; i++ {
+		b := tv[i]
+		switch {
+		// ; separates tags, ~ is not allowed at the start of values and %
+		// is used to escape other bytes.
+		case b == ';' || b == '~' || b == '%':
+			fmt.Fprintf(result, "%%%02X", b)
+		case strings.IndexByte(printables, b) != -1:
+			result.WriteByte(b)
+		default:
+			fmt.Fprintf(result, "%%%02X", b)
 		}
 	}
 	return result.String()
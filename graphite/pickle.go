@@ -0,0 +1,82 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// Opcodes of the pickle protocol, version 2.
+const (
+	pickleProto      = 0x80
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleBinUnicode = 'X'
+	pickleBinFloat   = 'G'
+	pickleTuple2     = 0x86
+	pickleAppends    = 'e'
+	pickleStop       = '.'
+)
+
+// maxPickleFrameSize is the size at which a new frame is started. Carbon
+// rejects frames larger than 1MiB.
+const maxPickleFrameSize = 512 * 1024
+
+// encodePickle encodes points for the pickle receiver of Carbon. Points are
+// sent as lists of (path, (timestamp, value)) tuples, in frames which are
+// prefixed by their length as a 4-byte big-endian integer. Large batches are
+// split into several frames.
+// http://graphite.readthedocs.io/en/latest/feeding-carbon.html#the-pickle-protocol
+func encodePickle(points []point) []byte {
+	var (
+		result bytes.Buffer
+		frame  bytes.Buffer
+	)
+	for len(points) > 0 {
+		frame.Reset()
+		frame.Write([]byte{pickleProto, 2, pickleEmptyList, pickleMark})
+		for len(points) > 0 && frame.Len() < maxPickleFrameSize {
+			writePicklePoint(&frame, points[0])
+			points = points[1:]
+		}
+		frame.Write([]byte{pickleAppends, pickleStop})
+
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(frame.Len()))
+		result.Write(size[:])
+		result.Write(frame.Bytes())
+	}
+	return result.Bytes()
+}
+
+func writePicklePoint(buf *bytes.Buffer, p point) {
+	var b [8]byte
+
+	buf.WriteByte(pickleBinUnicode)
+	binary.LittleEndian.PutUint32(b[:4], uint32(len(p.path)))
+	buf.Write(b[:4])
+	buf.WriteString(p.path)
+
+	buf.WriteByte(pickleBinFloat)
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(p.timestamp))
+	buf.Write(b[:])
+	buf.WriteByte(pickleBinFloat)
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(p.value))
+	buf.Write(b[:])
+
+	buf.WriteByte(pickleTuple2)
+	buf.WriteByte(pickleTuple2)
+}
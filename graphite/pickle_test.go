@@ -0,0 +1,181 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// decodePickle decodes a frame produced by encodePickle. It only supports
+// the opcodes used by the encoder.
+func decodePickle(frame []byte) ([]point, error) {
+	var (
+		points []point
+		stack  []interface{}
+	)
+	pop := func() interface{} {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v
+	}
+	for i := 0; i < len(frame); {
+		op := frame[i]
+		i++
+		switch op {
+		case pickleProto:
+			i++
+		case pickleEmptyList, pickleMark:
+		case pickleBinUnicode:
+			n := int(binary.LittleEndian.Uint32(frame[i:]))
+			stack = append(stack, string(frame[i+4:i+4+n]))
+			i += 4 + n
+		case pickleBinFloat:
+			stack = append(stack, math.Float64frombits(binary.BigEndian.Uint64(frame[i:])))
+			i += 8
+		case pickleTuple2:
+			b, a := pop(), pop()
+			stack = append(stack, [2]interface{}{a, b})
+		case pickleAppends:
+			for _, v := range stack {
+				t := v.([2]interface{})
+				dp := t[1].([2]interface{})
+				points = append(points, point{path: t[0].(string), timestamp: dp[0].(float64), value: dp[1].(float64)})
+			}
+			stack = nil
+		case pickleStop:
+			if i != len(frame) {
+				return nil, fmt.Errorf("unexpected data after STOP")
+			}
+			return points, nil
+		default:
+			return nil, fmt.Errorf("unexpected opcode %x", op)
+		}
+	}
+	return nil, fmt.Errorf("missing STOP")
+}
+
+// readPickleFrames reads length-prefixed frames like the pickle receiver of
+// Carbon.
+func readPickleFrames(r io.Reader) ([]point, error) {
+	var points []point
+	br := bufio.NewReader(r)
+	for {
+		var size uint32
+		if err := binary.Read(br, binary.BigEndian, &size); err == io.EOF {
+			return points, nil
+		} else if err != nil {
+			return nil, err
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(br, frame); err != nil {
+			return nil, err
+		}
+		ps, err := decodePickle(frame)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, ps...)
+	}
+}
+
+func TestEncodePickle(t *testing.T) {
+	points := []point{
+		{path: "test:metric.testlabel.test:value", timestamp: 1234.5, value: 42},
+		{path: "up;job=node", timestamp: 1, value: math.MaxFloat64},
+	}
+	decoded, err := readPickleFrames(strings.NewReader(string(encodePickle(points))))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(decoded, points) {
+		t.Errorf("Expected %v, got %v", points, decoded)
+	}
+
+	// Large batches are split into several frames.
+	path := strings.Repeat("a", 1000)
+	points = make([]point, 2000)
+	for i := range points {
+		points[i] = point{path: path, timestamp: float64(i), value: 1}
+	}
+	buf := encodePickle(points)
+	if size := binary.BigEndian.Uint32(buf); size > 1<<20 {
+		t.Errorf("Expected frames of at most 1MiB, got %d bytes", size)
+	}
+	decoded, err = readPickleFrames(strings.NewReader(string(buf)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(decoded, points) {
+		t.Errorf("Expected %d points to be decoded, got %d", len(points), len(decoded))
+	}
+}
+
+func TestWritePickle(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan []point, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		points, err := readPickleFrames(conn)
+		if err != nil {
+			t.Errorf("Error decoding frames: %s", err)
+		}
+		received <- points
+	}()
+
+	c := NewClient(nil, Config{
+		Address:   l.Addr().String(),
+		Transport: TransportPickle,
+		Timeout:   time.Minute,
+		Prefix:    "prefix.",
+		Format:    FormatPath,
+	})
+	err = c.Write(model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "up", "job": "node"}, Value: 1, Timestamp: 1500},
+		{Metric: model.Metric{model.MetricNameLabel: "up", "job": "node"}, Value: model.SampleValue(math.NaN()), Timestamp: 2500},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c.Close()
+
+	select {
+	case points := <-received:
+		expected := []point{{path: "prefix.up.job.node", timestamp: 1.5, value: 1}}
+		if !reflect.DeepEqual(points, expected) {
+			t.Errorf("Expected %v, got %v", expected, points)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for samples")
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+)
+
+// point is a single sample to be sent to Graphite, with its timestamp in
+// seconds.
+type point struct {
+	path      string
+	timestamp float64
+	value     float64
+}
+
+// batch collects the points of concurrent writes until it is sent.
+type batch struct {
+	points []point
+	// done is closed once the batch was sent, err is the result then.
+	done chan struct{}
+	err  error
+}
+
+// enqueue adds points to the current batch and waits until it was sent.
+// The batch is sent once it is full or the flush interval elapsed.
+func (c *Client) enqueue(points []point) error {
+	c.mtx.Lock()
+	b := c.batch
+	if b == nil {
+		b = &batch{done: make(chan struct{})}
+		c.batch = b
+		time.AfterFunc(c.flushInterval, func() { c.flush(b) })
+	}
+	b.points = append(b.points, points...)
+	full := c.batchSize > 0 && len(b.points) >= c.batchSize
+	c.mtx.Unlock()
+
+	if full {
+		c.flush(b)
+	}
+	<-b.done
+	return b.err
+}
+
+// flush sends b unless it was already sent.
+func (c *Client) flush(b *batch) {
+	c.mtx.Lock()
+	if c.batch != b {
+		c.mtx.Unlock()
+		return
+	}
+	c.batch = nil
+	c.mtx.Unlock()
+
+	b.err = c.send(b.points)
+	close(b.done)
+}
+
+// send writes points to Graphite over a pooled connection. Connections
+// which fail are closed, so that the next send reconnects.
+func (c *Client) send(points []point) error {
+	buf := c.encode(points)
+
+	c.sem <- struct{}{}
+	defer func() { <-c.sem }()
+
+	conn, reused, err := c.conn()
+	if err != nil {
+		return err
+	}
+	err = c.writeTo(conn, buf)
+	if err != nil && reused {
+		// The server may have closed the connection while it was idle,
+		// so try again with a new one.
+		conn.Close()
+		if conn, err = c.dial(); err != nil {
+			return err
+		}
+		err = c.writeTo(conn, buf)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	c.release(conn)
+	return nil
+}
+
+// conn returns an idle connection, or a new one if there is none.
+func (c *Client) conn() (conn net.Conn, reused bool, err error) {
+	select {
+	case conn := <-c.conns:
+		return conn, true, nil
+	default:
+	}
+	conn, err = c.dial()
+	return conn, false, err
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	network := c.transport
+	if network == TransportPickle {
+		network = "tcp"
+	}
+	return net.DialTimeout(network, c.address, c.timeout)
+}
+
+func (c *Client) writeTo(conn net.Conn, buf []byte) error {
+	if c.timeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Write(buf)
+	return err
+}
+
+// release returns a connection to the idle ones.
+func (c *Client) release(conn net.Conn) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.closed {
+		conn.Close()
+		return
+	}
+	select {
+	case c.conns <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// Close closes the idle connections of the client. Connections which are in
+// use by writes are closed once they are done.
+func (c *Client) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.closed = true
+	for {
+		select {
+		case conn := <-c.conns:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// encode encodes points in the protocol of the transport.
+func (c *Client) encode(points []point) []byte {
+	if c.transport == TransportPickle {
+		return encodePickle(points)
+	}
+	return encodePlaintext(points)
+}
+
+// encodePlaintext encodes points in the plaintext protocol of Graphite.
+func encodePlaintext(points []point) []byte {
+	var buf bytes.Buffer
+	for _, p := range points {
+		fmt.Fprintf(&buf, "%s %f %f\n", p.path, p.value, p.timestamp)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,173 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// fakeCarbon accepts connections and records the lines received on them.
+type fakeCarbon struct {
+	listener net.Listener
+
+	mtx   sync.Mutex
+	conns int
+	lines []string
+}
+
+func newFakeCarbon(t *testing.T) *fakeCarbon {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := &fakeCarbon{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			fc.mtx.Lock()
+			fc.conns++
+			fc.mtx.Unlock()
+			go func() {
+				defer conn.Close()
+				s := bufio.NewScanner(conn)
+				for s.Scan() {
+					fc.mtx.Lock()
+					fc.lines = append(fc.lines, s.Text())
+					fc.mtx.Unlock()
+				}
+			}()
+		}
+	}()
+	return fc
+}
+
+// wait waits until n lines were received and returns the number of
+// connections.
+func (fc *fakeCarbon) wait(t *testing.T, n int) int {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		fc.mtx.Lock()
+		lines, conns := len(fc.lines), fc.conns
+		fc.mtx.Unlock()
+		if lines >= n {
+			return conns
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %d lines", n)
+	return 0
+}
+
+func TestWriteReusesConnections(t *testing.T) {
+	fc := newFakeCarbon(t)
+	defer fc.listener.Close()
+
+	c := NewClient(nil, Config{
+		Address:        fc.listener.Addr().String(),
+		Transport:      "tcp",
+		Timeout:        time.Minute,
+		Format:         FormatPath,
+		MaxConnections: 2,
+	})
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := c.Write(model.Samples{{Metric: metric, Value: 1}}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if conns := fc.wait(t, 10); conns != 1 {
+		t.Errorf("Expected sequential writes to share 1 connection, got %d", conns)
+	}
+}
+
+func TestWriteBatchesConcurrentWrites(t *testing.T) {
+	fc := newFakeCarbon(t)
+	defer fc.listener.Close()
+
+	c := NewClient(nil, Config{
+		Address:        fc.listener.Addr().String(),
+		Transport:      "tcp",
+		Timeout:        time.Minute,
+		Format:         FormatPath,
+		MaxConnections: 4,
+		BatchSize:      1000,
+		FlushInterval:  time.Hour,
+	})
+	defer c.Close()
+
+	// The batch is only sent once it is full, as the flush interval never
+	// elapses during the test.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			samples := make(model.Samples, 100)
+			for j := range samples {
+				samples[j] = &model.Sample{Metric: metric, Value: 1}
+			}
+			if err := c.Write(samples); err != nil {
+				t.Errorf("Unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if conns := fc.wait(t, 1000); conns != 1 {
+		t.Errorf("Expected a single batch over 1 connection, got %d connections", conns)
+	}
+}
+
+func TestWriteFlushInterval(t *testing.T) {
+	fc := newFakeCarbon(t)
+	defer fc.listener.Close()
+
+	c := NewClient(nil, Config{
+		Address:       fc.listener.Addr().String(),
+		Transport:     "tcp",
+		Timeout:       time.Minute,
+		Format:        FormatPath,
+		BatchSize:     1000,
+		FlushInterval: 10 * time.Millisecond,
+	})
+	defer c.Close()
+
+	if err := c.Write(model.Samples{{Metric: metric, Value: 1}}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	fc.wait(t, 1)
+}
+
+func TestWriteDialError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	c := NewClient(nil, Config{Address: addr, Transport: "tcp", Timeout: time.Second, Format: FormatPath})
+	if err := c.Write(model.Samples{{Metric: metric, Value: 1}}); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
@@ -0,0 +1,390 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	findEndpoint   = "/metrics/find"
+	renderEndpoint = "/render"
+
+	// maxTargetsPerRender limits the number of series requested from the
+	// render API at once, to keep requests at a reasonable size.
+	maxTargetsPerRender = 100
+)
+
+// findResult is a node returned by the find API.
+type findResult struct {
+	ID         string `json:"id"`
+	Leaf       int    `json:"leaf"`
+	Expandable int    `json:"expandable"`
+}
+
+// renderResult is a series returned by the render API. Data points are
+// pairs of a value, which is null for missing values, and a timestamp in
+// seconds.
+type renderResult struct {
+	Target     string        `json:"target"`
+	Datapoints [][2]*float64 `json:"datapoints"`
+}
+
+// Read queries the Graphite web API for the series matching each query of
+// the request. As labels are encoded into the metric paths, matching series
+// are found by walking the metric tree below the metric names, skipping
+// branches which can't match.
+func (c *Client) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	if c.webURL == "" {
+		return nil, errors.New("no Graphite web URL configured")
+	}
+	if c.format == FormatTagged {
+		return nil, errors.New("reading tagged series from Graphite is not supported")
+	}
+	resp := &prompb.ReadResponse{
+		Results: make([]*prompb.QueryResult, 0, len(req.Queries)),
+	}
+	for _, q := range req.Queries {
+		ts, err := c.query(q)
+		if err != nil {
+			return nil, err
+		}
+		resp.Results = append(resp.Results, &prompb.QueryResult{Timeseries: ts})
+	}
+	return resp, nil
+}
+
+func (c *Client) query(q *prompb.Query) ([]*prompb.TimeSeries, error) {
+	ms, err := newMatchers(q.Matchers)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := c.findPaths(ms)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]string, 0, len(paths))
+	for p := range paths {
+		targets = append(targets, p)
+	}
+	sort.Strings(targets)
+
+	var series []*prompb.TimeSeries
+	for len(targets) > 0 {
+		n := len(targets)
+		if n > maxTargetsPerRender {
+			n = maxTargetsPerRender
+		}
+		ts, err := c.render(targets[:n], paths, q.StartTimestampMs, q.EndTimestampMs)
+		if err != nil {
+			return nil, err
+		}
+		series = append(series, ts...)
+		targets = targets[n:]
+	}
+	return series, nil
+}
+
+// findPaths returns the paths of all series whose metric matches ms, mapped
+// to their metric.
+func (c *Client) findPaths(ms matchers) (map[string]model.Metric, error) {
+	// Start at the metric names, or at the single one being queried.
+	root := c.prefix + "*"
+	for _, m := range ms {
+		if m.name == model.MetricNameLabel && m.typ == prompb.LabelMatcher_EQ {
+			root = c.prefix + escape(model.LabelValue(m.value))
+		}
+	}
+	nodes, err := c.find(root)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := map[string]model.Metric{}
+	for _, n := range nodes {
+		name, err := unescape(strings.TrimPrefix(n.ID, c.prefix))
+		if err != nil {
+			continue
+		}
+		metric := model.Metric{model.MetricNameLabel: model.LabelValue(name)}
+		if !ms.matchesLabel(model.MetricNameLabel, metric) {
+			continue
+		}
+		if err := c.walk(n, metric, "", ms, paths); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// walk descends the metric tree from node n, whose path encodes metric and,
+// unless label is empty, the name of the label whose value comes next.
+// Series whose metric matches ms are added to paths.
+func (c *Client) walk(n findResult, metric model.Metric, label model.LabelName, ms matchers, paths map[string]model.Metric) error {
+	if n.Leaf == 1 && label == "" && ms.matches(metric) {
+		paths[n.ID] = metric
+	}
+	if n.Expandable != 1 {
+		return nil
+	}
+	children, err := c.find(n.ID + ".*")
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		// Paths may contain glob characters, which could make the query
+		// return unrelated nodes.
+		if !strings.HasPrefix(child.ID, n.ID+".") {
+			continue
+		}
+		raw := child.ID[len(n.ID)+1:]
+		if strings.Contains(raw, ".") {
+			continue
+		}
+		text, err := unescape(raw)
+		if err != nil {
+			continue
+		}
+		if label == "" {
+			// Labels are sorted in paths, so skip branches which went past
+			// a label that must be present.
+			name := model.LabelName(text)
+			if ms.missingBefore(name, metric) {
+				continue
+			}
+			if err := c.walk(child, metric, name, ms, paths); err != nil {
+				return err
+			}
+			continue
+		}
+		m := metric.Clone()
+		if text != "" {
+			m[label] = model.LabelValue(text)
+		}
+		if !ms.matchesLabel(label, m) {
+			continue
+		}
+		if err := c.walk(child, m, "", ms, paths); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// find returns the nodes matching a glob query.
+func (c *Client) find(query string) ([]findResult, error) {
+	var nodes []findResult
+	err := c.call(findEndpoint, url.Values{"query": {query}, "format": {"treejson"}}, &nodes)
+	return nodes, err
+}
+
+// render returns the data points of the target paths between start and
+// end, labeled with the metrics of the paths.
+func (c *Client) render(targets []string, paths map[string]model.Metric, start, end int64) ([]*prompb.TimeSeries, error) {
+	params := url.Values{
+		"target": targets,
+		"format": {"json"},
+		// Graphite takes timestamps in seconds and includes both ends.
+		"from":  {strconv.FormatInt(start/1000, 10)},
+		"until": {strconv.FormatInt((end+999)/1000, 10)},
+	}
+	var results []renderResult
+	if err := c.call(renderEndpoint, params, &results); err != nil {
+		return nil, err
+	}
+
+	series := make([]*prompb.TimeSeries, 0, len(results))
+	for _, r := range results {
+		metric, ok := paths[r.Target]
+		if !ok {
+			continue
+		}
+		ts := &prompb.TimeSeries{Labels: make([]prompb.Label, 0, len(metric))}
+		for k, v := range metric {
+			ts.Labels = append(ts.Labels, prompb.Label{Name: string(k), Value: string(v)})
+		}
+		for _, dp := range r.Datapoints {
+			if dp[0] == nil || dp[1] == nil {
+				continue
+			}
+			t := int64(*dp[1]) * 1000
+			if t < start || t > end {
+				continue
+			}
+			ts.Samples = append(ts.Samples, prompb.Sample{Timestamp: t, Value: *dp[0]})
+		}
+		series = append(series, ts)
+	}
+	return series, nil
+}
+
+// call sends a request with the given parameters to an endpoint of the
+// Graphite web API and decodes the JSON response into v. The parameters are
+// sent as a form, as they may not fit into a URL.
+func (c *Client) call(endpoint string, params url.Values, v interface{}) error {
+	u, err := url.Parse(c.webURL)
+	if err != nil {
+		return err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + endpoint
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", u.String(), strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.Wrap(err, "error decoding Graphite response")
+	}
+	return nil
+}
+
+// matcher matches the value of a label.
+type matcher struct {
+	name  model.LabelName
+	value string
+	typ   prompb.LabelMatcher_Type
+	re    *regexp.Regexp
+}
+
+type matchers []matcher
+
+func newMatchers(lms []*prompb.LabelMatcher) (matchers, error) {
+	ms := make(matchers, 0, len(lms))
+	for _, lm := range lms {
+		m := matcher{name: model.LabelName(lm.Name), value: lm.Value, typ: lm.Type}
+		switch lm.Type {
+		case prompb.LabelMatcher_EQ, prompb.LabelMatcher_NEQ:
+		case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+			re, err := regexp.Compile("^(?:" + lm.Value + ")$")
+			if err != nil {
+				return nil, err
+			}
+			m.re = re
+		default:
+			return nil, errors.Errorf("unknown match type %v", lm.Type)
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+func (m matcher) matches(v string) bool {
+	switch m.typ {
+	case prompb.LabelMatcher_EQ:
+		return v == m.value
+	case prompb.LabelMatcher_NEQ:
+		return v != m.value
+	case prompb.LabelMatcher_RE:
+		return m.re.MatchString(v)
+	case prompb.LabelMatcher_NRE:
+		return !m.re.MatchString(v)
+	}
+	return false
+}
+
+// matches returns whether a metric matches all matchers. Missing labels
+// have an empty value.
+func (ms matchers) matches(metric model.Metric) bool {
+	for _, m := range ms {
+		if !m.matches(string(metric[m.name])) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesLabel returns whether the value of the named label in metric
+// matches all matchers on that label.
+func (ms matchers) matchesLabel(name model.LabelName, metric model.Metric) bool {
+	for _, m := range ms {
+		if m.name == name && !m.matches(string(metric[name])) {
+			return false
+		}
+	}
+	return true
+}
+
+// missingBefore returns whether a label sorting before next, which thus
+// can't be added to metric anymore, must be present to match.
+func (ms matchers) missingBefore(next model.LabelName, metric model.Metric) bool {
+	for _, m := range ms {
+		if m.name == model.MetricNameLabel || m.name >= next {
+			continue
+		}
+		if _, ok := metric[m.name]; !ok && !m.matches("") {
+			return true
+		}
+	}
+	return false
+}
+
+// unescape reverses escape.
+func unescape(s string) (string, error) {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 >= len(s) {
+				return "", errors.Errorf("incomplete escape sequence in %q", s)
+			}
+			i++
+			b.WriteByte(s[i])
+		case '%':
+			if i+2 >= len(s) {
+				return "", errors.Errorf("incomplete escape sequence in %q", s)
+			}
+			v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", errors.Errorf("invalid escape sequence in %q", s)
+			}
+			b.WriteByte(byte(v))
+			i += 2
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestUnescape(t *testing.T) {
+	for _, v := range []string{"foo-bar-42", "foo_bar%42", "http://example.org:8080", "Björn's email: bjoern@soundcloud.com", "日", "(){},=.'\"\\", "line\nbreak\x01"} {
+		actual, err := unescape(escape(model.LabelValue(v)))
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %s", v, err)
+		}
+		if actual != v {
+			t.Errorf("Expected %q, got %q", v, actual)
+		}
+	}
+	for _, s := range []string{"foo%2", "foo%ZZ", "foo\\"} {
+		if _, err := unescape(s); err == nil {
+			t.Errorf("Expected error for %q, got none", s)
+		}
+	}
+}
+
+// fakeGraphite serves the find and render APIs for a fixed set of paths.
+type fakeGraphite struct {
+	paths []string
+	finds []string
+}
+
+func (g *fakeGraphite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	switch r.URL.Path {
+	case findEndpoint:
+		query := r.Form.Get("query")
+		g.finds = append(g.finds, query)
+		parent, pattern := "", query
+		if i := strings.LastIndex(query, "."); i >= 0 {
+			parent, pattern = query[:i+1], query[i+1:]
+		}
+		nodes := map[string]findResult{}
+		for _, p := range g.paths {
+			if !strings.HasPrefix(p, parent) {
+				continue
+			}
+			rest := p[len(parent):]
+			node := rest
+			if i := strings.Index(rest, "."); i >= 0 {
+				node = rest[:i]
+			}
+			if pattern != "*" && pattern != node {
+				continue
+			}
+			n := nodes[parent+node]
+			n.ID = parent + node
+			if node == rest {
+				n.Leaf = 1
+			} else {
+				n.Expandable = 1
+			}
+			nodes[n.ID] = n
+		}
+		var result []findResult
+		for _, n := range nodes {
+			result = append(result, n)
+		}
+		json.NewEncoder(w).Encode(result)
+	case renderEndpoint:
+		var result []renderResult
+		for _, target := range r.Form["target"] {
+			v1, v2, t1, t2 := 1.0, 2.0, 1.0, 2.0
+			result = append(result, renderResult{
+				Target:     target,
+				Datapoints: [][2]*float64{{&v1, &t1}, {nil, &t1}, {&v2, &t2}},
+			})
+		}
+		json.NewEncoder(w).Encode(result)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestRead(t *testing.T) {
+	g := &fakeGraphite{paths: []string{
+		"prefix.up.instance.a:9100.job.node",
+		"prefix.up.instance.b:9100.job.node",
+		"prefix.up.job.node",
+		"prefix.up.instance.c:9100.job.other",
+		"prefix.down.instance.a:9100.job.node",
+	}}
+	server := httptest.NewServer(g)
+	defer server.Close()
+
+	c := NewClient(nil, Config{Timeout: time.Minute, Prefix: "prefix.", Format: FormatPath, WebURL: server.URL})
+	resp, err := c.Read(&prompb.ReadRequest{
+		Queries: []*prompb.Query{{
+			StartTimestampMs: 1000,
+			EndTimestampMs:   2000,
+			Matchers: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+				{Type: prompb.LabelMatcher_RE, Name: "instance", Value: "a:.*|c:.*"},
+				{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "node"},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if len(resp.Results) != 1 || len(resp.Results[0].Timeseries) != 1 {
+		t.Fatalf("Expected a single series, got %v", resp)
+	}
+	ts := resp.Results[0].Timeseries[0]
+	sort.Slice(ts.Labels, func(i, j int) bool { return ts.Labels[i].Name < ts.Labels[j].Name })
+	expected := &prompb.TimeSeries{
+		Labels: []prompb.Label{
+			{Name: "__name__", Value: "up"},
+			{Name: "instance", Value: "a:9100"},
+			{Name: "job", Value: "node"},
+		},
+		Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 2}},
+	}
+	if !reflect.DeepEqual(ts, expected) {
+		t.Errorf("Expected %v, got %v", expected, ts)
+	}
+
+	// The branch of the b:9100 instance must not have been descended.
+	for _, f := range g.finds {
+		if strings.HasPrefix(f, "prefix.up.instance.b:9100") {
+			t.Errorf("Unexpected find query %q", f)
+		}
+	}
+}
+
+func TestReadWithoutWebURL(t *testing.T) {
+	c := NewClient(nil, Config{Address: "localhost:2003", Transport: "tcp", Timeout: time.Minute, Format: FormatPath})
+	if _, err := c.Read(&prompb.ReadRequest{}); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package histogram converts Prometheus native histograms into classic
+// histograms, with cumulative buckets, for remote storages which don't
+// support native histograms.
+package histogram
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// Schemas of native histograms. Exponential schemas range from -4 to 8,
+// histograms with custom buckets have their own schema.
+const (
+	minExponentialSchema = -4
+	maxExponentialSchema = 8
+	customBucketsSchema  = -53
+)
+
+// Sample is a native histogram of a series at a point in time.
+type Sample struct {
+	Metric    model.Metric
+	Histogram *Histogram
+	Timestamp model.Time
+}
+
+// Histogram is a native histogram with absolute bucket counts. Integer
+// histograms, whose bucket counts are encoded as deltas, are converted with
+// CountsFromDeltas.
+type Histogram struct {
+	Schema        int32
+	ZeroThreshold float64
+	ZeroCount     float64
+	Count         float64
+	Sum           float64
+
+	PositiveSpans   []Span
+	PositiveBuckets []float64
+	NegativeSpans   []Span
+	NegativeBuckets []float64
+
+	// CustomValues are the upper bounds of the buckets of histograms with
+	// custom buckets.
+	CustomValues []float64
+}
+
+// Span is a run of consecutive buckets. Offset is the gap to the end of the
+// previous span, or the index of the first bucket for the first span.
+type Span struct {
+	Offset int32
+	Length uint32
+}
+
+// Bucket is a bucket of a classic histogram, counting the observations
+// less than or equal to its upper bound.
+type Bucket struct {
+	UpperBound float64
+	Count      float64
+}
+
+// CountsFromDeltas converts bucket counts encoded as deltas to the previous
+// bucket into absolute counts.
+func CountsFromDeltas(deltas []int64) []float64 {
+	counts := make([]float64, len(deltas))
+	var cur int64
+	for i, d := range deltas {
+		cur += d
+		counts[i] = float64(cur)
+	}
+	return counts
+}
+
+// ClassicBuckets returns the cumulative buckets of the classic histogram
+// equivalent to h, ending with the +Inf bucket. Each bucket of h becomes a
+// classic bucket with its upper bound.
+func (h *Histogram) ClassicBuckets() ([]Bucket, error) {
+	custom := h.Schema == customBucketsSchema
+	if !custom && (h.Schema < minExponentialSchema || h.Schema > maxExponentialSchema) {
+		return nil, errors.Errorf("unsupported histogram schema %d", h.Schema)
+	}
+	if custom && (len(h.NegativeSpans) > 0 || len(h.NegativeBuckets) > 0) {
+		return nil, errors.New("histogram with custom buckets has negative buckets")
+	}
+
+	negative, err := h.bucketIndexes(h.NegativeSpans, h.NegativeBuckets)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid negative buckets")
+	}
+	positive, err := h.bucketIndexes(h.PositiveSpans, h.PositiveBuckets)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid positive buckets")
+	}
+
+	var (
+		buckets    []Bucket
+		cumulative float64
+	)
+	// Negative buckets count observations from their lower bound, the most
+	// negative bucket comes first.
+	for i := len(negative) - 1; i >= 0; i-- {
+		cumulative += h.NegativeBuckets[i]
+		buckets = append(buckets, Bucket{UpperBound: -h.lowerBound(negative[i]), Count: cumulative})
+	}
+	if !custom {
+		cumulative += h.ZeroCount
+		buckets = append(buckets, Bucket{UpperBound: h.ZeroThreshold, Count: cumulative})
+	}
+	for i, idx := range positive {
+		upper, err := h.upperBound(idx)
+		if err != nil {
+			return nil, err
+		}
+		cumulative += h.PositiveBuckets[i]
+		if math.IsInf(upper, 1) {
+			if i != len(positive)-1 {
+				return nil, errors.Errorf("bucket index %d out of range of %d custom bounds", positive[i+1], len(h.CustomValues))
+			}
+			// The last custom bucket is the +Inf bucket, which is added
+			// below.
+			break
+		}
+		buckets = append(buckets, Bucket{UpperBound: upper, Count: cumulative})
+	}
+	return append(buckets, Bucket{UpperBound: math.Inf(1), Count: h.Count}), nil
+}
+
+// bucketIndexes returns the index of each bucket described by spans.
+func (h *Histogram) bucketIndexes(spans []Span, buckets []float64) ([]int32, error) {
+	var (
+		indexes []int32
+		idx     int32
+	)
+	for i, s := range spans {
+		if i > 0 && s.Offset < 0 {
+			return nil, errors.Errorf("negative offset %d of span %d", s.Offset, i)
+		}
+		idx += s.Offset
+		for j := uint32(0); j < s.Length; j++ {
+			indexes = append(indexes, idx)
+			idx++
+		}
+	}
+	if len(indexes) != len(buckets) {
+		return nil, errors.Errorf("spans describe %d buckets, got %d", len(indexes), len(buckets))
+	}
+	return indexes, nil
+}
+
+// upperBound returns the upper bound of the bucket with the given index.
+func (h *Histogram) upperBound(idx int32) (float64, error) {
+	if h.Schema == customBucketsSchema {
+		switch {
+		case idx < 0 || int(idx) > len(h.CustomValues):
+			return 0, errors.Errorf("bucket index %d out of range of %d custom bounds", idx, len(h.CustomValues))
+		case int(idx) == len(h.CustomValues):
+			return math.Inf(1), nil
+		}
+		return h.CustomValues[idx], nil
+	}
+	// The buckets of exponential schemas grow by a factor of 2^(2^-schema),
+	// bucket 0 ends at 1.
+	if h.Schema <= 0 {
+		return math.Ldexp(1, int(idx)<<uint(-h.Schema)), nil
+	}
+	return math.Exp2(float64(idx) / float64(int(1)<<uint(h.Schema))), nil
+}
+
+// lowerBound returns the lower bound of the exponential bucket with the
+// given index, which is the upper bound of the previous one.
+func (h *Histogram) lowerBound(idx int32) float64 {
+	upper, _ := h.upperBound(idx - 1)
+	return upper
+}
+
+// FormatBound formats the upper bound of a bucket like the le label of
+// classic histograms.
+func FormatBound(b float64) string {
+	if math.IsInf(b, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(b, 'g', -1, 64)
+}
+
+// Expand converts native histograms into the series of classic histograms,
+// named after the native histogram with the _bucket, _sum and _count
+// suffixes. Histograms which can't be converted are returned as errors.
+func Expand(samples []Sample) (model.Samples, []error) {
+	var (
+		result model.Samples
+		errs   []error
+	)
+	for _, s := range samples {
+		buckets, err := s.Histogram.ClassicBuckets()
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "histogram %s", s.Metric))
+			continue
+		}
+		name := s.Metric[model.MetricNameLabel]
+		for _, b := range buckets {
+			m := withName(s.Metric, name+"_bucket")
+			m[model.BucketLabel] = model.LabelValue(FormatBound(b.UpperBound))
+			result = append(result, &model.Sample{Metric: m, Value: model.SampleValue(b.Count), Timestamp: s.Timestamp})
+		}
+		result = append(result,
+			&model.Sample{Metric: withName(s.Metric, name+"_sum"), Value: model.SampleValue(s.Histogram.Sum), Timestamp: s.Timestamp},
+			&model.Sample{Metric: withName(s.Metric, name+"_count"), Value: model.SampleValue(s.Histogram.Count), Timestamp: s.Timestamp},
+		)
+	}
+	return result, errs
+}
+
+func withName(m model.Metric, name model.LabelValue) model.Metric {
+	c := m.Clone()
+	c[model.MetricNameLabel] = name
+	return c
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package histogram
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestClassicBuckets(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		histogram Histogram
+		expected  []Bucket
+	}{
+		{
+			name: "exponential",
+			histogram: Histogram{
+				Schema:        0,
+				ZeroThreshold: 0.001,
+				ZeroCount:     1,
+				Count:         11,
+				// Buckets 0, 1 and 3 cover (0.5, 1], (1, 2] and (4, 8].
+				PositiveSpans:   []Span{{Offset: 0, Length: 2}, {Offset: 1, Length: 1}},
+				PositiveBuckets: []float64{1, 2, 3},
+				// Buckets 1 and 2 cover [-2, -1) and [-4, -2).
+				NegativeSpans:   []Span{{Offset: 1, Length: 2}},
+				NegativeBuckets: []float64{1, 3},
+			},
+			expected: []Bucket{
+				{UpperBound: -2, Count: 3},
+				{UpperBound: -1, Count: 4},
+				{UpperBound: 0.001, Count: 5},
+				{UpperBound: 1, Count: 6},
+				{UpperBound: 2, Count: 8},
+				{UpperBound: 8, Count: 11},
+				{UpperBound: math.Inf(1), Count: 11},
+			},
+		},
+		{
+			name: "higher resolution",
+			histogram: Histogram{
+				Schema:          1,
+				Count:           2,
+				PositiveSpans:   []Span{{Offset: 1, Length: 2}},
+				PositiveBuckets: []float64{1, 1},
+			},
+			expected: []Bucket{
+				{UpperBound: 0, Count: 0},
+				{UpperBound: math.Exp2(0.5), Count: 1},
+				{UpperBound: 2, Count: 2},
+				{UpperBound: math.Inf(1), Count: 2},
+			},
+		},
+		{
+			name: "lower resolution",
+			histogram: Histogram{
+				Schema:          -1,
+				Count:           1,
+				PositiveSpans:   []Span{{Offset: 2, Length: 1}},
+				PositiveBuckets: []float64{1},
+			},
+			expected: []Bucket{
+				{UpperBound: 0, Count: 0},
+				{UpperBound: 16, Count: 1},
+				{UpperBound: math.Inf(1), Count: 1},
+			},
+		},
+		{
+			name: "custom buckets",
+			histogram: Histogram{
+				Schema:          -53,
+				Count:           6,
+				PositiveSpans:   []Span{{Offset: 0, Length: 3}},
+				PositiveBuckets: []float64{1, 2, 3},
+				CustomValues:    []float64{0.5, 1},
+			},
+			expected: []Bucket{
+				{UpperBound: 0.5, Count: 1},
+				{UpperBound: 1, Count: 3},
+				{UpperBound: math.Inf(1), Count: 6},
+			},
+		},
+	} {
+		buckets, err := c.histogram.ClassicBuckets()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", c.name, err)
+		}
+		if !reflect.DeepEqual(buckets, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, buckets)
+		}
+	}
+}
+
+func TestClassicBucketsInvalid(t *testing.T) {
+	for _, h := range []Histogram{
+		{Schema: 9},
+		{Schema: 0, PositiveSpans: []Span{{Offset: 0, Length: 2}}, PositiveBuckets: []float64{1}},
+		{Schema: 0, PositiveSpans: []Span{{Offset: 0, Length: 1}, {Offset: -2, Length: 1}}, PositiveBuckets: []float64{1, 1}},
+		{Schema: -53, PositiveSpans: []Span{{Offset: 0, Length: 2}}, PositiveBuckets: []float64{1, 1}},
+	} {
+		if _, err := h.ClassicBuckets(); err == nil {
+			t.Errorf("Expected error for %+v, got none", h)
+		}
+	}
+}
+
+func TestCountsFromDeltas(t *testing.T) {
+	if counts, expected := CountsFromDeltas([]int64{1, 2, -1, 0}), []float64{1, 3, 2, 2}; !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Expected %v, got %v", expected, counts)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	samples, errs := Expand([]Sample{
+		{
+			Metric:    model.Metric{"__name__": "rpc_seconds", "job": "a"},
+			Timestamp: 1000,
+			Histogram: &Histogram{
+				Schema:          -53,
+				Count:           3,
+				Sum:             1.5,
+				PositiveSpans:   []Span{{Offset: 0, Length: 2}},
+				PositiveBuckets: []float64{1, 2},
+				CustomValues:    []float64{0.25},
+			},
+		},
+		{
+			Metric:    model.Metric{"__name__": "invalid"},
+			Histogram: &Histogram{Schema: 100},
+		},
+	})
+	if len(errs) != 1 {
+		t.Errorf("Expected 1 error, got %v", errs)
+	}
+	expected := model.Samples{
+		{Metric: model.Metric{"__name__": "rpc_seconds_bucket", "job": "a", "le": "0.25"}, Value: 1, Timestamp: 1000},
+		{Metric: model.Metric{"__name__": "rpc_seconds_bucket", "job": "a", "le": "+Inf"}, Value: 3, Timestamp: 1000},
+		{Metric: model.Metric{"__name__": "rpc_seconds_sum", "job": "a"}, Value: 1.5, Timestamp: 1000},
+		{Metric: model.Metric{"__name__": "rpc_seconds_count", "job": "a"}, Value: 3, Timestamp: 1000},
+	}
+	if !reflect.DeepEqual(samples, expected) {
+		t.Errorf("Expected %v, got %v", expected, samples)
+	}
+}
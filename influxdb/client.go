@@ -16,8 +16,10 @@ package influxdb
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"math"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/go-kit/kit/log"
@@ -37,18 +39,54 @@ type Client struct {
 	client          influx.Client
 	database        string
 	retentionPolicy string
+	groupHistograms bool
+	writeMetadata   bool
+	pushDownHints   bool
+	readLimits      ReadLimits
 	ignoredSamples  prometheus.Counter
+	rejectedQueries *prometheus.CounterVec
+
+	measurements measurementCache
+}
+
+// Options configures optional behavior of a Client.
+type Options struct {
+	// GroupHistograms stores the series of a histogram or summary family
+	// as fields of a single measurement.
+	GroupHistograms bool
+	// WriteMetadata stores the metadata of metric families received by
+	// remote write.
+	WriteMetadata bool
+	// PushDownReadHints downsamples the results of read queries in
+	// InfluxDB where the read hints of Prometheus allow it.
+	PushDownReadHints bool
+	// ReadLimits limit the results of each read request.
+	ReadLimits ReadLimits
 }
 
 // NewClient creates a new Client.
-func NewClient(logger log.Logger, conf influx.HTTPConfig, db string, rp string) *Client {
-	c, err := influx.NewHTTPClient(conf)
+func NewClient(logger log.Logger, conf influx.HTTPConfig, db string, rp string, opts Options) *Client {
+	c, err := newHTTPClient(conf)
 	// Currently influx.NewClient() *should* never return an error.
 	if err != nil {
 		level.Error(logger).Log("err", err)
 		os.Exit(1)
 	}
+	return newClient(logger, c, db, rp, opts)
+}
 
+// NewUDPClient creates a new Client which sends samples to the UDP listener
+// of InfluxDB, in packets of at most the configured payload size. The
+// database is configured by the listener. Reading is not supported.
+func NewUDPClient(logger log.Logger, conf influx.UDPConfig, opts Options) (*Client, error) {
+	c, err := influx.NewUDPClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(logger, c, "", "", opts), nil
+}
+
+func newClient(logger log.Logger, c influx.Client, db string, rp string, opts Options) *Client {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
@@ -58,12 +96,23 @@ func NewClient(logger log.Logger, conf influx.HTTPConfig, db string, rp string)
 		client:          c,
 		database:        db,
 		retentionPolicy: rp,
+		groupHistograms: opts.GroupHistograms,
+		writeMetadata:   opts.WriteMetadata,
+		pushDownHints:   opts.PushDownReadHints,
+		readLimits:      opts.ReadLimits,
 		ignoredSamples: prometheus.NewCounter(
 			prometheus.CounterOpts{
 				Name: "prometheus_influxdb_ignored_samples_total",
 				Help: "The total number of samples not sent to InfluxDB due to unsupported float values (Inf, -Inf, NaN).",
 			},
 		),
+		rejectedQueries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "prometheus_influxdb_rejected_queries_total",
+				Help: "The total number of read requests rejected for exceeding a read limit.",
+			},
+			[]string{"limit"},
+		),
 	}
 }
 
@@ -80,12 +129,40 @@ func tagsFromMetric(m model.Metric) map[string]string {
 
 // Write sends a batch of samples to InfluxDB via its HTTP API.
 func (c *Client) Write(samples model.Samples) error {
+	toPoints := samplesToPoints
+	if c.groupHistograms {
+		toPoints = groupedPoints
+	}
+	points, err := toPoints(c.logger, samples, c.ignoredSamples)
+	if err != nil {
+		return err
+	}
+	return c.writePoints(points)
+}
+
+// writePoints sends a batch of points to InfluxDB.
+func (c *Client) writePoints(points []*influx.Point) error {
+	bps, err := influx.NewBatchPoints(influx.BatchPointsConfig{
+		Precision:       "ms",
+		Database:        c.database,
+		RetentionPolicy: c.retentionPolicy,
+	})
+	if err != nil {
+		return err
+	}
+	bps.AddPoints(points)
+	return c.client.Write(bps)
+}
+
+// samplesToPoints converts samples into InfluxDB points. Samples with
+// values InfluxDB can't store are skipped and counted as ignored.
+func samplesToPoints(logger log.Logger, samples model.Samples, ignored prometheus.Counter) ([]*influx.Point, error) {
 	points := make([]*influx.Point, 0, len(samples))
 	for _, s := range samples {
 		v := float64(s.Value)
 		if math.IsNaN(v) || math.IsInf(v, 0) {
-			level.Debug(c.logger).Log("msg", "Cannot send  to InfluxDB, skipping sample", "value", v, "sample", s)
-			c.ignoredSamples.Inc()
+			level.Debug(logger).Log("msg", "Cannot send  to InfluxDB, skipping sample", "value", v, "sample", s)
+			ignored.Inc()
 			continue
 		}
 		p, err := influx.NewPoint(
@@ -95,41 +172,28 @@ func (c *Client) Write(samples model.Samples) error {
 			s.Timestamp.Time(),
 		)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		points = append(points, p)
 	}
+	return points, nil
+}
 
-	bps, err := influx.NewBatchPoints(influx.BatchPointsConfig{
-		Precision:       "ms",
-		Database:        c.database,
-		RetentionPolicy: c.retentionPolicy,
-	})
-	if err != nil {
-		return err
-	}
-	bps.AddPoints(points)
-	return c.client.Write(bps)
+// recoverableError wraps errors of writes which may succeed when retried.
+type recoverableError struct {
+	error
+}
+
+// Recoverable implements the interface used to detect recoverable errors.
+func (recoverableError) Recoverable() bool {
+	return true
 }
 
 func (c *Client) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
 	labelsToSeries := map[string]*prompb.TimeSeries{}
+	limiter := &readLimiter{limits: c.readLimits}
 	for _, q := range req.Queries {
-		command, err := c.buildCommand(q)
-		if err != nil {
-			return nil, err
-		}
-
-		query := influx.NewQuery(command, c.database, "ms")
-		resp, err := c.client.Query(query)
-		if err != nil {
-			return nil, err
-		}
-		if resp.Err != "" {
-			return nil, errors.New(resp.Err)
-		}
-
-		if err = mergeResult(labelsToSeries, resp.Results); err != nil {
+		if err := c.query(labelsToSeries, q, limiter); err != nil {
 			return nil, err
 		}
 	}
@@ -145,44 +209,114 @@ func (c *Client) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
 	return &resp, nil
 }
 
+// query runs a query as a chunked InfluxDB query and merges the returned
+// series into labelsToSeries chunk by chunk, counting them against the limits
+// of the read request.
+func (c *Client) query(labelsToSeries map[string]*prompb.TimeSeries, q *prompb.Query, limiter *readLimiter) error {
+	if err := limiter.checkTimeRange(q); err != nil {
+		return c.countRejected(err)
+	}
+	buildCommand := c.buildCommand
+	if c.groupHistograms {
+		buildCommand = c.buildGroupedCommand
+	}
+	command, err := buildCommand(q)
+	if err == errNoMeasurements {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	query := influx.NewQuery(command, c.database, "ms")
+	query.Chunked = true
+	query.ChunkSize = readChunkSize
+	cr, err := c.client.QueryAsChunk(query)
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+	for {
+		resp, err := cr.NextResponse()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := resp.Error(); err != nil {
+			return err
+		}
+
+		if c.groupHistograms {
+			err = mergeGroupedResult(labelsToSeries, resp.Results, q.Matchers, limiter)
+		} else {
+			err = mergeResult(labelsToSeries, resp.Results, limiter)
+		}
+		if err != nil {
+			return c.countRejected(err)
+		}
+	}
+}
+
 func (c *Client) buildCommand(q *prompb.Query) (string, error) {
 	matchers := make([]string, 0, len(q.Matchers))
-	// If we don't find a metric name matcher, query all metrics
-	// (InfluxDB measurements) by default.
-	from := "FROM /.+/"
+	var nameMatchers []*prompb.LabelMatcher
 	for _, m := range q.Matchers {
 		if m.Name == model.MetricNameLabel {
-			switch m.Type {
-			case prompb.LabelMatcher_EQ:
-				from = fmt.Sprintf("FROM %q.%q", c.retentionPolicy, m.Value)
-			case prompb.LabelMatcher_RE:
-				from = fmt.Sprintf("FROM %q./^%s$/", c.retentionPolicy, escapeSlashes(m.Value))
-			default:
-				// TODO: Figure out how to support these efficiently.
-				return "", errors.New("non-equal or regex-non-equal matchers are not supported on the metric name yet")
-			}
+			nameMatchers = append(nameMatchers, m)
 			continue
 		}
 
-		switch m.Type {
-		case prompb.LabelMatcher_EQ:
-			matchers = append(matchers, fmt.Sprintf("%q = '%s'", m.Name, escapeSingleQuotes(m.Value)))
-		case prompb.LabelMatcher_NEQ:
-			matchers = append(matchers, fmt.Sprintf("%q != '%s'", m.Name, escapeSingleQuotes(m.Value)))
-		case prompb.LabelMatcher_RE:
-			matchers = append(matchers, fmt.Sprintf("%q =~ /^%s$/", m.Name, escapeSlashes(m.Value)))
-		case prompb.LabelMatcher_NRE:
-			matchers = append(matchers, fmt.Sprintf("%q !~ /^%s$/", m.Name, escapeSlashes(m.Value)))
-		default:
-			return "", errors.Errorf("unknown match type %v", m.Type)
+		cond, err := tagCondition(m)
+		if err != nil {
+			return "", err
+		}
+		matchers = append(matchers, cond)
+	}
+	// If we don't find a metric name matcher, query all metrics
+	// (InfluxDB measurements) by default.
+	from := "FROM /.+/"
+	switch {
+	case len(nameMatchers) == 1 && nameMatchers[0].Type == prompb.LabelMatcher_EQ:
+		from = fmt.Sprintf("FROM %q.%q", c.retentionPolicy, nameMatchers[0].Value)
+	case len(nameMatchers) == 1 && nameMatchers[0].Type == prompb.LabelMatcher_RE:
+		from = fmt.Sprintf("FROM %q./^%s$/", c.retentionPolicy, escapeSlashes(nameMatchers[0].Value))
+	case len(nameMatchers) > 0:
+		// InfluxQL can neither exclude measurements nor select them by
+		// several conditions, so list the ones matching all matchers.
+		var err error
+		if from, err = c.matchingFrom(nameMatchers); err != nil {
+			return "", err
 		}
 	}
 	matchers = append(matchers, fmt.Sprintf("time >= %vms", q.StartTimestampMs))
 	matchers = append(matchers, fmt.Sprintf("time <= %vms", q.EndTimestampMs))
 
+	if c.pushDownHints {
+		if selection, groupByTime, ok := downsampling(q.Hints); ok {
+			return fmt.Sprintf("SELECT %s %s WHERE %v GROUP BY %s, * fill(none)", selection, from, strings.Join(matchers, " AND "), groupByTime), nil
+		}
+	}
 	return fmt.Sprintf("SELECT value %s WHERE %v GROUP BY *", from, strings.Join(matchers, " AND ")), nil
 }
 
+// tagCondition translates a matcher on a label into an InfluxQL condition
+// on the tag.
+func tagCondition(m *prompb.LabelMatcher) (string, error) {
+	switch m.Type {
+	case prompb.LabelMatcher_EQ:
+		return fmt.Sprintf("%q = '%s'", m.Name, escapeSingleQuotes(m.Value)), nil
+	case prompb.LabelMatcher_NEQ:
+		return fmt.Sprintf("%q != '%s'", m.Name, escapeSingleQuotes(m.Value)), nil
+	case prompb.LabelMatcher_RE:
+		return fmt.Sprintf("%q =~ /^%s$/", m.Name, escapeSlashes(m.Value)), nil
+	case prompb.LabelMatcher_NRE:
+		return fmt.Sprintf("%q !~ /^%s$/", m.Name, escapeSlashes(m.Value)), nil
+	}
+	return "", errors.Errorf("unknown match type %v", m.Type)
+}
+
 func escapeSingleQuotes(str string) string {
 	return strings.Replace(str, `'`, `\'`, -1)
 }
@@ -191,18 +325,30 @@ func escapeSlashes(str string) string {
 	return strings.Replace(str, `/`, `\/`, -1)
 }
 
-func mergeResult(labelsToSeries map[string]*prompb.TimeSeries, results []influx.Result) error {
+// mergeResult merges the returned series into labelsToSeries, counting them
+// against the limits of the read request.
+func mergeResult(labelsToSeries map[string]*prompb.TimeSeries, results []influx.Result, limiter *readLimiter) error {
 	for _, r := range results {
 		for _, s := range r.Series {
-			k := concatLabels(s.Tags)
+			if s.Name == exemplarMeasurement {
+				// Exemplars are only returned by ReadExemplars.
+				continue
+			}
+			k := s.Name + "\xff" + concatLabels(s.Tags)
 			ts, ok := labelsToSeries[k]
 			if !ok {
+				if err := limiter.addSeries(); err != nil {
+					return err
+				}
 				ts = &prompb.TimeSeries{
 					Labels: tagsToLabelPairs(s.Name, s.Tags),
 				}
 				labelsToSeries[k] = ts
 			}
 
+			if err := limiter.addSamples(len(s.Values)); err != nil {
+				return err
+			}
 			samples, err := valuesToSamples(s.Values)
 			if err != nil {
 				return err
@@ -222,6 +368,9 @@ func concatLabels(labels map[string]string) string {
 	for k, v := range labels {
 		pairs = append(pairs, k+separator+v)
 	}
+	// Map iteration order is random, so sort the pairs to get the same
+	// key for the same labels.
+	sort.Strings(pairs)
 	return strings.Join(pairs, separator)
 }
 
@@ -307,17 +456,24 @@ func mergeSamples(a, b []prompb.Sample) []prompb.Sample {
 	return result
 }
 
+// Close releases the connections of the client.
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
 // Name identifies the client as an InfluxDB client.
-func (c Client) Name() string {
+func (c *Client) Name() string {
 	return "influxdb"
 }
 
 // Describe implements prometheus.Collector.
 func (c *Client) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.ignoredSamples.Desc()
+	c.rejectedQueries.Describe(ch)
 }
 
 // Collect implements prometheus.Collector.
 func (c *Client) Collect(ch chan<- prometheus.Metric) {
 	ch <- c.ignoredSamples
+	c.rejectedQueries.Collect(ch)
 }
@@ -16,9 +16,11 @@ package influxdb
 import (
 	"io/ioutil"
 	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -103,9 +105,93 @@ testmetric,test_label=test_label_value2 value=5.1234 123456789123
 		Password: "testpass",
 		Timeout:  time.Minute,
 	}
-	c := NewClient(nil, conf, "test_db", "default")
+	c := NewClient(nil, conf, "test_db", "default", Options{})
 
 	if err := c.Write(samples); err != nil {
 		t.Fatalf("Error sending samples: %s", err)
 	}
 }
+
+func TestUDPClientSplitsPackets(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer conn.Close()
+
+	const payloadSize = 100
+	c, err := NewUDPClient(nil, influx.UDPConfig{Addr: conn.LocalAddr().String(), PayloadSize: payloadSize}, Options{})
+	if err != nil {
+		t.Fatalf("Unable to create client: %s", err)
+	}
+	defer c.Close()
+
+	samples := make(model.Samples, 10)
+	for i := range samples {
+		samples[i] = &model.Sample{
+			Metric: model.Metric{
+				model.MetricNameLabel: "testmetric",
+				"test_label":          "test_label_value",
+			},
+			Timestamp: model.Time(123456789123 + i),
+			Value:     1.23,
+		}
+	}
+	if err := c.Write(samples); err != nil {
+		t.Fatalf("Error sending samples: %s", err)
+	}
+
+	var lines []string
+	buf := make([]byte, 65536)
+	for len(lines) < len(samples) {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Error reading packet after %d lines: %s", len(lines), err)
+		}
+		if n > payloadSize {
+			t.Errorf("Expected packets of at most %d bytes, got %d", payloadSize, n)
+		}
+		lines = append(lines, strings.Split(strings.TrimSuffix(string(buf[:n]), "\n"), "\n")...)
+	}
+	if expected := "testmetric,test_label=test_label_value value=1.23 123456789123000000"; lines[0] != expected {
+		t.Errorf("Unexpected line; expected %q, got %q", expected, lines[0])
+	}
+}
+
+func TestClientWriteErrors(t *testing.T) {
+	for _, c := range []struct {
+		status      int
+		body        string
+		recoverable bool
+	}{
+		{status: http.StatusBadRequest, body: `{"error":"partial write: field type conflict: input field \"value\" on measurement \"up\" is type string, already exists as type float dropped=1"}`},
+		{status: http.StatusNotFound, body: `{"error":"database not found: \"test_db\""}`},
+		// Errors InfluxDB doesn't know to be permanent are server errors.
+		{status: http.StatusInternalServerError, body: `{"error":"timeout"}`, recoverable: true},
+		{status: http.StatusInternalServerError, body: `{"error":"engine: cache-max-memory-size exceeded: (1073741824/1073741824)"}`, recoverable: true},
+		{status: http.StatusServiceUnavailable, body: `<html>Service Unavailable</html>`, recoverable: true},
+		{status: http.StatusTooManyRequests, recoverable: true},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(c.status)
+			w.Write([]byte(c.body))
+		}))
+		client := NewClient(nil, influx.HTTPConfig{Addr: server.URL, Timeout: time.Minute}, "test_db", "autogen", Options{})
+		err := client.Write(model.Samples{{Metric: model.Metric{model.MetricNameLabel: "up"}, Value: 1}})
+		server.Close()
+		if err == nil {
+			t.Fatalf("Expected error for status %d, got none", c.status)
+		}
+		if _, ok := err.(recoverableError); ok != c.recoverable {
+			t.Errorf("Expected recoverable=%v for %q with status %d, got %v", c.recoverable, c.body, c.status, ok)
+		}
+	}
+
+	// Network errors are left to the caller, which retries them.
+	client := NewClient(nil, influx.HTTPConfig{Addr: "http://127.0.0.1:1", Timeout: time.Minute}, "test_db", "autogen", Options{})
+	err := client.Write(model.Samples{{Metric: model.Metric{model.MetricNameLabel: "up"}, Value: 1}})
+	if _, ok := err.(net.Error); !ok {
+		t.Errorf("Expected network error, got %v", err)
+	}
+}
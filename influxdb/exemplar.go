@@ -0,0 +1,192 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"exemplar"
+)
+
+// Exemplars of all series are stored in a single measurement. The labels of
+// the series, including the metric name, and the labels of the exemplar are
+// all tags, the names of the exemplar labels are kept in a field to tell
+// them apart when reading:
+//
+//	rpc_seconds_bucket{le="0.5"} {trace_id="abc"} 0.3
+//	  ->  prometheus_exemplars,__name__=rpc_seconds_bucket,le=0.5,trace_id=abc value=0.3,exemplar_labels="trace_id"
+const (
+	exemplarMeasurement     = "prometheus_exemplars"
+	fieldExemplarLabels     = "exemplar_labels"
+	exemplarLabelsSeparator = ","
+)
+
+// WriteExemplars sends exemplars to InfluxDB.
+func (c *Client) WriteExemplars(series []exemplar.Series) error {
+	points, err := exemplarPoints(c.logger, series, c.ignoredSamples)
+	if err != nil {
+		return err
+	}
+	return c.writePoints(points)
+}
+
+// exemplarPoints converts exemplars into InfluxDB points. Exemplars with
+// values InfluxDB can't store, or with labels which clash with the labels
+// of their series, are skipped and counted as ignored.
+func exemplarPoints(logger log.Logger, series []exemplar.Series, ignored prometheus.Counter) ([]*influx.Point, error) {
+	var points []*influx.Point
+	for _, s := range series {
+		for _, e := range s.Exemplars {
+			v := float64(e.Value)
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				level.Debug(logger).Log("msg", "Cannot send  to InfluxDB, skipping exemplar", "value", v, "series", s.SeriesLabels)
+				ignored.Inc()
+				continue
+			}
+
+			tags := make(map[string]string, len(s.SeriesLabels)+len(e.Labels))
+			for l, v := range s.SeriesLabels {
+				tags[string(l)] = string(v)
+			}
+			var (
+				names []string
+				clash bool
+			)
+			for l, v := range e.Labels {
+				if _, ok := tags[string(l)]; ok {
+					clash = true
+					break
+				}
+				tags[string(l)] = string(v)
+				names = append(names, string(l))
+			}
+			if clash {
+				level.Debug(logger).Log("msg", "Cannot send  to InfluxDB, skipping exemplar whose labels clash with its series", "labels", e.Labels, "series", s.SeriesLabels)
+				ignored.Inc()
+				continue
+			}
+			sort.Strings(names)
+
+			p, err := influx.NewPoint(
+				exemplarMeasurement,
+				tags,
+				map[string]interface{}{
+					fieldValue:          v,
+					fieldExemplarLabels: strings.Join(names, exemplarLabelsSeparator),
+				},
+				e.Timestamp.Time(),
+			)
+			if err != nil {
+				return nil, err
+			}
+			points = append(points, p)
+		}
+	}
+	return points, nil
+}
+
+// ReadExemplars returns the exemplars of the series selected by the
+// matchers of q within its time range.
+func (c *Client) ReadExemplars(q *prompb.Query) ([]exemplar.Series, error) {
+	command, err := c.buildExemplarCommand(q)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Query(influx.NewQuery(command, c.database, "ms"))
+	if err != nil {
+		return nil, err
+	}
+	if resp.Err != "" {
+		return nil, errors.New(resp.Err)
+	}
+	return exemplarsFromResult(resp.Results)
+}
+
+func (c *Client) buildExemplarCommand(q *prompb.Query) (string, error) {
+	matchers := make([]string, 0, len(q.Matchers)+2)
+	for _, m := range q.Matchers {
+		cond, err := tagCondition(m)
+		if err != nil {
+			return "", err
+		}
+		matchers = append(matchers, cond)
+	}
+	matchers = append(matchers, fmt.Sprintf("time >= %vms", q.StartTimestampMs))
+	matchers = append(matchers, fmt.Sprintf("time <= %vms", q.EndTimestampMs))
+
+	return fmt.Sprintf("SELECT %q, %q FROM %q.%q WHERE %v GROUP BY *",
+		fieldValue, fieldExemplarLabels, c.retentionPolicy, exemplarMeasurement,
+		strings.Join(matchers, " AND ")), nil
+}
+
+// exemplarsFromResult splits the tags of the exemplar series returned by
+// InfluxDB into the labels of the series and of the exemplars.
+func exemplarsFromResult(results []influx.Result) ([]exemplar.Series, error) {
+	var series []exemplar.Series
+	for _, r := range results {
+		for _, s := range r.Series {
+			for _, row := range s.Values {
+				if len(row) != 3 {
+					return nil, errors.Errorf("bad exemplar tuple length, expected [<timestamp>, <value>, <labels>], got %v", row)
+				}
+				samples, err := valuesToSamples([][]interface{}{row[:2]})
+				if err != nil {
+					return nil, err
+				}
+				names, ok := row[2].(string)
+				if !ok {
+					return nil, errors.Errorf("bad exemplar labels: %v", row[2])
+				}
+
+				seriesLabels := model.LabelSet{}
+				for k, v := range s.Tags {
+					// Empty tags don't exist, see tagsToLabelPairs.
+					if v != "" {
+						seriesLabels[model.LabelName(k)] = model.LabelValue(v)
+					}
+				}
+				labels := model.LabelSet{}
+				if names != "" {
+					for _, n := range strings.Split(names, exemplarLabelsSeparator) {
+						labels[model.LabelName(n)] = seriesLabels[model.LabelName(n)]
+						delete(seriesLabels, model.LabelName(n))
+					}
+				}
+				series = append(series, exemplar.Series{
+					SeriesLabels: seriesLabels,
+					Exemplars: []exemplar.Exemplar{{
+						Labels:    labels,
+						Value:     model.SampleValue(samples[0].Value),
+						Timestamp: model.Time(samples[0].Timestamp),
+					}},
+				})
+			}
+		}
+	}
+	// The exemplars of a series come back in as many InfluxDB series as
+	// they have distinct labels.
+	return exemplar.Merge(series), nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"exemplar"
+)
+
+func TestExemplarPoints(t *testing.T) {
+	series := []exemplar.Series{{
+		SeriesLabels: model.LabelSet{"__name__": "rpc_seconds_bucket", "le": "0.5"},
+		Exemplars: []exemplar.Exemplar{
+			{Labels: model.LabelSet{"trace_id": "abc", "span_id": "1"}, Value: 0.3, Timestamp: 1000},
+			{Labels: model.LabelSet{"trace_id": "def"}, Value: model.SampleValue(math.NaN()), Timestamp: 2000},
+			// Clashes with the le label of the series.
+			{Labels: model.LabelSet{"le": "1"}, Value: 0.4, Timestamp: 3000},
+		},
+	}}
+	ignored := prometheus.NewCounter(prometheus.CounterOpts{Name: "ignored"})
+	points, err := exemplarPoints(log.NewNopLogger(), series, ignored)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var lines []string
+	for _, p := range points {
+		lines = append(lines, p.PrecisionString("ms"))
+	}
+	expected := []string{
+		`prometheus_exemplars,__name__=rpc_seconds_bucket,le=0.5,span_id=1,trace_id=abc exemplar_labels="span_id,trace_id",value=0.3 1000`,
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected points\n%v\ngot\n%v", expected, lines)
+	}
+}
+
+func TestBuildExemplarCommand(t *testing.T) {
+	c := &Client{retentionPolicy: "autogen"}
+	command, err := c.buildExemplarCommand(&prompb.Query{
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "rpc_.*"},
+			{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "a"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := `SELECT "value", "exemplar_labels" FROM "autogen"."prometheus_exemplars" WHERE "__name__" =~ /^rpc_.*$/ AND "job" = 'a' AND time >= 1000ms AND time <= 2000ms GROUP BY *`
+	if command != expected {
+		t.Errorf("Expected command\n%s\ngot\n%s", expected, command)
+	}
+}
+
+func TestExemplarsFromResult(t *testing.T) {
+	results := []influx.Result{{
+		Series: []models.Row{
+			{
+				Name:    exemplarMeasurement,
+				Tags:    map[string]string{"__name__": "up", "job": "a", "trace_id": "def", "span_id": ""},
+				Columns: []string{"time", "value", "exemplar_labels"},
+				Values:  [][]interface{}{{json.Number("2000"), json.Number("2"), "trace_id"}},
+			},
+			{
+				Name:    exemplarMeasurement,
+				Tags:    map[string]string{"__name__": "up", "job": "a", "trace_id": "abc", "span_id": "1"},
+				Columns: []string{"time", "value", "exemplar_labels"},
+				Values:  [][]interface{}{{json.Number("1000"), json.Number("1"), "span_id,trace_id"}},
+			},
+		},
+	}}
+	series, err := exemplarsFromResult(results)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []exemplar.Series{{
+		SeriesLabels: model.LabelSet{"__name__": "up", "job": "a"},
+		Exemplars: []exemplar.Exemplar{
+			{Labels: model.LabelSet{"trace_id": "abc", "span_id": "1"}, Value: 1, Timestamp: 1000},
+			{Labels: model.LabelSet{"trace_id": "def"}, Value: 2, Timestamp: 2000},
+		},
+	}}
+	if !reflect.DeepEqual(series, expected) {
+		t.Errorf("Expected %v, got %v", expected, series)
+	}
+}
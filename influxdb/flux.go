@@ -0,0 +1,241 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// buildFluxQuery translates a query into a Flux query selecting the value
+// field of the matching series. Prometheus treats an empty label value like
+// a missing label, so matchers which match the empty string also match
+// series without the tag.
+func buildFluxQuery(bucket string, q *prompb.Query) (string, error) {
+	filters := []string{`r._field == "value"`}
+	for _, m := range q.Matchers {
+		f, err := fluxFilter(m)
+		if err != nil {
+			return "", err
+		}
+		filters = append(filters, f)
+	}
+
+	// The stop of a range is exclusive, while the end of a query isn't.
+	return fmt.Sprintf(
+		"from(bucket: %s)\n  |> range(start: %s, stop: %s)\n  |> filter(fn: (r) => %s)",
+		fluxString(bucket),
+		fluxTime(q.StartTimestampMs),
+		fluxTime(q.EndTimestampMs+1),
+		strings.Join(filters, " and "),
+	), nil
+}
+
+func fluxFilter(m *prompb.LabelMatcher) (string, error) {
+	column := fmt.Sprintf("r[%s]", fluxString(m.Name))
+	if m.Name == model.MetricNameLabel {
+		column = "r._measurement"
+	}
+
+	var cmp string
+	var matchesEmpty bool
+	switch m.Type {
+	case prompb.LabelMatcher_EQ:
+		cmp = fmt.Sprintf("%s == %s", column, fluxString(m.Value))
+		matchesEmpty = m.Value == ""
+	case prompb.LabelMatcher_NEQ:
+		cmp = fmt.Sprintf("%s != %s", column, fluxString(m.Value))
+		matchesEmpty = m.Value != ""
+	case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+		re, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return "", err
+		}
+		op := "=~"
+		if m.Type == prompb.LabelMatcher_NRE {
+			op = "!~"
+		}
+		cmp = fmt.Sprintf("%s %s /%s/", column, op, escapeSlashes(re.String()))
+		matchesEmpty = re.MatchString("") == (m.Type == prompb.LabelMatcher_RE)
+	default:
+		return "", errors.Errorf("unknown match type %v", m.Type)
+	}
+
+	if m.Name == model.MetricNameLabel {
+		return cmp, nil
+	}
+	if matchesEmpty {
+		return fmt.Sprintf("(not exists %s or %s)", column, cmp), nil
+	}
+	return fmt.Sprintf("(exists %s and %s)", column, cmp), nil
+}
+
+// fluxString quotes s as a Flux string literal.
+func fluxString(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, `${`, `\${`, -1)
+	return `"` + s + `"`
+}
+
+func fluxTime(ms int64) string {
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+}
+
+// fluxColumns are the columns of a Flux result which aren't tags.
+var fluxColumns = map[string]bool{
+	"":             true,
+	"result":       true,
+	"table":        true,
+	"_start":       true,
+	"_stop":        true,
+	"_time":        true,
+	"_value":       true,
+	"_field":       true,
+	"_measurement": true,
+}
+
+// parseFluxCSV parses the annotated CSV response of a Flux query into
+// series, sorted by their labels.
+// https://docs.influxdata.com/influxdb/v2.0/reference/syntax/annotated-csv/
+func parseFluxCSV(r io.Reader) ([]*prompb.TimeSeries, error) {
+	cr := csv.NewReader(r)
+	// Each table of the response has its own header and columns.
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	var (
+		header       []string
+		columns      map[string]int
+		expectHeader = true
+		series       = map[string]*prompb.TimeSeries{}
+	)
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "error parsing Flux response")
+		}
+		if strings.HasPrefix(record[0], "#") {
+			expectHeader = true
+			continue
+		}
+		if expectHeader {
+			header = append(header[:0], record...)
+			columns = make(map[string]int, len(header))
+			for i, name := range header {
+				columns[name] = i
+			}
+			expectHeader = false
+			continue
+		}
+		if len(record) != len(header) {
+			return nil, errors.Errorf("unexpected number of columns in Flux response, expected %d, got %d", len(header), len(record))
+		}
+
+		ti, ok := columns["_time"]
+		if !ok {
+			// Errors which occur while the response is written are
+			// returned as a table with an error column.
+			if i, ok := columns["error"]; ok {
+				return nil, errors.Errorf("error in Flux response: %s", record[i])
+			}
+			return nil, errors.New("missing _time column in Flux response")
+		}
+		vi, ok := columns["_value"]
+		if !ok {
+			return nil, errors.New("missing _value column in Flux response")
+		}
+
+		t, err := time.Parse(time.RFC3339Nano, record[ti])
+		if err != nil {
+			return nil, errors.Wrap(err, "bad sample timestamp")
+		}
+		v, err := strconv.ParseFloat(record[vi], 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad sample value")
+		}
+
+		labels := fluxLabels(header, record)
+		k := labelsKey(labels)
+		ts, ok := series[k]
+		if !ok {
+			ts = &prompb.TimeSeries{Labels: labels}
+			series[k] = ts
+		}
+		ts.Samples = append(ts.Samples, prompb.Sample{
+			Timestamp: t.UnixNano() / int64(time.Millisecond),
+			Value:     v,
+		})
+	}
+
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([]*prompb.TimeSeries, 0, len(keys))
+	for _, k := range keys {
+		ts := series[k]
+		sort.Slice(ts.Samples, func(i, j int) bool {
+			return ts.Samples[i].Timestamp < ts.Samples[j].Timestamp
+		})
+		result = append(result, ts)
+	}
+	return result, nil
+}
+
+// fluxLabels returns the labels of a row, sorted by name. Empty tag values
+// are skipped, as they are equivalent to missing labels in Prometheus.
+func fluxLabels(header, record []string) []prompb.Label {
+	var labels []prompb.Label
+	for i, name := range header {
+		if name == "_measurement" {
+			labels = append(labels, prompb.Label{Name: model.MetricNameLabel, Value: record[i]})
+			continue
+		}
+		if fluxColumns[name] || record[i] == "" {
+			continue
+		}
+		labels = append(labels, prompb.Label{Name: name, Value: record[i]})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	return labels
+}
+
+func labelsKey(labels []prompb.Label) string {
+	// 0xff cannot occur in valid UTF-8 sequences, so use it
+	// as a separator here.
+	separator := "\xff"
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, l.Name+separator+l.Value)
+	}
+	return strings.Join(pairs, separator)
+}
@@ -0,0 +1,152 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestBuildFluxQuery(t *testing.T) {
+	q := &prompb.Query{
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+			{Type: prompb.LabelMatcher_EQ, Name: "job", Value: `a"b`},
+		},
+	}
+	expected := `from(bucket: "prometheus")
+  |> range(start: 1970-01-01T00:00:01Z, stop: 1970-01-01T00:00:02.001Z)
+  |> filter(fn: (r) => r._field == "value" and r._measurement == "up" and (exists r["job"] and r["job"] == "a\"b"))`
+	query, err := buildFluxQuery("prometheus", q)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if query != expected {
+		t.Errorf("Expected query\n%s\ngot\n%s", expected, query)
+	}
+}
+
+func TestFluxFilter(t *testing.T) {
+	tests := []struct {
+		matcher  prompb.LabelMatcher
+		expected string
+	}{
+		{
+			matcher:  prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "up|down"},
+			expected: `r._measurement =~ /^(?:up|down)$/`,
+		},
+		{
+			matcher:  prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "job", Value: ""},
+			expected: `(not exists r["job"] or r["job"] == "")`,
+		},
+		{
+			matcher:  prompb.LabelMatcher{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "node"},
+			expected: `(not exists r["job"] or r["job"] != "node")`,
+		},
+		{
+			matcher:  prompb.LabelMatcher{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: ""},
+			expected: `(exists r["job"] and r["job"] != "")`,
+		},
+		{
+			matcher:  prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "path", Value: "/a/.*"},
+			expected: `(exists r["path"] and r["path"] =~ /^(?:\/a\/.*)$/)`,
+		},
+		{
+			matcher:  prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "job", Value: "node|"},
+			expected: `(not exists r["job"] or r["job"] =~ /^(?:node|)$/)`,
+		},
+		{
+			matcher:  prompb.LabelMatcher{Type: prompb.LabelMatcher_NRE, Name: "job", Value: "node"},
+			expected: `(not exists r["job"] or r["job"] !~ /^(?:node)$/)`,
+		},
+		{
+			matcher:  prompb.LabelMatcher{Type: prompb.LabelMatcher_NRE, Name: "job", Value: ".*"},
+			expected: `(exists r["job"] and r["job"] !~ /^(?:.*)$/)`,
+		},
+		{
+			matcher:  prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "job", Value: `${x}\`},
+			expected: `(exists r["job"] and r["job"] == "\${x}\\")`,
+		},
+	}
+	for _, test := range tests {
+		m := test.matcher
+		f, err := fluxFilter(&m)
+		if err != nil {
+			t.Fatalf("Unexpected error for %v: %s", m, err)
+		}
+		if f != test.expected {
+			t.Errorf("Expected filter %s for %v, got %s", test.expected, m, f)
+		}
+	}
+
+	if _, err := fluxFilter(&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "job", Value: "("}); err == nil {
+		t.Error("Expected error for invalid regular expression, got none")
+	}
+}
+
+func TestParseFluxCSV(t *testing.T) {
+	response := `#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,double,string,string,string
+#group,false,false,true,true,false,false,true,true,true
+#default,_result,,,,,,,,
+,result,table,_start,_stop,_time,_value,_field,_measurement,job
+,,0,1970-01-01T00:00:00Z,1970-01-01T00:01:00Z,1970-01-01T00:00:02Z,2,value,up,node
+,,0,1970-01-01T00:00:00Z,1970-01-01T00:01:00Z,1970-01-01T00:00:01.5Z,1,value,up,node
+
+#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,double,string,string,string,string
+#group,false,false,true,true,false,false,true,true,true,true
+#default,_result,,,,,,,,,
+,result,table,_start,_stop,_time,_value,_field,_measurement,instance,job
+,,1,1970-01-01T00:00:00Z,1970-01-01T00:01:00Z,1970-01-01T00:00:01Z,3,value,up,a:9090,
+`
+	series, err := parseFluxCSV(strings.NewReader(response))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []*prompb.TimeSeries{
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "up"},
+				{Name: "instance", Value: "a:9090"},
+			},
+			Samples: []prompb.Sample{{Timestamp: 1000, Value: 3}},
+		},
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "up"},
+				{Name: "job", Value: "node"},
+			},
+			Samples: []prompb.Sample{{Timestamp: 1500, Value: 1}, {Timestamp: 2000, Value: 2}},
+		},
+	}
+	if !reflect.DeepEqual(series, expected) {
+		t.Errorf("Expected %v, got %v", expected, series)
+	}
+}
+
+func TestParseFluxCSVError(t *testing.T) {
+	response := `#datatype,string,string
+#group,true,true
+#default,,
+,error,reference
+,query terminated,
+`
+	if _, err := parseFluxCSV(strings.NewReader(response)); err == nil || !strings.Contains(err.Error(), "query terminated") {
+		t.Errorf("Expected error from response, got %v", err)
+	}
+}
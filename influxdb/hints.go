@@ -0,0 +1,58 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// pushDownFuncs maps the PromQL range functions which can be pushed down to
+// the InfluxQL functions computing them per time bucket. Prometheus applies
+// the range function again to the returned points, so only functions whose
+// result over the per-bucket results equals their result over the raw
+// samples are listed. Functions like rate or avg_over_time are not.
+var pushDownFuncs = map[string]string{
+	"max_over_time":  "max",
+	"min_over_time":  "min",
+	"sum_over_time":  "sum",
+	"last_over_time": "last",
+}
+
+// downsampling returns the InfluxQL selection and GROUP BY time clause which
+// downsample the raw samples to one point per step, as far as this doesn't
+// change the result of the query the hints describe. It returns false if
+// the query has to be answered with the raw samples.
+//
+// Prometheus evaluates a range function at start+k*step over the range
+// (t-range, t]. The time buckets are aligned to these ranges by offsetting
+// them by one millisecond, so that each range covers range/step buckets and
+// each bucket is labeled with a timestamp inside of it.
+func downsampling(h *prompb.ReadHints) (selection, groupByTime string, ok bool) {
+	if h == nil || h.StepMs <= 0 || h.RangeMs < h.StepMs || h.RangeMs%h.StepMs != 0 {
+		return "", "", false
+	}
+	f, ok := pushDownFuncs[h.Func]
+	if !ok {
+		return "", "", false
+	}
+	// The first evaluation is at the start of the selection plus the
+	// range.
+	offset := (h.StartMs + h.RangeMs + 1) % h.StepMs
+	if offset < 0 {
+		offset += h.StepMs
+	}
+	return fmt.Sprintf("%s(value) AS value", f), fmt.Sprintf("time(%dms, %dms)", h.StepMs, offset), true
+}
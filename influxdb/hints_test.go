@@ -0,0 +1,219 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestBuildCommandPushesDownHints(t *testing.T) {
+	c := &Client{retentionPolicy: "autogen", pushDownHints: true}
+	matchers := []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}}
+
+	for _, tc := range []struct {
+		hints    *prompb.ReadHints
+		expected string
+	}{
+		{
+			hints:    &prompb.ReadHints{Func: "max_over_time", StepMs: 60000, RangeMs: 300000, StartMs: 600000, EndMs: 3600000},
+			expected: `SELECT max(value) AS value FROM "autogen"."up" WHERE time >= 600000ms AND time <= 3600000ms GROUP BY time(60000ms, 1ms), * fill(none)`,
+		},
+		{
+			hints:    &prompb.ReadHints{Func: "min_over_time", StepMs: 60000, RangeMs: 60000, StartMs: 615000, EndMs: 3600000},
+			expected: `SELECT min(value) AS value FROM "autogen"."up" WHERE time >= 600000ms AND time <= 3600000ms GROUP BY time(60000ms, 15001ms), * fill(none)`,
+		},
+		{
+			hints:    &prompb.ReadHints{Func: "sum_over_time", StepMs: 30000, RangeMs: 60000, StartMs: 600000, EndMs: 3600000},
+			expected: `SELECT sum(value) AS value FROM "autogen"."up" WHERE time >= 600000ms AND time <= 3600000ms GROUP BY time(30000ms, 1ms), * fill(none)`,
+		},
+		{
+			hints:    &prompb.ReadHints{Func: "last_over_time", StepMs: 30000, RangeMs: 30000, StartMs: 600000, EndMs: 3600000},
+			expected: `SELECT last(value) AS value FROM "autogen"."up" WHERE time >= 600000ms AND time <= 3600000ms GROUP BY time(30000ms, 1ms), * fill(none)`,
+		},
+		// Functions whose result would change.
+		{
+			hints:    &prompb.ReadHints{Func: "rate", StepMs: 60000, RangeMs: 300000, StartMs: 600000, EndMs: 3600000},
+			expected: `SELECT value FROM "autogen"."up" WHERE time >= 600000ms AND time <= 3600000ms GROUP BY *`,
+		},
+		{
+			hints:    &prompb.ReadHints{Func: "avg_over_time", StepMs: 60000, RangeMs: 300000, StartMs: 600000, EndMs: 3600000},
+			expected: `SELECT value FROM "autogen"."up" WHERE time >= 600000ms AND time <= 3600000ms GROUP BY *`,
+		},
+		// Instant queries.
+		{
+			hints:    &prompb.ReadHints{Func: "max_over_time", RangeMs: 300000, StartMs: 600000, EndMs: 3600000},
+			expected: `SELECT value FROM "autogen"."up" WHERE time >= 600000ms AND time <= 3600000ms GROUP BY *`,
+		},
+		// Ranges which don't cover whole steps.
+		{
+			hints:    &prompb.ReadHints{Func: "max_over_time", StepMs: 60000, RangeMs: 90000, StartMs: 600000, EndMs: 3600000},
+			expected: `SELECT value FROM "autogen"."up" WHERE time >= 600000ms AND time <= 3600000ms GROUP BY *`,
+		},
+		{
+			expected: `SELECT value FROM "autogen"."up" WHERE time >= 600000ms AND time <= 3600000ms GROUP BY *`,
+		},
+	} {
+		command, err := c.buildCommand(&prompb.Query{
+			StartTimestampMs: 600000,
+			EndTimestampMs:   3600000,
+			Matchers:         matchers,
+			Hints:            tc.hints,
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if command != tc.expected {
+			t.Errorf("Expected command for %+v:\n%s\ngot:\n%s", tc.hints, tc.expected, command)
+		}
+	}
+
+	c.pushDownHints = false
+	command, err := c.buildCommand(&prompb.Query{
+		StartTimestampMs: 600000,
+		EndTimestampMs:   3600000,
+		Matchers:         matchers,
+		Hints:            &prompb.ReadHints{Func: "max_over_time", StepMs: 60000, RangeMs: 300000, StartMs: 600000, EndMs: 3600000},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if expected := `SELECT value FROM "autogen"."up" WHERE time >= 600000ms AND time <= 3600000ms GROUP BY *`; command != expected {
+		t.Errorf("Expected hints to be ignored, got %s", command)
+	}
+}
+
+// rangeFuncs evaluate the pushed down PromQL range functions over the
+// samples of a range.
+var rangeFuncs = map[string]func([]prompb.Sample) float64{
+	"max_over_time": func(s []prompb.Sample) float64 {
+		v := s[0].Value
+		for _, x := range s[1:] {
+			v = math.Max(v, x.Value)
+		}
+		return v
+	},
+	"min_over_time": func(s []prompb.Sample) float64 {
+		v := s[0].Value
+		for _, x := range s[1:] {
+			v = math.Min(v, x.Value)
+		}
+		return v
+	},
+	"sum_over_time": func(s []prompb.Sample) float64 {
+		v := 0.0
+		for _, x := range s {
+			v += x.Value
+		}
+		return v
+	},
+	"last_over_time": func(s []prompb.Sample) float64 {
+		return s[len(s)-1].Value
+	},
+}
+
+// evaluate evaluates a range function like PromQL at start+k*step up to end,
+// over the samples in (t-range, t].
+func evaluate(f func([]prompb.Sample) float64, samples []prompb.Sample, start, end, step, rng int64) map[int64]float64 {
+	results := map[int64]float64{}
+	for t := start; t <= end; t += step {
+		var window []prompb.Sample
+		for _, s := range samples {
+			if s.Timestamp > t-rng && s.Timestamp <= t {
+				window = append(window, s)
+			}
+		}
+		if len(window) > 0 {
+			results[t] = f(window)
+		}
+	}
+	return results
+}
+
+// groupByTime aggregates samples like InfluxDB does for GROUP BY
+// time(step, offset) fill(none), labeling each bucket with its start.
+func groupByTime(f func([]prompb.Sample) float64, samples []prompb.Sample, step, offset int64) []prompb.Sample {
+	buckets := map[int64][]prompb.Sample{}
+	for _, s := range samples {
+		b := s.Timestamp - offset
+		b -= ((b % step) + step) % step
+		buckets[b+offset] = append(buckets[b+offset], s)
+	}
+	var points []prompb.Sample
+	for ts, b := range buckets {
+		points = append(points, prompb.Sample{Timestamp: ts, Value: f(b)})
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Timestamp < points[j].Timestamp })
+	return points
+}
+
+func TestDownsamplingKeepsResults(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	const (
+		evalStart = 1000000
+		evalEnd   = 2000000
+		step      = 20000
+	)
+	for name, f := range rangeFuncs {
+		for _, rng := range []int64{step, 3 * step} {
+			// Prometheus selects the samples from the start of the
+			// first range.
+			selStart := int64(evalStart - rng)
+
+			// Scrape every 5s with jitter, including samples right
+			// on the boundaries of the ranges.
+			var samples []prompb.Sample
+			for ts := selStart; ts <= evalEnd; ts += 5000 {
+				ts := ts
+				if rnd.Intn(3) > 0 {
+					ts += rnd.Int63n(5000)
+				}
+				if ts > evalEnd {
+					break
+				}
+				// Integers keep sums exact regardless of their order.
+				samples = append(samples, prompb.Sample{Timestamp: ts, Value: float64(rnd.Intn(100))})
+			}
+
+			hints := &prompb.ReadHints{Func: name, StepMs: step, RangeMs: rng, StartMs: selStart, EndMs: evalEnd}
+			selection, groupBy, ok := downsampling(hints)
+			if !ok {
+				t.Fatalf("Expected %s over %dms to be pushed down", name, rng)
+			}
+			var groupStep, offset int64
+			if _, err := fmt.Sscanf(groupBy, "time(%dms, %dms)", &groupStep, &offset); err != nil || groupStep != step {
+				t.Fatalf("Unexpected GROUP BY clause %q for %s: %s", groupBy, selection, err)
+			}
+
+			raw := evaluate(f, samples, evalStart, evalEnd, step, rng)
+			downsampled := evaluate(f, groupByTime(f, samples, step, offset), evalStart, evalEnd, step, rng)
+			if len(raw) == 0 {
+				t.Fatalf("No results for %s", name)
+			}
+			for ts, v := range raw {
+				if d, ok := downsampled[ts]; !ok || d != v {
+					t.Errorf("%s over %dms at %d: expected %v from raw samples, got %v (%t) from downsampled ones", name, rng, ts, v, d, ok)
+				}
+			}
+			if len(downsampled) != len(raw) {
+				t.Errorf("%s over %dms: expected %d results, got %d", name, rng, len(raw), len(downsampled))
+			}
+		}
+	}
+}
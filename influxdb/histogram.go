@@ -0,0 +1,383 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"histogram"
+)
+
+// With grouped histograms, the series of a histogram or summary are stored
+// as fields of a single measurement named after the family:
+//
+//	foo_bucket{le="0.5"}  ->  foo le_0.5=...
+//	foo{quantile="0.99"}  ->  foo quantile_0.99=...
+//	foo_sum               ->  foo sum=...
+//	foo_count             ->  foo count=...
+//
+// Any other series is stored in the value field, as without grouping. The
+// suffixes are all that's known about the type of a series, so any series
+// ending in _sum or _count is grouped. Reads expand the fields again, which
+// restores the original series either way.
+const (
+	fieldValue          = "value"
+	fieldSum            = "sum"
+	fieldCount          = "count"
+	fieldBucketPrefix   = "le_"
+	fieldQuantilePrefix = "quantile_"
+)
+
+// histogramField returns the measurement and field a series is stored in
+// with grouped histograms, and the label which is encoded in the field name,
+// if any.
+func histogramField(m model.Metric) (measurement, field string, label model.LabelName) {
+	name := string(m[model.MetricNameLabel])
+	if le, ok := m[model.BucketLabel]; ok && hasSuffix(name, "_bucket") {
+		return strings.TrimSuffix(name, "_bucket"), fieldBucketPrefix + string(le), model.BucketLabel
+	}
+	if hasSuffix(name, "_sum") {
+		return strings.TrimSuffix(name, "_sum"), fieldSum, ""
+	}
+	if hasSuffix(name, "_count") {
+		return strings.TrimSuffix(name, "_count"), fieldCount, ""
+	}
+	if q, ok := m[model.QuantileLabel]; ok {
+		return name, fieldQuantilePrefix + string(q), model.QuantileLabel
+	}
+	return name, fieldValue, ""
+}
+
+// hasSuffix reports whether s ends in suffix and has something before it.
+func hasSuffix(s, suffix string) bool {
+	return len(s) > len(suffix) && strings.HasSuffix(s, suffix)
+}
+
+// seriesFromField is the reverse of histogramField. It returns false for
+// fields which weren't written by the adapter.
+func seriesFromField(measurement, field string) (name string, label model.LabelName, value string, ok bool) {
+	switch {
+	case field == fieldValue:
+		return measurement, "", "", true
+	case field == fieldSum:
+		return measurement + "_sum", "", "", true
+	case field == fieldCount:
+		return measurement + "_count", "", "", true
+	case strings.HasPrefix(field, fieldBucketPrefix):
+		return measurement + "_bucket", model.BucketLabel, strings.TrimPrefix(field, fieldBucketPrefix), true
+	case strings.HasPrefix(field, fieldQuantilePrefix):
+		return measurement, model.QuantileLabel, strings.TrimPrefix(field, fieldQuantilePrefix), true
+	}
+	return "", "", "", false
+}
+
+// groupedPoints converts samples into InfluxDB points, with the series of
+// a histogram or summary family which share their labels and timestamp
+// grouped into a single point.
+func groupedPoints(logger log.Logger, samples model.Samples, ignored prometheus.Counter) ([]*influx.Point, error) {
+	type key struct {
+		measurement string
+		signature   uint64
+		timestamp   model.Time
+	}
+	type group struct {
+		tags   map[string]string
+		fields map[string]interface{}
+	}
+
+	var keys []key
+	groups := map[key]*group{}
+	for _, s := range samples {
+		v := float64(s.Value)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			level.Debug(logger).Log("msg", "Cannot send  to InfluxDB, skipping sample", "value", v, "sample", s)
+			ignored.Inc()
+			continue
+		}
+
+		measurement, field, label := histogramField(s.Metric)
+		m := s.Metric
+		if label != "" {
+			m = m.Clone()
+			delete(m, label)
+		}
+		// The metric name differs between the series of a family, so
+		// leave it out of the signature.
+		tags := tagsFromMetric(m)
+		delete(tags, model.MetricNameLabel)
+		k := key{
+			measurement: measurement,
+			signature:   model.LabelsToSignature(tags),
+			timestamp:   s.Timestamp,
+		}
+		g, ok := groups[k]
+		if !ok {
+			g = &group{tags: tags, fields: map[string]interface{}{}}
+			groups[k] = g
+			keys = append(keys, k)
+		}
+		g.fields[field] = v
+	}
+
+	points := make([]*influx.Point, 0, len(keys))
+	for _, k := range keys {
+		g := groups[k]
+		p, err := influx.NewPoint(k.measurement, g.tags, g.fields, k.timestamp.Time())
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+// groupedMeasurements returns the measurements in which the series with the
+// given metric name may be stored with grouped histograms.
+func groupedMeasurements(name string) []string {
+	measurements := []string{name}
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if hasSuffix(name, suffix) {
+			measurements = append(measurements, strings.TrimSuffix(name, suffix))
+		}
+	}
+	return measurements
+}
+
+// buildGroupedCommand builds a query selecting all fields of the
+// measurements which may contain the matching series. Matchers on the
+// labels which are encoded in field names can't be sent to InfluxDB, so the
+// returned series must be filtered with all matchers again.
+func (c *Client) buildGroupedCommand(q *prompb.Query) (string, error) {
+	matchers := make([]string, 0, len(q.Matchers))
+	// The measurements of series matching a regular expression or a
+	// non-equal matcher can't be derived from it, so query all
+	// measurements then.
+	from := "FROM /.+/"
+	for _, m := range q.Matchers {
+		if m.Name == model.MetricNameLabel {
+			// Other matchers are applied to the expanded series only.
+			if m.Type == prompb.LabelMatcher_EQ {
+				var measurements []string
+				for _, name := range groupedMeasurements(m.Value) {
+					measurements = append(measurements, fmt.Sprintf("%q.%q", c.retentionPolicy, name))
+				}
+				from = "FROM " + strings.Join(measurements, ",")
+			}
+			continue
+		}
+		if m.Name == model.BucketLabel || m.Name == model.QuantileLabel {
+			continue
+		}
+
+		cond, err := tagCondition(m)
+		if err != nil {
+			return "", err
+		}
+		matchers = append(matchers, cond)
+	}
+	matchers = append(matchers, fmt.Sprintf("time >= %vms", q.StartTimestampMs))
+	matchers = append(matchers, fmt.Sprintf("time <= %vms", q.EndTimestampMs))
+
+	return fmt.Sprintf("SELECT * %s WHERE %v GROUP BY *", from, strings.Join(matchers, " AND ")), nil
+}
+
+// mergeGroupedResult expands the fields of the returned series into the
+// series they were written from, and merges the ones matching all matchers
+// into labelsToSeries, counting them against the limits of the read request.
+func mergeGroupedResult(labelsToSeries map[string]*prompb.TimeSeries, results []influx.Result, matchers []*prompb.LabelMatcher, limiter *readLimiter) error {
+	match, err := newLabelsMatcher(matchers)
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		for _, s := range r.Series {
+			if s.Name == exemplarMeasurement {
+				// Exemplars are only returned by ReadExemplars.
+				continue
+			}
+			for i, column := range s.Columns {
+				if column == "time" {
+					continue
+				}
+				name, label, value, ok := seriesFromField(s.Name, column)
+				if !ok {
+					continue
+				}
+				tags := make(map[string]string, len(s.Tags)+1)
+				for k, v := range s.Tags {
+					tags[k] = v
+				}
+				if label != "" {
+					tags[string(label)] = value
+				}
+				labels := tagsToLabelPairs(name, tags)
+				if !match(labels) {
+					continue
+				}
+
+				samples, err := columnToSamples(s.Values, i)
+				if err != nil {
+					return err
+				}
+				if len(samples) == 0 {
+					continue
+				}
+				if err := limiter.addSamples(len(samples)); err != nil {
+					return err
+				}
+
+				tags[model.MetricNameLabel] = name
+				k := concatLabels(tags)
+				ts, ok := labelsToSeries[k]
+				if !ok {
+					if err := limiter.addSeries(); err != nil {
+						return err
+					}
+					ts = &prompb.TimeSeries{Labels: labels}
+					labelsToSeries[k] = ts
+				}
+				ts.Samples = mergeSamples(ts.Samples, samples)
+			}
+		}
+	}
+	return nil
+}
+
+// columnToSamples returns the samples of a field in the rows of a query
+// result, whose first column is the time. Rows in which the field is null
+// are skipped.
+func columnToSamples(values [][]interface{}, column int) ([]prompb.Sample, error) {
+	samples := make([]prompb.Sample, 0, len(values))
+	for _, v := range values {
+		if column >= len(v) || v[column] == nil {
+			continue
+		}
+		s, err := valuesToSamples([][]interface{}{{v[0], v[column]}})
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, s...)
+	}
+	return samples, nil
+}
+
+// newLabelsMatcher returns a function which reports whether labels match
+// all matchers. A missing label matches like an empty one.
+func newLabelsMatcher(matchers []*prompb.LabelMatcher) (func([]prompb.Label) bool, error) {
+	type matcher struct {
+		name  string
+		match func(string) bool
+	}
+	ms := make([]matcher, 0, len(matchers))
+	for _, m := range matchers {
+		value := m.Value
+		var match func(string) bool
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			match = func(v string) bool { return v == value }
+		case prompb.LabelMatcher_NEQ:
+			match = func(v string) bool { return v != value }
+		case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+			re, err := regexp.Compile("^(?:" + value + ")$")
+			if err != nil {
+				return nil, err
+			}
+			negate := m.Type == prompb.LabelMatcher_NRE
+			match = func(v string) bool { return re.MatchString(v) != negate }
+		default:
+			return nil, errors.Errorf("unknown match type %v", m.Type)
+		}
+		ms = append(ms, matcher{name: m.Name, match: match})
+	}
+	return func(labels []prompb.Label) bool {
+		for _, m := range ms {
+			var v string
+			for _, l := range labels {
+				if l.Name == m.name {
+					v = l.Value
+					break
+				}
+			}
+			if !m.match(v) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// WriteHistograms sends native histograms to InfluxDB as a single point
+// each, laid out like grouped classic histograms: a field per cumulative
+// bucket, plus the sum and count. Reading them back requires grouped
+// histograms.
+func (c *Client) WriteHistograms(histograms []histogram.Sample) error {
+	points, err := histogramPoints(c.logger, histograms, c.ignoredSamples)
+	if err != nil {
+		return err
+	}
+	return c.writePoints(points)
+}
+
+// histogramPoints converts native histograms into InfluxDB points. Fields
+// with values InfluxDB can't store are skipped and counted as ignored.
+func histogramPoints(logger log.Logger, histograms []histogram.Sample, ignored prometheus.Counter) ([]*influx.Point, error) {
+	points := make([]*influx.Point, 0, len(histograms))
+	for _, h := range histograms {
+		buckets, err := h.Histogram.ClassicBuckets()
+		if err != nil {
+			return nil, errors.Wrapf(err, "histogram %s", h.Metric)
+		}
+		fields := make(map[string]interface{}, len(buckets)+2)
+		add := func(field string, v float64) {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				level.Debug(logger).Log("msg", "Cannot send  to InfluxDB, skipping histogram field", "value", v, "field", field, "histogram", h.Metric)
+				ignored.Inc()
+				return
+			}
+			fields[field] = v
+		}
+		for _, b := range buckets {
+			add(fieldBucketPrefix+histogram.FormatBound(b.UpperBound), b.Count)
+		}
+		add(fieldSum, h.Histogram.Sum)
+		add(fieldCount, h.Histogram.Count)
+		if len(fields) == 0 {
+			continue
+		}
+
+		p, err := influx.NewPoint(
+			string(h.Metric[model.MetricNameLabel]),
+			tagsFromMetric(h.Metric),
+			fields,
+			h.Timestamp.Time(),
+		)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
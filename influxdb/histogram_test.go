@@ -0,0 +1,177 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	influx "github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"histogram"
+)
+
+func TestGroupedPoints(t *testing.T) {
+	samples := model.Samples{
+		{Metric: model.Metric{"__name__": "rpc_seconds_bucket", "job": "a", "le": "0.5"}, Timestamp: 1000, Value: 1},
+		{Metric: model.Metric{"__name__": "rpc_seconds_bucket", "job": "a", "le": "+Inf"}, Timestamp: 1000, Value: 2},
+		{Metric: model.Metric{"__name__": "rpc_seconds_sum", "job": "a"}, Timestamp: 1000, Value: 0.7},
+		{Metric: model.Metric{"__name__": "rpc_seconds_count", "job": "a"}, Timestamp: 1000, Value: 2},
+		// Different labels and timestamps go into separate points.
+		{Metric: model.Metric{"__name__": "rpc_seconds_count", "job": "b"}, Timestamp: 1000, Value: 3},
+		{Metric: model.Metric{"__name__": "rpc_seconds_count", "job": "a"}, Timestamp: 2000, Value: 4},
+		{Metric: model.Metric{"__name__": "gc_seconds", "quantile": "0.99"}, Timestamp: 1000, Value: 0.1},
+		{Metric: model.Metric{"__name__": "up", "job": "a"}, Timestamp: 1000, Value: 1},
+	}
+	points, err := groupedPoints(nil, samples, prometheus.NewCounter(prometheus.CounterOpts{Name: "ignored"}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var lines []string
+	for _, p := range points {
+		lines = append(lines, p.PrecisionString("ms"))
+	}
+	expected := []string{
+		`rpc_seconds,job=a count=2,le_+Inf=2,le_0.5=1,sum=0.7 1000`,
+		`rpc_seconds,job=b count=3 1000`,
+		`rpc_seconds,job=a count=4 2000`,
+		`gc_seconds quantile_0.99=0.1 1000`,
+		`up,job=a value=1 1000`,
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected points\n%v\ngot\n%v", expected, lines)
+	}
+}
+
+func TestHistogramPoints(t *testing.T) {
+	histograms := []histogram.Sample{
+		{
+			Metric:    model.Metric{"__name__": "rpc_seconds", "job": "a"},
+			Timestamp: 1000,
+			Histogram: &histogram.Histogram{
+				Schema:          0,
+				Count:           3,
+				Sum:             2.5,
+				PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+				PositiveBuckets: []float64{1, 2},
+			},
+		},
+		{
+			Metric:    model.Metric{"__name__": "rpc_seconds", "job": "b"},
+			Timestamp: 1000,
+			Histogram: &histogram.Histogram{Schema: 0, Count: 0, Sum: math.NaN()},
+		},
+	}
+	ignored := prometheus.NewCounter(prometheus.CounterOpts{Name: "ignored"})
+	points, err := histogramPoints(log.NewNopLogger(), histograms, ignored)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var lines []string
+	for _, p := range points {
+		lines = append(lines, p.PrecisionString("ms"))
+	}
+	expected := []string{
+		`rpc_seconds,job=a count=3,le_+Inf=3,le_0=0,le_1=1,le_2=3,sum=2.5 1000`,
+		`rpc_seconds,job=b count=0,le_+Inf=0,le_0=0 1000`,
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected points\n%v\ngot\n%v", expected, lines)
+	}
+}
+
+func TestBuildGroupedCommand(t *testing.T) {
+	c := &Client{retentionPolicy: "autogen"}
+	command, err := c.buildGroupedCommand(&prompb.Query{
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "rpc_seconds_bucket"},
+			{Type: prompb.LabelMatcher_EQ, Name: "le", Value: "0.5"},
+			{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "a"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := `SELECT * FROM "autogen"."rpc_seconds_bucket","autogen"."rpc_seconds" WHERE "job" = 'a' AND time >= 1000ms AND time <= 2000ms GROUP BY *`
+	if command != expected {
+		t.Errorf("Expected command\n%s\ngot\n%s", expected, command)
+	}
+}
+
+func TestMergeGroupedResult(t *testing.T) {
+	results := []influx.Result{{
+		Series: []models.Row{{
+			Name:    "rpc_seconds",
+			Tags:    map[string]string{"job": "a"},
+			Columns: []string{"time", "count", "le_+Inf", "le_0.5", "sum"},
+			Values: [][]interface{}{
+				{json.Number("1000"), json.Number("2"), json.Number("2"), json.Number("1"), json.Number("0.7")},
+				{json.Number("2000"), json.Number("4"), nil, nil, nil},
+			},
+		}},
+	}}
+
+	labelsToSeries := map[string]*prompb.TimeSeries{}
+	err := mergeGroupedResult(labelsToSeries, results, []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "rpc_seconds_(bucket|count)"},
+	}, &readLimiter{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	var series []*prompb.TimeSeries
+	for _, ts := range labelsToSeries {
+		sort.Slice(ts.Labels, func(i, j int) bool { return ts.Labels[i].Name < ts.Labels[j].Name })
+		series = append(series, ts)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return concatLabels(labelMap(series[i].Labels)) < concatLabels(labelMap(series[j].Labels))
+	})
+	expected := []*prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "rpc_seconds_bucket"}, {Name: "job", Value: "a"}, {Name: "le", Value: "+Inf"}},
+			Samples: []prompb.Sample{{Timestamp: 1000, Value: 2}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "rpc_seconds_bucket"}, {Name: "job", Value: "a"}, {Name: "le", Value: "0.5"}},
+			Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "rpc_seconds_count"}, {Name: "job", Value: "a"}},
+			Samples: []prompb.Sample{{Timestamp: 1000, Value: 2}, {Timestamp: 2000, Value: 4}},
+		},
+	}
+	if !reflect.DeepEqual(series, expected) {
+		t.Errorf("Expected %v, got %v", expected, series)
+	}
+}
+
+func labelMap(labels []prompb.Label) map[string]string {
+	m := make(map[string]string, len(labels))
+	for _, l := range labels {
+		m[l.Name] = l.Value
+	}
+	return m
+}
@@ -0,0 +1,116 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// ReadLimits limit the results of a single read request. A limit of 0
+// disables it.
+type ReadLimits struct {
+	// MaxSeries is the maximum number of series returned.
+	MaxSeries int
+	// MaxSamples is the maximum number of samples returned.
+	MaxSamples int
+	// MaxTimeRange is the maximum time range of each query.
+	MaxTimeRange time.Duration
+}
+
+// Names of the read limits, as reported by errors and in the limit label of
+// the rejected queries.
+const (
+	limitSeries    = "series"
+	limitSamples   = "samples"
+	limitTimeRange = "time_range"
+)
+
+// limitError is returned for reads exceeding a read limit.
+type limitError struct {
+	limit string
+	msg   string
+}
+
+func (e limitError) Error() string {
+	return e.msg
+}
+
+// ReadLimit returns the name of the exceeded limit. It marks errors of reads
+// which were rejected because of their size, rather than because of a
+// failure of InfluxDB.
+func (e limitError) ReadLimit() string {
+	return e.limit
+}
+
+// readLimiter counts the results of a read request against the limits. The
+// results are counted chunk by chunk as InfluxDB returns them, so that a read
+// is aborted once it exceeds a limit rather than after receiving all of its
+// results.
+type readLimiter struct {
+	limits  ReadLimits
+	series  int
+	samples int
+}
+
+// checkTimeRange returns an error if the time range of q exceeds the limit.
+func (l *readLimiter) checkTimeRange(q *prompb.Query) error {
+	if l.limits.MaxTimeRange <= 0 {
+		return nil
+	}
+	r := time.Duration(q.EndTimestampMs-q.StartTimestampMs) * time.Millisecond
+	if r <= l.limits.MaxTimeRange {
+		return nil
+	}
+	return limitError{
+		limit: limitTimeRange,
+		msg:   fmt.Sprintf("query time range of %s exceeds the limit of %s", model.Duration(r), model.Duration(l.limits.MaxTimeRange)),
+	}
+}
+
+// addSeries counts a series and returns an error if there are too many.
+func (l *readLimiter) addSeries() error {
+	l.series++
+	if l.limits.MaxSeries <= 0 || l.series <= l.limits.MaxSeries {
+		return nil
+	}
+	return limitError{
+		limit: limitSeries,
+		msg:   fmt.Sprintf("query returns more than the limit of %d series", l.limits.MaxSeries),
+	}
+}
+
+// addSamples counts n samples and returns an error if there are too many.
+func (l *readLimiter) addSamples(n int) error {
+	l.samples += n
+	if l.limits.MaxSamples <= 0 || l.samples <= l.limits.MaxSamples {
+		return nil
+	}
+	return limitError{
+		limit: limitSamples,
+		msg:   fmt.Sprintf("query returns more than the limit of %d samples", l.limits.MaxSamples),
+	}
+}
+
+// countRejected counts reads rejected because of err exceeding a limit.
+func (c *Client) countRejected(err error) error {
+	if le, ok := err.(limitError); ok {
+		c.rejectedQueries.WithLabelValues(le.limit).Inc()
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	influx "github.com/influxdata/influxdb/client/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestReadLimits(t *testing.T) {
+	// Two series with three samples in total.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Influxdb-Version", "1.8.10")
+		fmt.Fprintln(w, `{"results":[{"statement_id":0,"series":[{"name":"up","tags":{"job":"a"},"columns":["time","value"],"values":[[1000,1],[2000,1]]},{"name":"up","tags":{"job":"b"},"columns":["time","value"],"values":[[1000,0]]}]}]}`)
+	}))
+	defer server.Close()
+
+	query := &prompb.Query{
+		StartTimestampMs: 0,
+		EndTimestampMs:   3600000,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+	}
+	for _, tc := range []struct {
+		limits   ReadLimits
+		limit    string
+		expected string
+	}{
+		{limits: ReadLimits{MaxSeries: 2, MaxSamples: 3, MaxTimeRange: time.Hour}},
+		{
+			limits:   ReadLimits{MaxSeries: 1},
+			limit:    limitSeries,
+			expected: "query returns more than the limit of 1 series",
+		},
+		{
+			limits:   ReadLimits{MaxSamples: 2},
+			limit:    limitSamples,
+			expected: "query returns more than the limit of 2 samples",
+		},
+		{
+			limits:   ReadLimits{MaxTimeRange: 30 * time.Minute},
+			limit:    limitTimeRange,
+			expected: "query time range of 1h exceeds the limit of 30m",
+		},
+	} {
+		c := NewClient(nil, influx.HTTPConfig{Addr: server.URL, Timeout: time.Minute}, "test_db", "autogen", Options{ReadLimits: tc.limits})
+		req := &prompb.ReadRequest{Queries: []*prompb.Query{query}}
+		_, readErr := c.Read(req)
+		streamErr := c.ReadStream(req, func(int, *prompb.TimeSeries) error { return nil })
+
+		for _, err := range []error{readErr, streamErr} {
+			if tc.limit == "" {
+				if err != nil {
+					t.Errorf("Unexpected error for limits %+v: %s", tc.limits, err)
+				}
+				continue
+			}
+			le, ok := err.(limitError)
+			if !ok {
+				t.Errorf("Expected limit error for limits %+v, got %v", tc.limits, err)
+				continue
+			}
+			if le.ReadLimit() != tc.limit || le.Error() != tc.expected {
+				t.Errorf("Expected error %q for limit %s, got %q for limit %s", tc.expected, tc.limit, le.Error(), le.ReadLimit())
+			}
+		}
+		if tc.limit == "" {
+			continue
+		}
+		if got := testutil.ToFloat64(c.rejectedQueries.WithLabelValues(tc.limit)); got != 2 {
+			t.Errorf("Expected 2 rejected queries for limit %s, got %v", tc.limit, got)
+		}
+	}
+
+	// The limits apply to all queries of a request together.
+	c := NewClient(nil, influx.HTTPConfig{Addr: server.URL, Timeout: time.Minute}, "test_db", "autogen", Options{ReadLimits: ReadLimits{MaxSamples: 5}})
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{query, query}}
+	_, readErr := c.Read(req)
+	streamErr := c.ReadStream(req, func(int, *prompb.TimeSeries) error { return nil })
+	for _, err := range []error{readErr, streamErr} {
+		if le, ok := err.(limitError); !ok || le.ReadLimit() != limitSamples {
+			t.Errorf("Expected samples limit error for two queries, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	influx "github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// measurementsRefreshInterval is how long the list of measurements is used
+// before it is queried again. Measurements created in the meantime are only
+// selected by negative matchers on the metric name after the refresh.
+const measurementsRefreshInterval = time.Minute
+
+// errNoMeasurements is returned when building a command for a query which
+// can't select any measurement, so there is nothing to query.
+var errNoMeasurements = errors.New("no measurement matches the metric name")
+
+// measurementCache holds the measurements of the database, as returned by
+// SHOW MEASUREMENTS.
+type measurementCache struct {
+	mtx     sync.Mutex
+	names   []string
+	updated time.Time
+}
+
+// listMeasurements returns the measurements of the database, querying them
+// if the cached list is older than measurementsRefreshInterval. Concurrent
+// callers wait for a single query.
+func (c *Client) listMeasurements() ([]string, error) {
+	mc := &c.measurements
+	mc.mtx.Lock()
+	defer mc.mtx.Unlock()
+	if !mc.updated.IsZero() && time.Since(mc.updated) < measurementsRefreshInterval {
+		return mc.names, nil
+	}
+
+	resp, err := c.client.Query(influx.NewQuery("SHOW MEASUREMENTS", c.database, ""))
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.Error(); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, r := range resp.Results {
+		for _, s := range r.Series {
+			for _, v := range s.Values {
+				if len(v) == 0 {
+					continue
+				}
+				name, ok := v[0].(string)
+				if !ok {
+					return nil, errors.Errorf("invalid measurement name %v", v[0])
+				}
+				names = append(names, name)
+			}
+		}
+	}
+	mc.names = names
+	mc.updated = time.Now()
+	return names, nil
+}
+
+// matchingFrom returns a FROM clause listing the measurements whose names
+// match all of the matchers on the metric name. If one of them is an equal
+// matcher, only its measurement is checked against the others, otherwise the
+// measurements of the database are. It returns errNoMeasurements if there
+// are none.
+func (c *Client) matchingFrom(ms []*prompb.LabelMatcher) (string, error) {
+	var (
+		matches []func(string) bool
+		equal   *prompb.LabelMatcher
+	)
+	for _, m := range ms {
+		match, err := nameMatcher(m)
+		if err != nil {
+			return "", err
+		}
+		matches = append(matches, match)
+		if m.Type == prompb.LabelMatcher_EQ && equal == nil {
+			equal = m
+		}
+	}
+
+	var names []string
+	if equal != nil {
+		names = []string{equal.Value}
+	} else {
+		listed, err := c.listMeasurements()
+		if err != nil {
+			return "", errors.Wrap(err, "error listing measurements")
+		}
+		for _, name := range listed {
+			if name != exemplarMeasurement && name != metadataMeasurement {
+				names = append(names, name)
+			}
+		}
+	}
+	var measurements []string
+	for _, name := range names {
+		if matchesAll(matches, name) {
+			measurements = append(measurements, fmt.Sprintf("%q.%q", c.retentionPolicy, name))
+		}
+	}
+	if len(measurements) == 0 {
+		return "", errNoMeasurements
+	}
+	return "FROM " + strings.Join(measurements, ","), nil
+}
+
+// nameMatcher returns a function reporting whether a measurement name
+// matches a matcher on the metric name.
+func nameMatcher(m *prompb.LabelMatcher) (func(string) bool, error) {
+	value := m.Value
+	switch m.Type {
+	case prompb.LabelMatcher_EQ:
+		return func(name string) bool { return name == value }, nil
+	case prompb.LabelMatcher_NEQ:
+		return func(name string) bool { return name != value }, nil
+	case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		if m.Type == prompb.LabelMatcher_NRE {
+			return func(name string) bool { return !re.MatchString(name) }, nil
+		}
+		return re.MatchString, nil
+	}
+	return nil, errors.Errorf("unknown match type %v", m.Type)
+}
+
+func matchesAll(matches []func(string) bool, name string) bool {
+	for _, match := range matches {
+		if !match(name) {
+			return false
+		}
+	}
+	return true
+}
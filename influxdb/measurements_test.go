@@ -0,0 +1,200 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	influx "github.com/influxdata/influxdb/client/v2"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestBuildCommandExcludingMeasurements(t *testing.T) {
+	var shows, selects int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Influxdb-Version", "1.8.10")
+		switch q := r.FormValue("q"); q {
+		case "SHOW MEASUREMENTS":
+			shows++
+			fmt.Fprintln(w, `{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["go_goroutines"],["go_threads"],["prometheus_exemplars"],["prometheus_metadata"],["process_cpu_seconds_total"],["up"]]}]}]}`)
+		default:
+			selects++
+			fmt.Fprintln(w, `{"results":[{"statement_id":0}]}`)
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient(nil, influx.HTTPConfig{Addr: server.URL, Timeout: time.Minute}, "test_db", "autogen", Options{})
+	for _, tc := range []struct {
+		matchers []*prompb.LabelMatcher
+		expected string
+	}{
+		{
+			matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_NRE, Name: "__name__", Value: "go_.*"}},
+			expected: `SELECT value FROM "autogen"."process_cpu_seconds_total","autogen"."up" WHERE "job" = 'x' AND time >= 1000ms AND time <= 2000ms GROUP BY *`,
+		},
+		{
+			matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_NEQ, Name: "__name__", Value: "up"}},
+			expected: `SELECT value FROM "autogen"."go_goroutines","autogen"."go_threads","autogen"."process_cpu_seconds_total" WHERE "job" = 'x' AND time >= 1000ms AND time <= 2000ms GROUP BY *`,
+		},
+		{
+			// Only whole names are excluded.
+			matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_NRE, Name: "__name__", Value: "go_|up|process_.*"}},
+			expected: `SELECT value FROM "autogen"."go_goroutines","autogen"."go_threads" WHERE "job" = 'x' AND time >= 1000ms AND time <= 2000ms GROUP BY *`,
+		},
+		{
+			// All matchers on the metric name apply.
+			matchers: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "go_.*"},
+				{Type: prompb.LabelMatcher_NEQ, Name: "__name__", Value: "go_threads"},
+			},
+			expected: `SELECT value FROM "autogen"."go_goroutines" WHERE "job" = 'x' AND time >= 1000ms AND time <= 2000ms GROUP BY *`,
+		},
+		{
+			// The measurement of an equal matcher is checked against
+			// the others without listing measurements.
+			matchers: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_NRE, Name: "__name__", Value: "go_.*"},
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "node_load1"},
+			},
+			expected: `SELECT value FROM "autogen"."node_load1" WHERE "job" = 'x' AND time >= 1000ms AND time <= 2000ms GROUP BY *`,
+		},
+	} {
+		command, err := c.buildCommand(&prompb.Query{
+			StartTimestampMs: 1000,
+			EndTimestampMs:   2000,
+			Matchers:         append(tc.matchers, &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "x"}),
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if command != tc.expected {
+			t.Errorf("Expected command for %v:\n%s\ngot:\n%s", tc.matchers, tc.expected, command)
+		}
+	}
+	if shows != 1 {
+		t.Errorf("Expected measurements to be listed once, got %d", shows)
+	}
+
+	// Queries excluding all measurements aren't sent.
+	resp, err := c.Read(&prompb.ReadRequest{Queries: []*prompb.Query{{
+		Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_NRE, Name: "__name__", Value: ".+"}},
+	}}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if selects != 0 || len(resp.Results[0].Timeseries) != 0 {
+		t.Errorf("Expected no query and no series, got %d queries and %v", selects, resp)
+	}
+	err = c.ReadStream(&prompb.ReadRequest{Queries: []*prompb.Query{{
+		Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_NRE, Name: "__name__", Value: ".+"}},
+	}}}, func(int, *prompb.TimeSeries) error { return nil })
+	if err != nil || selects != 0 {
+		t.Errorf("Expected no query and no error, got %d queries and %v", selects, err)
+	}
+
+	// Contradicting matchers select no measurement.
+	_, err = c.buildCommand(&prompb.Query{Matchers: []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+		{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "go_.*"},
+	}})
+	if err != errNoMeasurements {
+		t.Errorf("Expected errNoMeasurements, got %v", err)
+	}
+
+	// The list is queried again once it is outdated.
+	c.measurements.updated = time.Now().Add(-measurementsRefreshInterval)
+	if _, err := c.buildCommand(&prompb.Query{
+		Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_NEQ, Name: "__name__", Value: "up"}},
+	}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if shows != 2 {
+		t.Errorf("Expected measurements to be listed again, got %d listings", shows)
+	}
+
+	if _, err := c.buildCommand(&prompb.Query{
+		Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_NRE, Name: "__name__", Value: "("}},
+	}); err == nil {
+		t.Error("Expected error for invalid regular expression, got none")
+	}
+}
+
+func TestReadMeasurementsWithSameTags(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Influxdb-Version", "1.8.10")
+		if r.FormValue("q") == "SHOW MEASUREMENTS" {
+			fmt.Fprintln(w, `{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["go_goroutines"],["process_cpu_seconds_total"],["up"]]}]}]}`)
+			return
+		}
+		fmt.Fprintln(w, `{"results":[{"statement_id":0,"series":[{"name":"process_cpu_seconds_total","tags":{"job":"x"},"columns":["time","value"],"values":[[1000,2]]},{"name":"up","tags":{"job":"x"},"columns":["time","value"],"values":[[1000,1]]}]}]}`)
+	}))
+	defer server.Close()
+
+	c := NewClient(nil, influx.HTTPConfig{Addr: server.URL, Timeout: time.Minute}, "test_db", "autogen", Options{})
+	resp, err := c.Read(&prompb.ReadRequest{Queries: []*prompb.Query{{
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_NRE, Name: "__name__", Value: "go_.*"},
+			{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "x"},
+		},
+	}}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// The series of both measurements are kept apart.
+	got := map[string][]prompb.Sample{}
+	for _, ts := range resp.Results[0].Timeseries {
+		for _, l := range ts.Labels {
+			if l.Name == "__name__" {
+				got[l.Value] = ts.Samples
+			}
+		}
+	}
+	expected := map[string][]prompb.Sample{
+		"process_cpu_seconds_total": {{Timestamp: 1000, Value: 2}},
+		"up":                        {{Timestamp: 1000, Value: 1}},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestListMeasurementsError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Influxdb-Version", "1.8.10")
+		fmt.Fprintln(w, `{"results":[{"statement_id":0,"error":"database not found: test_db"}]}`)
+	}))
+	defer server.Close()
+
+	c := NewClient(nil, influx.HTTPConfig{Addr: server.URL, Timeout: time.Minute}, "test_db", "autogen", Options{})
+	_, err := c.buildCommand(&prompb.Query{
+		Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_NEQ, Name: "__name__", Value: "up"}},
+	})
+	if err == nil || err.Error() != "error listing measurements: database not found: test_db" {
+		t.Errorf("Expected database error, got %v", err)
+	}
+	if !c.measurements.updated.IsZero() {
+		t.Error("Expected failed listing not to be cached")
+	}
+}
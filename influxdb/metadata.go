@@ -0,0 +1,64 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"time"
+
+	influx "github.com/influxdata/influxdb/client/v2"
+	"github.com/prometheus/common/model"
+
+	"metadata"
+)
+
+// The metadata of metric families is stored in a single measurement, with
+// the family name in the __name__ tag. All points have the same timestamp,
+// so that newer metadata of a family overwrites the older one:
+//
+//	prometheus_metadata,__name__=rpc_seconds type="histogram",help="RPC latency.",unit="seconds" 0
+const metadataMeasurement = "prometheus_metadata"
+
+// WriteMetadata sends the metadata of metric families to InfluxDB, if the
+// client was created with WriteMetadata.
+func (c *Client) WriteMetadata(families []metadata.Family) error {
+	if !c.writeMetadata {
+		return nil
+	}
+	points, err := metadataPoints(families)
+	if err != nil {
+		return err
+	}
+	return c.writePoints(points)
+}
+
+func metadataPoints(families []metadata.Family) ([]*influx.Point, error) {
+	points := make([]*influx.Point, 0, len(families))
+	for _, f := range families {
+		p, err := influx.NewPoint(
+			metadataMeasurement,
+			map[string]string{model.MetricNameLabel: f.Name},
+			map[string]interface{}{
+				"type": f.Type,
+				"help": f.Help,
+				"unit": f.Unit,
+			},
+			time.Unix(0, 0),
+		)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"reflect"
+	"testing"
+
+	"metadata"
+)
+
+func TestMetadataPoints(t *testing.T) {
+	points, err := metadataPoints([]metadata.Family{
+		{Name: "rpc_seconds", Metadata: metadata.Metadata{Type: "histogram", Help: `RPC "latency".`, Unit: "seconds"}},
+		{Name: "up", Metadata: metadata.Metadata{Type: "gauge"}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var lines []string
+	for _, p := range points {
+		lines = append(lines, p.PrecisionString("ms"))
+	}
+	expected := []string{
+		`prometheus_metadata,__name__=rpc_seconds help="RPC \"latency\".",type="histogram",unit="seconds" 0`,
+		`prometheus_metadata,__name__=up help="",type="gauge",unit="" 0`,
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected points\n%v\ngot\n%v", expected, lines)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"io"
+
+	influx "github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// readChunkSize is the number of points InfluxDB returns per chunk of a read
+// query.
+const readChunkSize = 10000
+
+// ReadStream runs the queries of a read request as chunked InfluxDB queries
+// and passes each series to send, along with the index of its query, once
+// all of its points arrived, in the order in which InfluxDB returns them.
+// Only a single series is held in memory at a time. The results of all
+// queries are counted against the limits of the request together.
+func (c *Client) ReadStream(req *prompb.ReadRequest, send func(int, *prompb.TimeSeries) error) error {
+	limiter := &readLimiter{limits: c.readLimits}
+	for i, q := range req.Queries {
+		sendQuery := func(ts *prompb.TimeSeries) error { return send(i, ts) }
+		if !c.groupHistograms {
+			if err := c.streamQuery(q, limiter, sendQuery); err != nil {
+				return err
+			}
+			continue
+		}
+		// A grouped series is spread over the fields of several InfluxDB
+		// series, so it is only complete once the whole result has been
+		// read.
+		labelsToSeries := map[string]*prompb.TimeSeries{}
+		if err := c.query(labelsToSeries, q, limiter); err != nil {
+			return err
+		}
+		for _, ts := range labelsToSeries {
+			if err := sendQuery(ts); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// streamQuery runs a query as a chunked InfluxDB query and passes each series
+// to send once all of its points arrived.
+func (c *Client) streamQuery(q *prompb.Query, limiter *readLimiter, send func(*prompb.TimeSeries) error) error {
+	if err := limiter.checkTimeRange(q); err != nil {
+		return c.countRejected(err)
+	}
+	command, err := c.buildCommand(q)
+	if err == errNoMeasurements {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	query := influx.NewQuery(command, c.database, "ms")
+	query.Chunked = true
+	query.ChunkSize = readChunkSize
+	cr, err := c.client.QueryAsChunk(query)
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+
+	// InfluxDB splits series across chunks, so a series is only sent
+	// once the next one starts.
+	var (
+		pending    *prompb.TimeSeries
+		pendingKey string
+	)
+	for {
+		resp, err := cr.NextResponse()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if resp.Err != "" {
+			return errors.New(resp.Err)
+		}
+		for _, r := range resp.Results {
+			if r.Err != "" {
+				return errors.New(r.Err)
+			}
+			for _, s := range r.Series {
+				if s.Name == exemplarMeasurement {
+					continue
+				}
+				if err := limiter.addSamples(len(s.Values)); err != nil {
+					return c.countRejected(err)
+				}
+				samples, err := valuesToSamples(s.Values)
+				if err != nil {
+					return err
+				}
+				k := s.Name + "\xff" + concatLabels(s.Tags)
+				if pending != nil && k == pendingKey {
+					pending.Samples = append(pending.Samples, samples...)
+					continue
+				}
+				if pending != nil {
+					if err := send(pending); err != nil {
+						return err
+					}
+				}
+				if err := limiter.addSeries(); err != nil {
+					return c.countRejected(err)
+				}
+				pending = &prompb.TimeSeries{
+					Labels:  tagsToLabelPairs(s.Name, s.Tags),
+					Samples: samples,
+				}
+				pendingKey = k
+			}
+		}
+	}
+	if pending != nil {
+		return send(pending)
+	}
+	return nil
+}
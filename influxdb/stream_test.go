@@ -0,0 +1,115 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	influx "github.com/influxdata/influxdb/client/v2"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestReadStream(t *testing.T) {
+	// The second series is split across two chunks.
+	chunks := []string{
+		`{"results":[{"statement_id":0,"series":[{"name":"up","tags":{"job":"a"},"columns":["time","value"],"values":[[1000,1]]},{"name":"up","tags":{"job":"b"},"columns":["time","value"],"values":[[1000,0]],"partial":true}],"partial":true}]}`,
+		`{"results":[{"statement_id":0,"series":[{"name":"up","tags":{"job":"b"},"columns":["time","value"],"values":[[2000,1]]}]}]}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/query" {
+			t.Fatalf("Unexpected path; expected /query, got %s", r.URL.Path)
+		}
+		if r.FormValue("chunked") != "true" || r.FormValue("chunk_size") != fmt.Sprint(readChunkSize) {
+			t.Errorf("Expected chunked query, got %s", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Influxdb-Version", "1.8.10")
+		for _, c := range chunks {
+			fmt.Fprintln(w, c)
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient(nil, influx.HTTPConfig{Addr: server.URL, Timeout: time.Minute}, "test_db", "autogen", Options{})
+	var got []*prompb.TimeSeries
+	err := c.ReadStream(&prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: 0,
+		EndTimestampMs:   3000,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+	}}}, func(i int, ts *prompb.TimeSeries) error {
+		if i != 0 {
+			t.Errorf("Expected series of query 0, got %d", i)
+		}
+		sort.Slice(ts.Labels, func(i, j int) bool { return ts.Labels[i].Name < ts.Labels[j].Name })
+		got = append(got, ts)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected := []*prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+			Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "b"}},
+			Samples: []prompb.Sample{{Timestamp: 1000, Value: 0}, {Timestamp: 2000, Value: 1}},
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	// Read merges the series split across chunks as well.
+	resp, err := c.Read(&prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: 0,
+		EndTimestampMs:   3000,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+	}}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	got = resp.Results[0].Timeseries
+	for _, ts := range got {
+		sort.Slice(ts.Labels, func(i, j int) bool { return ts.Labels[i].Name < ts.Labels[j].Name })
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].Labels[1].Value < got[j].Labels[1].Value })
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestReadStreamError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Influxdb-Version", "1.8.10")
+		fmt.Fprintln(w, `{"results":[{"statement_id":0,"error":"database not found: test_db"}]}`)
+	}))
+	defer server.Close()
+
+	c := NewClient(nil, influx.HTTPConfig{Addr: server.URL, Timeout: time.Minute}, "test_db", "autogen", Options{})
+	err := c.ReadStream(&prompb.ReadRequest{Queries: []*prompb.Query{{}}}, func(int, *prompb.TimeSeries) error { return nil })
+	if err == nil || err.Error() != "database not found: test_db" {
+		t.Errorf("Expected database error, got %v", err)
+	}
+}
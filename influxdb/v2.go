@@ -0,0 +1,254 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	writeEndpointV2 = "/api/v2/write"
+	queryEndpointV2 = "/api/v2/query"
+)
+
+// V2Config configures a V2Client.
+type V2Config struct {
+	URL     string
+	Org     string
+	Bucket  string
+	Token   string
+	Timeout time.Duration
+}
+
+// V2Client allows sending batches of Prometheus samples to InfluxDB 2.x,
+// and reading them back with Flux queries.
+type V2Client struct {
+	logger log.Logger
+
+	url            string
+	org            string
+	bucket         string
+	token          string
+	timeout        time.Duration
+	ignoredSamples prometheus.Counter
+}
+
+// NewV2Client creates a new V2Client.
+func NewV2Client(logger log.Logger, conf V2Config) *V2Client {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	return &V2Client{
+		logger:  logger,
+		url:     conf.URL,
+		org:     conf.Org,
+		bucket:  conf.Bucket,
+		token:   conf.Token,
+		timeout: conf.Timeout,
+		ignoredSamples: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "prometheus_influxdb_ignored_samples_total",
+				Help: "The total number of samples not sent to InfluxDB due to unsupported float values (Inf, -Inf, NaN).",
+			},
+		),
+	}
+}
+
+// Write sends a batch of samples to InfluxDB via its v2 write API.
+func (c *V2Client) Write(samples model.Samples) error {
+	points, err := samplesToPoints(c.logger, samples, c.ignoredSamples)
+	if err != nil {
+		return err
+	}
+	if len(points) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, p := range points {
+		buf.WriteString(p.PrecisionString("ms"))
+		buf.WriteByte('\n')
+	}
+
+	params := url.Values{}
+	params.Set("org", c.org)
+	params.Set("bucket", c.bucket)
+	params.Set("precision", "ms")
+	resp, err := c.post(writeEndpointV2, params, "text/plain; charset=utf-8", &buf)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	// API returns status code 204 for successful writes.
+	if resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	err = responseError(resp)
+	// Server errors are usually transient and InfluxDB responds with 429
+	// when it is overloaded, so the write may be retried.
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return recoverableError{err}
+	}
+	return err
+}
+
+// fluxQuery is the body of a request to the query endpoint.
+type fluxQuery struct {
+	Query   string      `json:"query"`
+	Dialect fluxDialect `json:"dialect"`
+}
+
+type fluxDialect struct {
+	Annotations []string `json:"annotations"`
+	Header      bool     `json:"header"`
+	Delimiter   string   `json:"delimiter"`
+}
+
+// Read queries InfluxDB with Flux for the series matching each query of the
+// request.
+func (c *V2Client) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	resp := &prompb.ReadResponse{
+		Results: make([]*prompb.QueryResult, 0, len(req.Queries)),
+	}
+	for _, q := range req.Queries {
+		ts, err := c.query(q)
+		if err != nil {
+			return nil, err
+		}
+		resp.Results = append(resp.Results, &prompb.QueryResult{Timeseries: ts})
+	}
+	return resp, nil
+}
+
+func (c *V2Client) query(q *prompb.Query) ([]*prompb.TimeSeries, error) {
+	query, err := buildFluxQuery(c.bucket, q)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(fluxQuery{
+		Query: query,
+		Dialect: fluxDialect{
+			Annotations: []string{"datatype", "group", "default"},
+			Header:      true,
+			Delimiter:   ",",
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Set("org", c.org)
+	resp, err := c.post(queryEndpointV2, params, "application/json", bytes.NewBuffer(buf))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	return parseFluxCSV(resp.Body)
+}
+
+// post sends a request to an endpoint of the InfluxDB API. The caller must
+// close the body of the response.
+func (c *V2Client) post(endpoint string, params url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = endpoint
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest("POST", u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Token "+c.token)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelReadCloser{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelReadCloser cancels the context of a request once its response body
+// is closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r cancelReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.cancel()
+	return err
+}
+
+// responseError returns an error for a failed request, including the
+// message InfluxDB responded with if there is one.
+func responseError(resp *http.Response) error {
+	var r struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil || r.Message == "" {
+		return errors.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	return errors.Errorf("server returned HTTP status %s: %s", resp.Status, r.Message)
+}
+
+// Name identifies the client as an InfluxDB client.
+func (c *V2Client) Name() string {
+	return "influxdb"
+}
+
+// Describe implements prometheus.Collector.
+func (c *V2Client) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.ignoredSamples.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (c *V2Client) Collect(ch chan<- prometheus.Metric) {
+	ch <- c.ignoredSamples
+}
@@ -0,0 +1,178 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestV2ClientWrite(t *testing.T) {
+	expectedBody := `testmetric,test_label=test_label_value1 value=1.23 123456789123
+testmetric,test_label=test_label_value2 value=5.1234 123456789123
+`
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != writeEndpointV2 {
+				t.Fatalf("Unexpected path %s", r.URL.Path)
+			}
+			q := r.URL.Query()
+			if q.Get("org") != "org" || q.Get("bucket") != "bucket" || q.Get("precision") != "ms" {
+				t.Fatalf("Unexpected query parameters %s", r.URL.RawQuery)
+			}
+			if auth := r.Header.Get("Authorization"); auth != "Token secret" {
+				t.Fatalf("Unexpected authorization header %q", auth)
+			}
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Fatalf("Error reading body: %s", err)
+			}
+			if string(b) != expectedBody {
+				t.Fatalf("Unexpected request body; expected:\n\n%s\n\ngot:\n\n%s", expectedBody, string(b))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		},
+	))
+	defer server.Close()
+
+	c := NewV2Client(nil, V2Config{
+		URL:     server.URL,
+		Org:     "org",
+		Bucket:  "bucket",
+		Token:   "secret",
+		Timeout: time.Minute,
+	})
+	err := c.Write(model.Samples{
+		{
+			Metric:    model.Metric{model.MetricNameLabel: "testmetric", "test_label": "test_label_value1"},
+			Timestamp: model.Time(123456789123),
+			Value:     1.23,
+		},
+		{
+			Metric:    model.Metric{model.MetricNameLabel: "testmetric", "test_label": "test_label_value2"},
+			Timestamp: model.Time(123456789123),
+			Value:     5.1234,
+		},
+		{
+			Metric:    model.Metric{model.MetricNameLabel: "nan_value"},
+			Timestamp: model.Time(123456789123),
+			Value:     model.SampleValue(math.NaN()),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error sending samples: %s", err)
+	}
+}
+
+func TestV2ClientWriteErrors(t *testing.T) {
+	tests := []struct {
+		status      int
+		recoverable bool
+	}{
+		{status: http.StatusBadRequest, recoverable: false},
+		{status: http.StatusUnauthorized, recoverable: false},
+		{status: http.StatusTooManyRequests, recoverable: true},
+		{status: http.StatusServiceUnavailable, recoverable: true},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(test.status)
+				w.Write([]byte(`{"code":"invalid","message":"something failed"}`))
+			},
+		))
+
+		c := NewV2Client(nil, V2Config{URL: server.URL, Timeout: time.Minute})
+		err := c.Write(model.Samples{{Metric: model.Metric{model.MetricNameLabel: "up"}, Value: 1}})
+		server.Close()
+		if err == nil {
+			t.Fatalf("Expected error for status %d, got none", test.status)
+		}
+		if !strings.Contains(err.Error(), "something failed") {
+			t.Errorf("Expected error to contain the message of the response, got %q", err)
+		}
+		_, ok := err.(recoverableError)
+		if ok != test.recoverable {
+			t.Errorf("Expected recoverable to be %v for status %d, got %v", test.recoverable, test.status, ok)
+		}
+	}
+}
+
+func TestV2ClientRead(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != queryEndpointV2 {
+				t.Fatalf("Unexpected path %s", r.URL.Path)
+			}
+			if org := r.URL.Query().Get("org"); org != "org" {
+				t.Fatalf("Unexpected org %q", org)
+			}
+			var q fluxQuery
+			if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+				t.Fatalf("Error decoding query: %s", err)
+			}
+			if !strings.HasPrefix(q.Query, `from(bucket: "bucket")`) {
+				t.Fatalf("Unexpected query %s", q.Query)
+			}
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Write([]byte(`#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,double,string,string,string
+#group,false,false,true,true,false,false,true,true,true
+#default,_result,,,,,,,,
+,result,table,_start,_stop,_time,_value,_field,_measurement,job
+,,0,1970-01-01T00:00:00Z,1970-01-01T00:01:00Z,1970-01-01T00:00:01Z,1,value,up,node
+`))
+		},
+	))
+	defer server.Close()
+
+	c := NewV2Client(nil, V2Config{URL: server.URL, Org: "org", Bucket: "bucket", Timeout: time.Minute})
+	resp, err := c.Read(&prompb.ReadRequest{
+		Queries: []*prompb.Query{{
+			StartTimestampMs: 0,
+			EndTimestampMs:   60000,
+			Matchers: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := &prompb.ReadResponse{
+		Results: []*prompb.QueryResult{{
+			Timeseries: []*prompb.TimeSeries{{
+				Labels: []prompb.Label{
+					{Name: "__name__", Value: "up"},
+					{Name: "job", Value: "node"},
+				},
+				Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}},
+			}},
+		}},
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Errorf("Expected %v, got %v", expected, resp)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+
+	influx "github.com/influxdata/influxdb/client/v2"
+	"github.com/pkg/errors"
+)
+
+// httpClient is an InfluxDB 1.x HTTP client which sends writes itself, as
+// the InfluxDB client doesn't expose the HTTP status of failed writes. Only
+// writes failing with a server error may be retried. Queries are left to the
+// InfluxDB client.
+type httpClient struct {
+	influx.Client
+
+	url       url.URL
+	username  string
+	password  string
+	userAgent string
+	transport *http.Transport
+	client    *http.Client
+}
+
+// newHTTPClient creates an httpClient configured the same way as the
+// InfluxDB client.
+func newHTTPClient(conf influx.HTTPConfig) (*httpClient, error) {
+	c, err := influx.NewHTTPClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(conf.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if conf.UserAgent == "" {
+		conf.UserAgent = "InfluxDBClient"
+	}
+
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: conf.InsecureSkipVerify,
+		},
+		Proxy:       conf.Proxy,
+		DialContext: conf.DialContext,
+	}
+	if conf.TLSConfig != nil {
+		tr.TLSClientConfig = conf.TLSConfig.Clone()
+		tr.TLSClientConfig.InsecureSkipVerify = conf.InsecureSkipVerify
+	}
+	return &httpClient{
+		Client:    c,
+		url:       *u,
+		username:  conf.Username,
+		password:  conf.Password,
+		userAgent: conf.UserAgent,
+		transport: tr,
+		client:    &http.Client{Timeout: conf.Timeout, Transport: tr},
+	}, nil
+}
+
+// Close releases the connections of both the writes and the InfluxDB client.
+func (c *httpClient) Close() error {
+	c.transport.CloseIdleConnections()
+	return c.Client.Close()
+}
+
+// Write sends a batch of points to the write endpoint of InfluxDB.
+func (c *httpClient) Write(bp influx.BatchPoints) error {
+	var buf bytes.Buffer
+	for _, p := range bp.Points() {
+		buf.WriteString(p.PrecisionString(bp.Precision()))
+		buf.WriteByte('\n')
+	}
+
+	u := c.url
+	u.Path = path.Join(u.Path, "write")
+	params := url.Values{}
+	params.Set("db", bp.Database())
+	params.Set("rp", bp.RetentionPolicy())
+	params.Set("precision", bp.Precision())
+	params.Set("consistency", bp.WriteConsistency())
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest("POST", u.String(), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "")
+	req.Header.Set("User-Agent", c.userAgent)
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	// Errors of the request itself are network errors or timeouts, which
+	// are recoverable.
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	err = writeResponseError(resp)
+	// InfluxDB responds with a client error to writes it will never
+	// accept, such as points with a conflicting field type. Server errors,
+	// including timeouts of the write, and throttled writes may succeed
+	// when retried.
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return recoverableError{err}
+	}
+	return err
+}
+
+// writeResponseError returns the error InfluxDB 1.x responded with to a
+// failed write.
+func writeResponseError(resp *http.Response) error {
+	var r struct {
+		Err string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil || r.Err == "" {
+		return errors.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	return errors.Errorf("server returned HTTP status %s: %s", resp.Status, r.Err)
+}
@@ -18,13 +18,16 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	_ "net/http/pprof"
-	"net/url"
+	"net/http/pprof"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/alecthomas/units"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/gogo/protobuf/proto"
@@ -35,46 +38,86 @@ import (
 	"github.com/prometheus/common/model"
 	"gopkg.in/alecthomas/kingpin.v2"
 
-	influx "github.com/influxdata/influxdb/client/v2"
-
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
 
 	"github.com/prometheus/prometheus/prompb"
-	"graphite"
-	"influxdb"
-	"opentsdb"
+
+	"exemplar"
+	"histogram"
+	"metadata"
+	"writev2"
 )
 
 type config struct {
+	configFile              string
 	graphiteAddress         string
 	graphiteTransport       string
 	graphitePrefix          string
+	graphiteFormat          string
+	graphiteWebURL          string
 	opentsdbURL             string
 	influxdbURL             string
 	influxdbRetentionPolicy string
 	influxdbUsername        string
 	influxdbDatabase        string
 	influxdbPassword        string
+	influxdbUDPPayloadSize  int
+	influxdbGroupHistograms bool
+	influxdbWriteMetadata   bool
+	influxdbPushDownHints   bool
+	influxdbMaxReadSeries   int
+	influxdbMaxReadSamples  int
+	influxdbMaxReadRange    time.Duration
+	influxdb2URL            string
+	influxdb2Org            string
+	influxdb2Bucket         string
+	influxdb2Token          string
 	remoteTimeout           time.Duration
 	listenAddr              string
 	telemetryPath           string
+	authConfigFile          string
+	webConfigFile           string
+	readPartialResponse     bool
+	readMaxBytesInFrame     int
+	readCacheMaxSize        units.Base2Bytes
+	readCacheBucketSize     time.Duration
+	readCacheMinAge         time.Duration
+	readCacheDir            string
+	readCacheMaxDiskSize    units.Base2Bytes
+	tenantHeader            string
+	tenantRequired          bool
+	tenantMaxActive         int
+	queueDir                string
+	queueMaxSize            units.Base2Bytes
+	queueSegmentSize        units.Base2Bytes
+	sendMaxRetries          int
+	sendMinBackoff          time.Duration
+	sendMaxBackoff          time.Duration
 	promlogConfig           promlog.Config
 }
 
 var (
-	receivedSamples = prometheus.NewCounter(
+	receivedSamples = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "received_samples_total",
 			Help: "Total number of received samples.",
 		},
+		[]string{"tenant"},
+	)
+	receivedHistograms = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "received_histograms_total",
+			Help: "Total number of received native histogram samples.",
+		},
+		[]string{"tenant"},
 	)
 	sentSamples = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "sent_samples_total",
 			Help: "Total number of processed samples sent to remote storage.",
 		},
-		[]string{"remote"},
+		[]string{"remote", "tenant"},
 	)
 	failedSamples = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -91,23 +134,131 @@ var (
 		},
 		[]string{"remote"},
 	)
+	retriedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "retried_samples_total",
+			Help: "Total number of processed samples which failed on send to remote storage and were retried.",
+		},
+		[]string{"remote"},
+	)
+	droppedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dropped_samples_total",
+			Help: "Total number of received samples dropped by the write relabeling of the remote storage.",
+		},
+		[]string{"remote"},
+	)
+	invalidHistograms = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "invalid_histograms_total",
+			Help: "Total number of received native histograms dropped because they couldn't be converted.",
+		},
+	)
+	configSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful.",
+		},
+	)
+	configSuccessTime = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload.",
+		},
+	)
+	failedReads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "failed_reads_total",
+			Help: "Total number of read requests which failed on the remote storage.",
+		},
+		[]string{"remote"},
+	)
+	rejectedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rejected_requests_total",
+			Help: "Total number of HTTP requests rejected because they failed to authenticate.",
+		},
+		[]string{"endpoint", "reason"},
+	)
+	readCacheHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "read_cache_hits_total",
+			Help: "Total number of time buckets of read queries answered from the read cache.",
+		},
+		[]string{"store"},
+	)
+	readCacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "read_cache_misses_total",
+			Help: "Total number of complete time buckets of read queries which weren't in the read cache.",
+		},
+	)
+	readCacheSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "read_cache_size_bytes",
+			Help: "Size of the read results held by the read cache.",
+		},
+		[]string{"store"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(receivedSamples)
+	prometheus.MustRegister(receivedHistograms)
 	prometheus.MustRegister(sentSamples)
 	prometheus.MustRegister(failedSamples)
 	prometheus.MustRegister(sentBatchDuration)
+	prometheus.MustRegister(failedReads)
+	prometheus.MustRegister(retriedSamples)
+	prometheus.MustRegister(droppedSamples)
+	prometheus.MustRegister(invalidHistograms)
+	prometheus.MustRegister(configSuccess)
+	prometheus.MustRegister(configSuccessTime)
+	prometheus.MustRegister(rejectedRequests)
+	prometheus.MustRegister(readCacheHits)
+	prometheus.MustRegister(readCacheMisses)
+	prometheus.MustRegister(readCacheSize)
 }
 
 func main() {
 	cfg := parseFlags()
-	http.Handle(cfg.telemetryPath, promhttp.Handler())
 
 	logger := promlog.New(&cfg.promlogConfig)
 
-	writers, readers := buildClients(logger, cfg)
-	if err := serve(logger, cfg.listenAddr, writers, readers); err != nil {
+	var cache *readCache
+	if cfg.readCacheMaxSize > 0 || cfg.readCacheDir != "" {
+		var err error
+		cache, err = newReadCache(
+			log.With(logger, "component", "read cache"),
+			cfg.readCacheBucketSize, cfg.readCacheMinAge,
+			int64(cfg.readCacheMaxSize), cfg.readCacheDir, int64(cfg.readCacheMaxDiskSize),
+		)
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to open read cache", "err", err)
+			os.Exit(1)
+		}
+	}
+	s := newStorages(logger, cfg, cache)
+	if err := s.reload(); err != nil {
+		level.Error(logger).Log("msg", "Failed to load configuration", "file", cfg.configFile, "err", err)
+		os.Exit(1)
+	}
+	auth := newAuthenticator(cfg.authConfigFile)
+	if err := auth.reload(); err != nil {
+		level.Error(logger).Log("msg", "Failed to load authentication configuration", "file", cfg.authConfigFile, "err", err)
+		os.Exit(1)
+	}
+	level.Info(logger).Log("msg", "Starting up...")
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadConfig(logger, s, auth)
+		}
+	}()
+
+	if err := serve(logger, cfg, s, auth); err != nil {
 		level.Error(logger).Log("msg", "Failed to listen", "addr", cfg.listenAddr, "err", err)
 		os.Exit(1)
 	}
@@ -119,18 +270,25 @@ func parseFlags() *config {
 
 	cfg := &config{
 		influxdbPassword: os.Getenv("INFLUXDB_PW"),
+		influxdb2Token:   os.Getenv("INFLUXDB2_TOKEN"),
 		promlogConfig:    promlog.Config{},
 	}
 
+	a.Flag("config.file", "Configuration file declaring the remote storages. Replaces the Graphite, OpenTSDB and InfluxDB flags, which are a shorthand for a single remote storage of each type.").
+		Default("").StringVar(&cfg.configFile)
 	a.Flag("graphite-address", "The host:port of the Graphite server to send samples to. None, if empty.").
 		Default("").StringVar(&cfg.graphiteAddress)
-	a.Flag("graphite-transport", "Transport protocol to use to communicate with Graphite. 'tcp', if empty.").
+	a.Flag("graphite-transport", "Transport protocol to use to communicate with Graphite. 'tcp' and 'udp' use the plaintext protocol, 'pickle' sends samples to the pickle receiver of Carbon over TCP. 'tcp', if empty.").
 		Default("tcp").StringVar(&cfg.graphiteTransport)
 	a.Flag("graphite-prefix", "The prefix to prepend to all metrics exported to Graphite. None, if empty.").
 		Default("").StringVar(&cfg.graphitePrefix)
+	a.Flag("graphite-format", "Format of the metrics sent to Graphite. 'path' encodes labels into the metric path, 'tagged' sends them as tags, which requires Graphite 1.1 or later.").
+		Default("path").EnumVar(&cfg.graphiteFormat, "path", "tagged")
+	a.Flag("graphite-web-url", "The URL of the Graphite web API to read samples back from. Graphite is write-only, if empty.").
+		Default("").StringVar(&cfg.graphiteWebURL)
 	a.Flag("opentsdb-url", "The URL of the remote OpenTSDB server to send samples to. None, if empty.").
 		Default("").StringVar(&cfg.opentsdbURL)
-	a.Flag("influxdb-url", "The URL of the remote InfluxDB server to send samples to. None, if empty.").
+	a.Flag("influxdb-url", "The URL of the remote InfluxDB server to send samples to. A udp:// URL sends samples to the UDP listener of InfluxDB, which is write-only. None, if empty.").
 		Default("").StringVar(&cfg.influxdbURL)
 	a.Flag("influxdb.retention-policy", "The InfluxDB retention policy to use.").
 		Default("autogen").StringVar(&cfg.influxdbRetentionPolicy)
@@ -138,12 +296,68 @@ func parseFlags() *config {
 		Default("").StringVar(&cfg.influxdbUsername)
 	a.Flag("influxdb.database", "The name of the database to use for storing samples in InfluxDB.").
 		Default("prometheus").StringVar(&cfg.influxdbDatabase)
+	a.Flag("influxdb.udp-payload-size", "Maximum size of the UDP packets sent to InfluxDB. 512 bytes, if 0.").
+		Default("0").IntVar(&cfg.influxdbUDPPayloadSize)
+	a.Flag("influxdb.group-histograms", "Store the series of a histogram or summary as fields of a single InfluxDB measurement, with a field per bucket or quantile plus sum and count.").
+		Default("false").BoolVar(&cfg.influxdbGroupHistograms)
+	a.Flag("influxdb.write-metadata", "Store the metadata of metric families received by remote write in the prometheus_metadata measurement of InfluxDB.").
+		Default("false").BoolVar(&cfg.influxdbWriteMetadata)
+	a.Flag("influxdb.push-down-read-hints", "Downsample the results of read requests in InfluxDB, with one point per step, for the range functions whose result doesn't change by it: max_over_time, min_over_time, sum_over_time and last_over_time.").
+		Default("false").BoolVar(&cfg.influxdbPushDownHints)
+	a.Flag("influxdb.max-read-series", "The maximum number of series returned by InfluxDB for a read request. Unlimited, if 0.").
+		Default("0").IntVar(&cfg.influxdbMaxReadSeries)
+	a.Flag("influxdb.max-read-samples", "The maximum number of samples returned by InfluxDB for a read request. Unlimited, if 0.").
+		Default("0").IntVar(&cfg.influxdbMaxReadSamples)
+	a.Flag("influxdb.max-read-time-range", "The maximum time range of the queries of a read request sent to InfluxDB. Unlimited, if 0.").
+		Default("0s").DurationVar(&cfg.influxdbMaxReadRange)
+	a.Flag("influxdb2-url", "The URL of the remote InfluxDB 2.x server to send samples to. The API token must be provided via the INFLUXDB2_TOKEN environment variable. None, if empty.").
+		Default("").StringVar(&cfg.influxdb2URL)
+	a.Flag("influxdb2.org", "The organization to use in InfluxDB 2.x.").
+		Default("").StringVar(&cfg.influxdb2Org)
+	a.Flag("influxdb2.bucket", "The name of the bucket to use for storing samples in InfluxDB 2.x.").
+		Default("prometheus").StringVar(&cfg.influxdb2Bucket)
 	a.Flag("send-timeout", "The timeout to use when sending samples to the remote storage.").
 		Default("30s").DurationVar(&cfg.remoteTimeout)
+	a.Flag("send-retries", "Number of times to retry sending samples which failed with a recoverable error before giving up. Queued samples are retried until they succeed.").
+		Default("3").IntVar(&cfg.sendMaxRetries)
+	a.Flag("send-min-backoff", "Initial time to wait before retrying to send samples. It is doubled on every retry.").
+		Default("100ms").DurationVar(&cfg.sendMinBackoff)
+	a.Flag("send-max-backoff", "Maximum time to wait before retrying to send samples.").
+		Default("5s").DurationVar(&cfg.sendMaxBackoff)
 	a.Flag("web.listen-address", "Address to listen on for web endpoints.").
 		Default(":9201").StringVar(&cfg.listenAddr)
 	a.Flag("web.telemetry-path", "Address to listen on for web endpoints.").
 		Default("/metrics").StringVar(&cfg.telemetryPath)
+	a.Flag("web.config.file", "Web configuration file enabling TLS, in the format of the Prometheus exporter toolkit. Certificates are read again when they change. HTTP is served in plaintext, if empty.").
+		Default("").StringVar(&cfg.webConfigFile)
+	a.Flag("web.auth-config", "Configuration file declaring how requests to the write, read, telemetry and admin endpoints authenticate. All endpoints are open, if empty.").
+		Default("").StringVar(&cfg.authConfigFile)
+	a.Flag("read.partial-response", "Return the results of the readers that succeeded when some readers fail, instead of failing the whole read request.").
+		Default("false").BoolVar(&cfg.readPartialResponse)
+	a.Flag("read.max-bytes-per-frame", "Maximum size of the frames of streamed read responses, which are sent to clients accepting STREAMED_XOR_CHUNKS. A frame holds at least one chunk of 120 samples, which may exceed it.").
+		Default("1048576").IntVar(&cfg.readMaxBytesInFrame)
+	a.Flag("read.cache.max-size", "Maximum size of the read results cached in memory. Results are only cached in memory, if --read.cache.dir is empty, and not at all if both are unset.").
+		Default("0").BytesVar(&cfg.readCacheMaxSize)
+	a.Flag("read.cache.bucket-size", "Size of the time buckets whose read results are cached.").
+		Default("1h").DurationVar(&cfg.readCacheBucketSize)
+	a.Flag("read.cache.min-age", "Time after the end of a time bucket after which its read results are cached. It must cover the delay with which samples arrive in the remote storage. Results aren't cached while samples for the remote storage are queued on disk, as they may be older.").
+		Default("10m").DurationVar(&cfg.readCacheMinAge)
+	a.Flag("read.cache.dir", "Directory in which to cache read results on disk, in addition to memory. Read results aren't cached on disk, if empty.").
+		Default("").StringVar(&cfg.readCacheDir)
+	a.Flag("read.cache.max-disk-size", "Maximum size of the read results cached on disk.").
+		Default("10GB").BytesVar(&cfg.readCacheMaxDiskSize)
+	a.Flag("tenant.header", "HTTP header holding the tenant of write and read requests, like X-Scope-OrgID. The data of each tenant is stored in its own InfluxDB database, InfluxDB 2.x bucket and under its own Graphite prefix, and tagged with the tenant in OpenTSDB. Multi-tenancy is disabled, if empty.").
+		Default("").StringVar(&cfg.tenantHeader)
+	a.Flag("tenant.required", "Reject requests without a tenant, instead of using the storages of requests without a tenant.").
+		Default("false").BoolVar(&cfg.tenantRequired)
+	a.Flag("tenant.max-active", "Maximum number of tenants whose remote storages are kept open. The storages of the least recently seen tenant are closed to make room for another tenant, and created again when it is seen again. 0 means no limit.").
+		Default("100").IntVar(&cfg.tenantMaxActive)
+	a.Flag("queue.dir", "Directory in which to queue samples on disk until they were sent to the remote storage. Samples are sent synchronously, if empty.").
+		Default("").StringVar(&cfg.queueDir)
+	a.Flag("queue.max-size", "Maximum size of the on-disk queue of each remote storage and tenant.").
+		Default("1GB").BytesVar(&cfg.queueMaxSize)
+	a.Flag("queue.segment-size", "Size of the segment files of the on-disk queues.").
+		Default("64MB").BytesVar(&cfg.queueSegmentSize)
 
 	flag.AddFlags(a, &cfg.promlogConfig)
 
@@ -153,6 +367,21 @@ func parseFlags() *config {
 		a.Usage(os.Args[1:])
 		os.Exit(2)
 	}
+	if cfg.configFile != "" && (cfg.graphiteAddress != "" || cfg.opentsdbURL != "" || cfg.influxdbURL != "" || cfg.influxdb2URL != "") {
+		fmt.Fprintln(os.Stderr, "The Graphite, OpenTSDB and InfluxDB flags cannot be used together with --config.file")
+		a.Usage(os.Args[1:])
+		os.Exit(2)
+	}
+	if cfg.influxdb2URL != "" && cfg.influxdb2Org == "" {
+		fmt.Fprintln(os.Stderr, "--influxdb2.org is required with --influxdb2-url")
+		a.Usage(os.Args[1:])
+		os.Exit(2)
+	}
+	if cfg.tenantRequired && cfg.tenantHeader == "" {
+		fmt.Fprintln(os.Stderr, "--tenant.required requires --tenant.header")
+		a.Usage(os.Args[1:])
+		os.Exit(2)
+	}
 
 	return cfg
 }
@@ -162,57 +391,91 @@ type writer interface {
 	Name() string
 }
 
+// histogramWriter is implemented by writers which store native histograms
+// in their own format. Native histograms are written to other writers as
+// classic histograms.
+type histogramWriter interface {
+	WriteHistograms(histograms []histogram.Sample) error
+}
+
+// metadataWriter is implemented by writers which store the metadata of
+// metric families.
+type metadataWriter interface {
+	WriteMetadata(families []metadata.Family) error
+}
+
+// exemplarWriter is implemented by writers which store exemplars. Other
+// writers drop them.
+type exemplarWriter interface {
+	WriteExemplars(series []exemplar.Series) error
+}
+
 type reader interface {
 	Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error)
 	Name() string
 }
 
-func buildClients(logger log.Logger, cfg *config) ([]writer, []reader) {
-	var writers []writer
-	var readers []reader
-	if cfg.graphiteAddress != "" {
-		c := graphite.NewClient(
-			log.With(logger, "storage", "Graphite"),
-			cfg.graphiteAddress, cfg.graphiteTransport,
-			cfg.remoteTimeout, cfg.graphitePrefix)
-		writers = append(writers, c)
+// streamReader is implemented by readers which return the series of the
+// queries of a read request one by one as they arrive, instead of all at
+// once. Each series is passed to send along with the index of its query.
+type streamReader interface {
+	ReadStream(req *prompb.ReadRequest, send func(int, *prompb.TimeSeries) error) error
+}
+
+// exemplarReader is implemented by readers which return stored exemplars.
+type exemplarReader interface {
+	ReadExemplars(q *prompb.Query) ([]exemplar.Series, error)
+}
+
+func reloadConfig(logger log.Logger, s *storages, auth *authenticator) error {
+	if err := s.reload(); err != nil {
+		level.Error(logger).Log("msg", "Failed to reload configuration", "file", s.cfg.configFile, "err", err)
+		return err
 	}
-	if cfg.opentsdbURL != "" {
-		c := opentsdb.NewClient(
-			log.With(logger, "storage", "OpenTSDB"),
-			cfg.opentsdbURL,
-			cfg.remoteTimeout,
-		)
-		writers = append(writers, c)
+	if err := auth.reload(); err != nil {
+		level.Error(logger).Log("msg", "Failed to reload authentication configuration", "file", auth.filename, "err", err)
+		return err
 	}
-	if cfg.influxdbURL != "" {
-		url, err := url.Parse(cfg.influxdbURL)
+	level.Info(logger).Log("msg", "Reloaded configuration", "file", s.cfg.configFile)
+	return nil
+}
+
+func serve(logger log.Logger, cfg *config, s *storages, auth *authenticator) error {
+	// The handlers are registered on their own mux, as importing pprof
+	// registers unauthenticated handlers on the default one.
+	mux := http.NewServeMux()
+	mux.Handle(cfg.telemetryPath, auth.protect(endpointTelemetry, promhttp.Handler()))
+	mux.Handle("/debug/pprof/", auth.protect(endpointAdmin, http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", auth.protect(endpointAdmin, http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", auth.protect(endpointAdmin, http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", auth.protect(endpointAdmin, http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", auth.protect(endpointAdmin, http.HandlerFunc(pprof.Trace)))
+	mux.Handle("/-/reload", auth.protect(endpointAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reloadConfig(logger, s, auth); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})))
+
+	metadataCaches := newMetadataCaches(cfg.tenantMaxActive)
+
+	mux.Handle("/write", auth.protect(endpointWrite, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := requestTenant(r, cfg)
 		if err != nil {
-			level.Error(logger).Log("msg", "Failed to parse InfluxDB URL", "url", cfg.influxdbURL, "err", err)
-			os.Exit(1)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		conf := influx.HTTPConfig{
-			Addr:     url.String(),
-			Username: cfg.influxdbUsername,
-			Password: cfg.influxdbPassword,
-			Timeout:  cfg.remoteTimeout,
+
+		msg, err := writeProto(r)
+		if err != nil {
+			level.Error(logger).Log("msg", "Unsupported write request", "err", err.Error())
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
 		}
-		c := influxdb.NewClient(
-			log.With(logger, "storage", "InfluxDB"),
-			conf,
-			cfg.influxdbDatabase,
-			cfg.influxdbRetentionPolicy,
-		)
-		prometheus.MustRegister(c)
-		writers = append(writers, c)
-		readers = append(readers, c)
-	}
-	level.Info(logger).Log("msg", "Starting up...")
-	return writers, readers
-}
 
-func serve(logger log.Logger, addr string, writers []writer, readers []reader) error {
-	http.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
 		compressed, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			level.Error(logger).Log("msg", "Read error", "err", err.Error())
@@ -227,28 +490,89 @@ func serve(logger log.Logger, addr string, writers []writer, readers []reader) e
 			return
 		}
 
-		var req prompb.WriteRequest
-		if err := proto.Unmarshal(reqBuf, &req); err != nil {
+		req, err := decodeWriteRequest(msg, reqBuf)
+		if err != nil {
 			level.Error(logger).Log("msg", "Unmarshal error", "err", err.Error())
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		receivedSamples.WithLabelValues(tenant).Add(float64(len(req.samples)))
+		receivedHistograms.WithLabelValues(tenant).Add(float64(len(req.histograms)))
+		req.histograms = validHistograms(logger, req.histograms)
+		metadataCaches.get(tenant).Update(req.metadata)
 
-		samples := protoToSamples(&req)
-		receivedSamples.Add(float64(len(samples)))
-
+		set, err := s.forTenant(tenant)
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to get remote storages", "tenant", tenant, "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer set.release()
+		writers := set.writers
+		errs := make([]error, len(writers))
+		exemplarsStored := make([]bool, len(writers))
 		var wg sync.WaitGroup
-		for _, w := range writers {
+		for i, w := range writers {
 			wg.Add(1)
-			go func(rw writer) {
-				sendSamples(logger, rw, samples)
-				wg.Done()
-			}(w)
+			go func(i int, rw writer) {
+				defer wg.Done()
+				if qw, ok := rw.(*queuedWriter); ok {
+					// The queue only holds float samples, so histograms
+					// are queued as classic histograms while exemplars
+					// and metadata are written right away. They are
+					// written first, so that a failure doesn't make
+					// Prometheus resend samples which were queued.
+					exemplarsStored[i], errs[i] = sendExemplars(logger, qw.writer, req.exemplars)
+					if errs[i] == nil {
+						errs[i] = sendMetadata(logger, qw.writer, req.metadata)
+					}
+					if errs[i] == nil {
+						errs[i] = enqueueSamples(logger, qw, withClassicHistograms(req.samples, req.histograms))
+					}
+					return
+				}
+				errs[i] = sendSamplesWithRetry(logger, cfg, histogramSender{writer: rw, histograms: req.histograms}, tenant, req.samples)
+				if errs[i] == nil {
+					exemplarsStored[i], errs[i] = sendExemplars(logger, rw, req.exemplars)
+				}
+				if errs[i] == nil {
+					errs[i] = sendMetadata(logger, rw, req.metadata)
+				}
+			}(i, w)
 		}
 		wg.Wait()
-	})
 
-	http.HandleFunc("/read", func(w http.ResponseWriter, r *http.Request) {
+		// Let Prometheus retry the request if any writer might still
+		// succeed, and make it drop the samples if none of them will.
+		code, err := writeError(errs)
+		if msg == writev2.ContentType {
+			// Samples count as written once all writers succeeded,
+			// exemplars if any of them stores exemplars.
+			var written writeStats
+			if err == nil {
+				written.samples = len(req.samples)
+				written.histograms = len(req.histograms)
+				for _, stored := range exemplarsStored {
+					if stored {
+						written.exemplars = countExemplars(req.exemplars)
+						break
+					}
+				}
+			}
+			setWrittenHeaders(w.Header(), written)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), code)
+		}
+	})))
+
+	mux.Handle("/read", auth.protect(endpointRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := requestTenant(r, cfg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		compressed, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			level.Error(logger).Log("msg", "Read error", "err", err.Error())
@@ -270,18 +594,34 @@ func serve(logger log.Logger, addr string, writers []writer, readers []reader) e
 			return
 		}
 
-		// TODO: Support reading from more than one reader and merging the results.
-		if len(readers) != 1 {
-			http.Error(w, fmt.Sprintf("expected exactly one reader, found %d readers", len(readers)), http.StatusInternalServerError)
+		set, err := s.forTenant(tenant)
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to get remote storages", "tenant", tenant, "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer set.release()
+		readers := set.readers
+
+		if acceptsStreamedChunks(&req) {
+			if err := streamRead(logger, w, readers, &req, cfg.readPartialResponse, cfg.readMaxBytesInFrame); err != nil {
+				level.Warn(logger).Log("msg", "Error executing streamed query", "query", req, "err", err)
+				if _, ok := err.(interruptedStreamError); ok {
+					// Once frames were written, the error can only
+					// cut the stream short. Aborting the response
+					// makes it fail on the client rather than end
+					// like a complete one.
+					panic(http.ErrAbortHandler)
+				}
+				http.Error(w, err.Error(), readErrorStatus(err))
+			}
 			return
 		}
-		reader := readers[0]
 
-		var resp *prompb.ReadResponse
-		resp, err = reader.Read(&req)
+		resp, err := readAll(logger, readers, &req, cfg.readPartialResponse)
 		if err != nil {
-			level.Warn(logger).Log("msg", "Error executing query", "query", req, "storage", reader.Name(), "err", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			level.Warn(logger).Log("msg", "Error executing query", "query", req, "err", err)
+			http.Error(w, err.Error(), readErrorStatus(err))
 			return
 		}
 
@@ -296,40 +636,52 @@ func serve(logger log.Logger, addr string, writers []writer, readers []reader) e
 
 		compressed = snappy.Encode(nil, data)
 		if _, err := w.Write(compressed); err != nil {
-			level.Warn(logger).Log("msg", "Error writing response", "storage", reader.Name(), "err", err)
+			level.Warn(logger).Log("msg", "Error writing response", "err", err)
 		}
-	})
+	})))
 
-	return http.ListenAndServe(addr, nil)
-}
+	mux.Handle("/api/v1/query_exemplars", auth.protect(endpointRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := requestTenant(r, cfg)
+		if err != nil {
+			respondError(logger, w, http.StatusBadRequest, errorBadData, err)
+			return
+		}
+		q, err := exemplarQuery(r, time.Now())
+		if err != nil {
+			respondError(logger, w, http.StatusBadRequest, errorBadData, err)
+			return
+		}
 
-func protoToSamples(req *prompb.WriteRequest) model.Samples {
-	var samples model.Samples
-	for _, ts := range req.Timeseries {
-		metric := make(model.Metric, len(ts.Labels))
-		for _, l := range ts.Labels {
-			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		set, err := s.forTenant(tenant)
+		if err != nil {
+			respondError(logger, w, http.StatusInternalServerError, errorInternal, err)
+			return
+		}
+		defer set.release()
+		series, err := queryExemplars(logger, set.readers, q, cfg.readPartialResponse)
+		if err != nil {
+			level.Warn(logger).Log("msg", "Error querying exemplars", "query", r.FormValue("query"), "err", err)
+			respondError(logger, w, http.StatusInternalServerError, errorInternal, err)
+			return
 		}
+		respond(logger, w, series)
+	})))
 
-		for _, s := range ts.Samples {
-			samples = append(samples, &model.Sample{
-				Metric:    metric,
-				Value:     model.SampleValue(s.Value),
-				Timestamp: model.Time(s.Timestamp),
-			})
+	mux.Handle("/api/v1/metadata", auth.protect(endpointRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := requestTenant(r, cfg)
+		if err != nil {
+			respondError(logger, w, http.StatusBadRequest, errorBadData, err)
+			return
 		}
-	}
-	return samples
-}
+		limit := -1
+		if v := r.FormValue("limit"); v != "" {
+			if limit, err = strconv.Atoi(v); err != nil {
+				respondError(logger, w, http.StatusBadRequest, errorBadData, errors.New("limit must be a number"))
+				return
+			}
+		}
+		respond(logger, w, metadataCaches.get(tenant).Get(r.FormValue("metric"), limit))
+	})))
 
-func sendSamples(logger log.Logger, w writer, samples model.Samples) {
-	begin := time.Now()
-	err := w.Write(samples)
-	duration := time.Since(begin).Seconds()
-	if err != nil {
-		level.Warn(logger).Log("msg", "Error sending samples to remote storage", "err", err, "storage", w.Name(), "num_samples", len(samples))
-		failedSamples.WithLabelValues(w.Name()).Add(float64(len(samples)))
-	}
-	sentSamples.WithLabelValues(w.Name()).Add(float64(len(samples)))
-	sentBatchDuration.WithLabelValues(w.Name()).Observe(duration)
+	return listenAndServe(logger, cfg, mux)
 }
@@ -0,0 +1,101 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metadata holds the metadata of metric families received by remote
+// write, as returned by the metadata API of Prometheus.
+package metadata
+
+import (
+	"sort"
+	"sync"
+)
+
+// Metadata describes a metric family. It marshals to the JSON of the
+// /api/v1/metadata endpoint of Prometheus.
+type Metadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// Family is the metadata of a named metric family.
+type Family struct {
+	Name string
+	Metadata
+}
+
+// types are the names of the metric types, indexed by their value in both
+// remote write protocols.
+var types = []string{"unknown", "counter", "gauge", "histogram", "gaugehistogram", "summary", "info", "stateset"}
+
+// TypeName returns the name of a metric type of the remote write protocols.
+func TypeName(t int32) string {
+	if t < 0 || int(t) >= len(types) {
+		return types[0]
+	}
+	return types[t]
+}
+
+// Cache keeps the latest metadata of each metric family. It is safe for
+// concurrent use.
+type Cache struct {
+	mtx      sync.RWMutex
+	families map[string]Metadata
+}
+
+// NewCache returns an empty cache.
+func NewCache() *Cache {
+	return &Cache{families: map[string]Metadata{}}
+}
+
+// Update stores the metadata of the families, replacing what was known
+// about them.
+func (c *Cache) Update(families []Family) {
+	if len(families) == 0 {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, f := range families {
+		c.families[f.Name] = f.Metadata
+	}
+}
+
+// Get returns the metadata of the named metric family, or of all families if
+// metric is empty, in the shape of the /api/v1/metadata endpoint. At most
+// limit families are returned, sorted by name, unless limit is negative.
+func (c *Cache) Get(metric string, limit int) map[string][]Metadata {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	result := map[string][]Metadata{}
+	if metric != "" {
+		if m, ok := c.families[metric]; ok && limit != 0 {
+			result[metric] = []Metadata{m}
+		}
+		return result
+	}
+
+	names := make([]string, 0, len(c.families))
+	for name := range c.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if limit >= 0 && limit < len(names) {
+		names = names[:limit]
+	}
+	for _, name := range names {
+		result[name] = []Metadata{c.families[name]}
+	}
+	return result
+}
@@ -0,0 +1,55 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	c := NewCache()
+	c.Update([]Family{
+		{Name: "up", Metadata: Metadata{Type: "gauge", Help: "Whether the target is up."}},
+		{Name: "rpc_seconds", Metadata: Metadata{Type: "histogram", Help: "RPC latency.", Unit: "seconds"}},
+	})
+	// Newer metadata replaces what was known.
+	c.Update([]Family{{Name: "up", Metadata: Metadata{Type: "gauge", Help: "1 if the target is up."}}})
+
+	up := []Metadata{{Type: "gauge", Help: "1 if the target is up."}}
+	rpc := []Metadata{{Type: "histogram", Help: "RPC latency.", Unit: "seconds"}}
+	for _, tc := range []struct {
+		metric   string
+		limit    int
+		expected map[string][]Metadata
+	}{
+		{limit: -1, expected: map[string][]Metadata{"up": up, "rpc_seconds": rpc}},
+		{limit: 1, expected: map[string][]Metadata{"rpc_seconds": rpc}},
+		{metric: "up", limit: -1, expected: map[string][]Metadata{"up": up}},
+		{metric: "up", limit: 0, expected: map[string][]Metadata{}},
+		{metric: "unknown", limit: -1, expected: map[string][]Metadata{}},
+	} {
+		if got := c.Get(tc.metric, tc.limit); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Get(%q, %d): expected %v, got %v", tc.metric, tc.limit, tc.expected, got)
+		}
+	}
+}
+
+func TestTypeName(t *testing.T) {
+	for typ, expected := range map[int32]string{0: "unknown", 1: "counter", 4: "gaugehistogram", 7: "stateset", 42: "unknown"} {
+		if got := TypeName(typ); got != expected {
+			t.Errorf("TypeName(%d): expected %s, got %s", typ, expected, got)
+		}
+	}
+}
@@ -126,6 +126,11 @@ func (c *Client) Write(samples model.Samples) error {
 		return nil
 	}
 
+	// Server errors are usually transient, so the write may be retried.
+	if resp.StatusCode/100 == 5 {
+		return recoverableError{errors.Errorf("server returned HTTP status %s", resp.Status)}
+	}
+
 	// API returns status code 400 on error, encoding error details in the
 	// response content in JSON.
 	buf, err = ioutil.ReadAll(resp.Body)
@@ -140,6 +145,16 @@ func (c *Client) Write(samples model.Samples) error {
 	return errors.Errorf("failed to write %d samples to OpenTSDB, %d succeeded", r["failed"], r["success"])
 }
 
+// recoverableError is an error for which retrying the write may succeed.
+type recoverableError struct {
+	error
+}
+
+// Recoverable marks the error as recoverable.
+func (recoverableError) Recoverable() bool {
+	return true
+}
+
 // Name identifies the client as an OpenTSDB client.
 func (c Client) Name() string {
 	return "opentsdb"
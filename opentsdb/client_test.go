@@ -16,8 +16,11 @@ package opentsdb
 import (
 	"bytes"
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/prometheus/common/model"
 )
@@ -73,3 +76,18 @@ func TestMarshalStoreSamplesRequest(t *testing.T) {
 		)
 	}
 }
+
+func TestWriteServerErrorIsRecoverable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		},
+	))
+	defer server.Close()
+
+	c := NewClient(nil, server.URL, time.Minute)
+	err := c.Write(model.Samples{{Metric: metric, Value: 1}})
+	if _, ok := err.(recoverableError); !ok {
+		t.Fatalf("Expected recoverable error, got %#v", err)
+	}
+}
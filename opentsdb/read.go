@@ -0,0 +1,350 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentsdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const queryEndpoint = "/api/query"
+
+// queryRequest is the body of a request to the query endpoint.
+// http://opentsdb.net/docs/build/html/api_http/query/index.html
+type queryRequest struct {
+	Start        int64      `json:"start"`
+	End          int64      `json:"end"`
+	MsResolution bool       `json:"msResolution"`
+	Queries      []subQuery `json:"queries"`
+}
+
+type subQuery struct {
+	Aggregator string      `json:"aggregator"`
+	Metric     TagValue    `json:"metric"`
+	Filters    []tagFilter `json:"filters,omitempty"`
+}
+
+type tagFilter struct {
+	Type    string `json:"type"`
+	Tagk    string `json:"tagk"`
+	Filter  string `json:"filter"`
+	GroupBy bool   `json:"groupBy"`
+}
+
+// queryResult is a single series returned by the query endpoint.
+type queryResult struct {
+	Metric TagValue            `json:"metric"`
+	Tags   map[string]TagValue `json:"tags"`
+	DPS    map[string]float64  `json:"dps"`
+}
+
+// Read queries OpenTSDB for the series matching each query of the request.
+// Matchers which can be expressed exactly as OpenTSDB filters are sent to
+// OpenTSDB, all matchers are applied to the returned series again.
+func (c *Client) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	resp := &prompb.ReadResponse{
+		Results: make([]*prompb.QueryResult, 0, len(req.Queries)),
+	}
+	for _, q := range req.Queries {
+		ts, err := c.query(q)
+		if err != nil {
+			return nil, err
+		}
+		resp.Results = append(resp.Results, &prompb.QueryResult{Timeseries: ts})
+	}
+	return resp, nil
+}
+
+func (c *Client) query(q *prompb.Query) ([]*prompb.TimeSeries, error) {
+	sq, err := buildSubQuery(q.Matchers)
+	if err != nil {
+		return nil, err
+	}
+	matchers, err := newMatchers(q.Matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := c.post(queryRequest{
+		Start:        q.StartTimestampMs,
+		End:          q.EndTimestampMs,
+		MsResolution: true,
+		Queries:      []subQuery{sq},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	series := make([]*prompb.TimeSeries, 0, len(results))
+	for _, r := range results {
+		m := make(model.Metric, len(r.Tags)+1)
+		for k, v := range r.Tags {
+			m[model.LabelName(k)] = model.LabelValue(v)
+		}
+		m[model.MetricNameLabel] = model.LabelValue(r.Metric)
+		if !matchers.matches(m) {
+			continue
+		}
+		ts, err := resultToTimeSeries(m, r.DPS)
+		if err != nil {
+			return nil, err
+		}
+		series = append(series, ts)
+	}
+	return series, nil
+}
+
+// post sends a query request to OpenTSDB and decodes the returned series.
+func (c *Client) post(qr queryRequest) ([]queryResult, error) {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = queryEndpoint
+
+	buf, err := json.Marshal(qr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", u.String(), bytes.NewBuffer(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	// OpenTSDB responds with 404 if the metric or one of the tag values
+	// doesn't exist, which means that no series match.
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("server returned HTTP status %s", resp.Status)
+	}
+
+	var results []queryResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, errors.Wrap(err, "error decoding OpenTSDB response")
+	}
+	return results, nil
+}
+
+// buildSubQuery translates the matchers of a query into an OpenTSDB query.
+// The metric name must be matched exactly, as OpenTSDB can only query a
+// single metric at a time.
+func buildSubQuery(matchers []*prompb.LabelMatcher) (subQuery, error) {
+	// The "none" aggregator returns every series separately.
+	sq := subQuery{Aggregator: "none"}
+	for _, m := range matchers {
+		if m.Name == model.MetricNameLabel {
+			if m.Type != prompb.LabelMatcher_EQ {
+				return sq, errors.New("only equality matchers are supported on the metric name by OpenTSDB")
+			}
+			sq.Metric = TagValue(m.Value)
+			continue
+		}
+		// An empty value matches series without the label, which OpenTSDB
+		// filters cannot express.
+		if m.Value == "" {
+			continue
+		}
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			sq.Filters = append(sq.Filters, tagFilter{Type: "literal_or", Tagk: m.Name, Filter: encode(m.Value)})
+		case prompb.LabelMatcher_RE:
+			// Unlike Prometheus, OpenTSDB doesn't return series without the
+			// tag for its filters, so neither inequality matchers nor regular
+			// expressions matching the empty value are sent to it.
+			if safeRegexp(m.Value) && !matchesEmpty(m.Value) {
+				sq.Filters = append(sq.Filters, tagFilter{Type: "regexp", Tagk: m.Name, Filter: "^(?:" + m.Value + ")$"})
+			}
+		}
+	}
+	if sq.Metric == "" {
+		return sq, errors.New("an equality matcher on the metric name is required by OpenTSDB")
+	}
+	return sq, nil
+}
+
+// encode returns the escaped form in which OpenTSDB stores a tag value.
+// literal_or filters match any of several values separated by '|', which
+// the escaping never produces.
+func encode(v string) string {
+	b, _ := TagValue(v).MarshalJSON()
+	return string(b[1 : len(b)-1])
+}
+
+// safeRegexp returns whether a regular expression matches the escaped form
+// of a value if and only if it matches the value itself. This holds if it
+// only matches strings of characters which aren't escaped, as values with
+// other characters contain a '_' once escaped, which can't be matched then.
+func safeRegexp(re string) bool {
+	parsed, err := syntax.Parse(re, syntax.Perl)
+	if err != nil {
+		return false
+	}
+	return safeRegexpNode(parsed)
+}
+
+// matchesEmpty returns whether a regular expression matches the empty
+// value, as Prometheus does for a missing label.
+func matchesEmpty(re string) bool {
+	r, err := regexp.Compile("^(?:" + re + ")$")
+	return err != nil || r.MatchString("")
+}
+
+func safeRegexpNode(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText:
+		return true
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return false
+		}
+		for _, r := range re.Rune {
+			if !unescaped(r) {
+				return false
+			}
+		}
+		return true
+	case syntax.OpCharClass:
+		for i := 0; i < len(re.Rune); i += 2 {
+			if !unescapedRange(re.Rune[i], re.Rune[i+1]) {
+				return false
+			}
+		}
+		return true
+	case syntax.OpCapture, syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat, syntax.OpConcat, syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if !safeRegexpNode(sub) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// unescaped returns whether a character is stored as is by OpenTSDB. See
+// TagValue.MarshalJSON.
+func unescaped(r rune) bool {
+	return unescapedRange(r, r)
+}
+
+// unescapedRange returns whether all characters from lo to hi are stored as
+// is by OpenTSDB.
+func unescapedRange(lo, hi rune) bool {
+	return (lo >= '-' && hi <= '9') || (lo >= 'A' && hi <= 'Z') || (lo >= 'a' && hi <= 'z')
+}
+
+// matcher matches the value of a label.
+type matcher struct {
+	name  model.LabelName
+	value string
+	typ   prompb.LabelMatcher_Type
+	re    *regexp.Regexp
+}
+
+type matchers []matcher
+
+func newMatchers(lms []*prompb.LabelMatcher) (matchers, error) {
+	ms := make(matchers, 0, len(lms))
+	for _, lm := range lms {
+		m := matcher{name: model.LabelName(lm.Name), value: lm.Value, typ: lm.Type}
+		switch lm.Type {
+		case prompb.LabelMatcher_EQ, prompb.LabelMatcher_NEQ:
+		case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+			re, err := regexp.Compile("^(?:" + lm.Value + ")$")
+			if err != nil {
+				return nil, err
+			}
+			m.re = re
+		default:
+			return nil, errors.Errorf("unknown match type %v", lm.Type)
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+// matches returns whether a metric matches all matchers. Missing labels
+// have an empty value.
+func (ms matchers) matches(metric model.Metric) bool {
+	for _, m := range ms {
+		v := string(metric[m.name])
+		var ok bool
+		switch m.typ {
+		case prompb.LabelMatcher_EQ:
+			ok = v == m.value
+		case prompb.LabelMatcher_NEQ:
+			ok = v != m.value
+		case prompb.LabelMatcher_RE:
+			ok = m.re.MatchString(v)
+		case prompb.LabelMatcher_NRE:
+			ok = !m.re.MatchString(v)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// resultToTimeSeries converts a series returned by OpenTSDB, whose data
+// points are keyed by their timestamp in milliseconds.
+func resultToTimeSeries(m model.Metric, dps map[string]float64) (*prompb.TimeSeries, error) {
+	ts := &prompb.TimeSeries{
+		Labels:  make([]prompb.Label, 0, len(m)),
+		Samples: make([]prompb.Sample, 0, len(dps)),
+	}
+	for k, v := range m {
+		ts.Labels = append(ts.Labels, prompb.Label{Name: string(k), Value: string(v)})
+	}
+	for k, v := range dps {
+		t, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad timestamp %q", k)
+		}
+		ts.Samples = append(ts.Samples, prompb.Sample{Timestamp: t, Value: v})
+	}
+	sort.Slice(ts.Samples, func(i, j int) bool {
+		return ts.Samples[i].Timestamp < ts.Samples[j].Timestamp
+	})
+	return ts, nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentsdb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestRead(t *testing.T) {
+	var received queryRequest
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != queryEndpoint {
+				t.Errorf("Unexpected path %s", r.URL.Path)
+			}
+			if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+				t.Errorf("Error decoding request: %s", err)
+			}
+			w.Write([]byte(`[
+				{"metric": "test_.metric", "tags": {"job": "node", "instance": "a_.9100"}, "dps": {"2000": 2, "1000": 1}},
+				{"metric": "test_.metric", "tags": {"job": "node", "instance": "b_.9100"}, "dps": {"1000": 3}}
+			]`))
+		},
+	))
+	defer server.Close()
+
+	c := NewClient(nil, server.URL, time.Minute)
+	resp, err := c.Read(&prompb.ReadRequest{
+		Queries: []*prompb.Query{{
+			StartTimestampMs: 1000,
+			EndTimestampMs:   2000,
+			Matchers: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "test:metric"},
+				{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "node"},
+				{Type: prompb.LabelMatcher_NRE, Name: "instance", Value: "b:.*"},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expectedReq := queryRequest{
+		Start:        1000,
+		End:          2000,
+		MsResolution: true,
+		Queries: []subQuery{{
+			Aggregator: "none",
+			Metric:     "test:metric",
+			Filters:    []tagFilter{{Type: "literal_or", Tagk: "job", Filter: "node"}},
+		}},
+	}
+	if !reflect.DeepEqual(received, expectedReq) {
+		t.Errorf("Expected request %+v, got %+v", expectedReq, received)
+	}
+
+	if len(resp.Results) != 1 || len(resp.Results[0].Timeseries) != 1 {
+		t.Fatalf("Expected a single series, got %v", resp)
+	}
+	ts := resp.Results[0].Timeseries[0]
+	sort.Slice(ts.Labels, func(i, j int) bool { return ts.Labels[i].Name < ts.Labels[j].Name })
+	expected := &prompb.TimeSeries{
+		Labels: []prompb.Label{
+			{Name: "__name__", Value: "test:metric"},
+			{Name: "instance", Value: "a:9100"},
+			{Name: "job", Value: "node"},
+		},
+		Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 2}},
+	}
+	if !reflect.DeepEqual(ts, expected) {
+		t.Errorf("Expected %v, got %v", expected, ts)
+	}
+}
+
+func TestBuildSubQuery(t *testing.T) {
+	sq, err := buildSubQuery([]*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+		{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "my_job"},
+		{Type: prompb.LabelMatcher_RE, Name: "env", Value: "prod|staging-[0-9]+"},
+		{Type: prompb.LabelMatcher_RE, Name: "instance", Value: "a.*"},
+		{Type: prompb.LabelMatcher_RE, Name: "path", Value: "/api_v1/.+"},
+		{Type: prompb.LabelMatcher_RE, Name: "region", Value: "eu-[0-9]+|"},
+		{Type: prompb.LabelMatcher_RE, Name: "zone", Value: "[a-c]*"},
+		{Type: prompb.LabelMatcher_EQ, Name: "missing", Value: ""},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []tagFilter{
+		{Type: "regexp", Tagk: "env", Filter: "^(?:prod|staging-[0-9]+)$"},
+	}
+	if !reflect.DeepEqual(sq.Filters, expected) {
+		t.Errorf("Expected filters %+v, got %+v", expected, sq.Filters)
+	}
+
+	if _, err := buildSubQuery([]*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "up|down"},
+	}); err == nil {
+		t.Error("Expected error for regex matcher on metric name, got none")
+	}
+}
+
+func TestReadSeriesWithoutTag(t *testing.T) {
+	var received queryRequest
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+				t.Errorf("Error decoding request: %s", err)
+			}
+			w.Write([]byte(`[
+				{"metric": "up", "tags": {"job": "node", "env": "prod"}, "dps": {"1000": 1}},
+				{"metric": "up", "tags": {"job": "db"}, "dps": {"1000": 2}},
+				{"metric": "up", "tags": {"env": "dev"}, "dps": {"1000": 3}},
+				{"metric": "up", "tags": {}, "dps": {"1000": 4}}
+			]`))
+		},
+	))
+	defer server.Close()
+
+	for _, test := range []struct {
+		matcher  *prompb.LabelMatcher
+		expected []float64
+	}{
+		{
+			matcher:  &prompb.LabelMatcher{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "node"},
+			expected: []float64{2, 3, 4},
+		},
+		{
+			matcher:  &prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "env", Value: "prod|"},
+			expected: []float64{1, 2, 4},
+		},
+	} {
+		c := NewClient(nil, server.URL, time.Minute)
+		resp, err := c.Read(&prompb.ReadRequest{
+			Queries: []*prompb.Query{{
+				StartTimestampMs: 1000,
+				EndTimestampMs:   2000,
+				Matchers: []*prompb.LabelMatcher{
+					{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+					test.matcher,
+				},
+			}},
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if len(received.Queries) != 1 || len(received.Queries[0].Filters) != 0 {
+			t.Errorf("%v: expected no filters to be sent, got %+v", test.matcher, received.Queries)
+		}
+		var values []float64
+		for _, ts := range resp.Results[0].Timeseries {
+			values = append(values, ts.Samples[0].Value)
+		}
+		sort.Float64s(values)
+		if !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("%v: expected series with values %v, got %v", test.matcher, test.expected, values)
+		}
+	}
+}
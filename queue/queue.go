@@ -0,0 +1,526 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package queue implements a durable FIFO queue of sample batches which is
+// persisted in segment files on local disk.
+package queue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/gogo/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	cursorFile = "cursor"
+
+	// Every record starts with the length of its payload and the CRC32
+	// of the payload, followed by the payload itself. The payload starts
+	// with the time the record was appended and the number of samples it
+	// contains, followed by the protobuf-encoded samples.
+	recordHeaderSize  = 8
+	payloadHeaderSize = 12
+)
+
+var (
+	// ErrFull is returned by Append if the queue has reached its maximum
+	// size on disk.
+	ErrFull = errors.New("queue is full")
+	// ErrClosed is returned when using a closed queue.
+	ErrClosed = errors.New("queue is closed")
+
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// record describes a batch of samples stored in a segment file.
+type record struct {
+	segment  int
+	offset   int64
+	size     int64
+	samples  int
+	appended time.Time
+}
+
+// Queue is a durable FIFO queue of sample batches. Batches are appended to
+// segment files in a directory and stay on disk until they are committed by
+// the consumer, so they survive restarts of the process. A Queue supports
+// any number of concurrent producers but only a single consumer.
+type Queue struct {
+	logger log.Logger
+
+	dir         string
+	maxSize     int64
+	segmentSize int64
+
+	mtx      sync.Mutex
+	cond     *sync.Cond
+	closed   bool
+	head     *os.File
+	headSeg  int
+	segments map[int]int64
+	size     int64
+	pending  []record
+	samples  int
+
+	reader    *os.File
+	readerSeg int
+
+	pendingSamplesDesc *prometheus.Desc
+	sizeBytesDesc      *prometheus.Desc
+	oldestAgeDesc      *prometheus.Desc
+}
+
+// Open opens the queue stored in dir, creating it if it doesn't exist yet.
+// Batches which were appended but not committed before the queue was last
+// closed are replayed. The queue never grows beyond maxSize bytes on disk,
+// and segment files are cut once they exceed segmentSize bytes. The name is
+// used to label the metrics exposed by the queue.
+func Open(logger log.Logger, dir string, name string, maxSize, segmentSize int64) (*Queue, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	labels := prometheus.Labels{"remote": name}
+	q := &Queue{
+		logger:      logger,
+		dir:         dir,
+		maxSize:     maxSize,
+		segmentSize: segmentSize,
+		segments:    map[int]int64{},
+		readerSeg:   -1,
+		pendingSamplesDesc: prometheus.NewDesc(
+			"queue_pending_samples",
+			"Number of samples in the on-disk queue waiting to be sent to the remote storage.",
+			nil, labels,
+		),
+		sizeBytesDesc: prometheus.NewDesc(
+			"queue_size_bytes",
+			"Size of the on-disk queue in bytes.",
+			nil, labels,
+		),
+		oldestAgeDesc: prometheus.NewDesc(
+			"queue_oldest_entry_age_seconds",
+			"Age of the oldest batch of samples in the on-disk queue.",
+			nil, labels,
+		),
+	}
+	q.cond = sync.NewCond(&q.mtx)
+
+	if err := q.replay(); err != nil {
+		return nil, err
+	}
+	if err := q.cut(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *Queue) segmentPath(seg int) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%08d", seg))
+}
+
+// replay loads the records of all segments on disk which haven't been
+// committed yet. Segments which were fully committed are removed and torn
+// records at the end of a segment are truncated.
+func (q *Queue) replay() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	var segs []int
+	for _, f := range files {
+		seg, err := strconv.Atoi(f.Name())
+		if err != nil || f.IsDir() {
+			continue
+		}
+		segs = append(segs, seg)
+	}
+	sort.Ints(segs)
+
+	cursorSeg, cursorOffset, err := q.readCursor()
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range segs {
+		q.headSeg = seg
+		if seg < cursorSeg {
+			if err := os.Remove(q.segmentPath(seg)); err != nil {
+				return err
+			}
+			continue
+		}
+		var offset int64
+		if seg == cursorSeg {
+			offset = cursorOffset
+		}
+		size, err := q.replaySegment(seg, offset)
+		if err != nil {
+			return errors.Wrapf(err, "error replaying segment %d", seg)
+		}
+		q.segments[seg] = size
+		q.size += size
+	}
+	return nil
+}
+
+func (q *Queue) replaySegment(seg int, offset int64) (int64, error) {
+	f, err := os.OpenFile(q.segmentPath(seg), os.O_RDWR, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	for {
+		r, err := readRecordHeader(f, seg, offset)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			level.Warn(q.logger).Log("msg", "Truncating corrupted queue segment", "segment", seg, "offset", offset, "err", err)
+			return offset, f.Truncate(offset)
+		}
+		q.pending = append(q.pending, r)
+		q.samples += r.samples
+		offset += r.size
+	}
+}
+
+// readRecordHeader reads and verifies the record at offset without decoding
+// the samples it contains.
+func readRecordHeader(f *os.File, seg int, offset int64) (record, error) {
+	var hdr [recordHeaderSize + payloadHeaderSize]byte
+	if _, err := f.ReadAt(hdr[:recordHeaderSize], offset); err != nil {
+		if err == io.EOF {
+			// A partially written header is a torn record, not the
+			// clean end of the segment.
+			info, statErr := f.Stat()
+			if statErr == nil && info.Size() == offset {
+				return record{}, io.EOF
+			}
+			return record{}, io.ErrUnexpectedEOF
+		}
+		return record{}, err
+	}
+	length := binary.BigEndian.Uint32(hdr[0:4])
+	if length < payloadHeaderSize {
+		return record{}, errors.Errorf("invalid record length %d", length)
+	}
+	payload := make([]byte, length)
+	if _, err := f.ReadAt(payload, offset+recordHeaderSize); err != nil {
+		return record{}, err
+	}
+	if crc32.Checksum(payload, castagnoliTable) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return record{}, errors.New("checksum mismatch")
+	}
+	return record{
+		segment:  seg,
+		offset:   offset,
+		size:     recordHeaderSize + int64(length),
+		appended: time.Unix(0, int64(binary.BigEndian.Uint64(payload[0:8]))),
+		samples:  int(binary.BigEndian.Uint32(payload[8:12])),
+	}, nil
+}
+
+func (q *Queue) readCursor() (int, int64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(q.dir, cursorFile))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var (
+		seg    int
+		offset int64
+	)
+	if _, err := fmt.Sscanf(string(b), "%d %d", &seg, &offset); err != nil {
+		return 0, 0, errors.Wrap(err, "invalid queue cursor")
+	}
+	return seg, offset, nil
+}
+
+func (q *Queue) writeCursor(seg int, offset int64) error {
+	tmp := filepath.Join(q.dir, cursorFile+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", seg, offset)), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(q.dir, cursorFile))
+}
+
+// cut closes the current head segment and starts a new one.
+func (q *Queue) cut() error {
+	if q.head != nil {
+		if err := q.head.Close(); err != nil {
+			return err
+		}
+	}
+	seg := q.headSeg + 1
+	f, err := os.OpenFile(q.segmentPath(seg), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	q.head = f
+	q.headSeg = seg
+	q.segments[seg] = 0
+	return nil
+}
+
+// Append durably stores a batch of samples at the end of the queue. It
+// returns ErrFull if the batch doesn't fit into the queue.
+func (q *Queue) Append(samples model.Samples) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	data, err := proto.Marshal(samplesToProto(samples))
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, recordHeaderSize+payloadHeaderSize+len(data))
+	payload := buf[recordHeaderSize:]
+	binary.BigEndian.PutUint64(payload[0:8], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(len(samples)))
+	copy(payload[payloadHeaderSize:], data)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, castagnoliTable))
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	size := int64(len(buf))
+	if q.size+size > q.maxSize {
+		return ErrFull
+	}
+	if q.segments[q.headSeg] > 0 && q.segments[q.headSeg]+size > q.segmentSize {
+		if err := q.cut(); err != nil {
+			return err
+		}
+	}
+
+	offset := q.segments[q.headSeg]
+	if _, err := q.head.Write(buf); err != nil {
+		// Drop whatever part of the record made it to disk, so that
+		// subsequent records don't end up behind garbage.
+		q.head.Truncate(offset)
+		q.head.Seek(offset, io.SeekStart)
+		return err
+	}
+	if err := q.head.Sync(); err != nil {
+		return err
+	}
+
+	q.segments[q.headSeg] += size
+	q.size += size
+	q.samples += len(samples)
+	q.pending = append(q.pending, record{
+		segment:  q.headSeg,
+		offset:   offset,
+		size:     size,
+		samples:  len(samples),
+		appended: time.Unix(0, int64(binary.BigEndian.Uint64(payload[0:8]))),
+	})
+	q.cond.Signal()
+	return nil
+}
+
+// Next returns the oldest batch of samples in the queue, blocking until one
+// is available. The same batch is returned until it is committed. Next
+// returns ErrClosed once the queue is closed.
+func (q *Queue) Next() (model.Samples, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for len(q.pending) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil, ErrClosed
+	}
+	// The reader is closed along with the queue and its segments, so it is
+	// used with the mutex held.
+	r := q.pending[0]
+	if q.readerSeg != r.segment {
+		if q.reader != nil {
+			q.reader.Close()
+		}
+		f, err := os.Open(q.segmentPath(r.segment))
+		if err != nil {
+			return nil, err
+		}
+		q.reader = f
+		q.readerSeg = r.segment
+	}
+
+	data := make([]byte, r.size-recordHeaderSize-payloadHeaderSize)
+	if _, err := q.reader.ReadAt(data, r.offset+recordHeaderSize+payloadHeaderSize); err != nil {
+		return nil, err
+	}
+	var req prompb.WriteRequest
+	if err := proto.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	return ProtoToSamples(&req), nil
+}
+
+// Commit removes the oldest batch of samples, as returned by Next, from the
+// queue.
+func (q *Queue) Commit() error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if len(q.pending) == 0 {
+		return nil
+	}
+	r := q.pending[0]
+	q.pending = q.pending[1:]
+	q.samples -= r.samples
+
+	seg, offset := q.headSeg, q.segments[q.headSeg]
+	if len(q.pending) > 0 {
+		seg, offset = q.pending[0].segment, q.pending[0].offset
+	}
+	if err := q.writeCursor(seg, offset); err != nil {
+		return err
+	}
+
+	// Remove all segments which were fully consumed.
+	for s, size := range q.segments {
+		if s >= seg {
+			continue
+		}
+		if s == q.readerSeg {
+			q.reader.Close()
+			q.reader = nil
+			q.readerSeg = -1
+		}
+		if err := os.Remove(q.segmentPath(s)); err != nil {
+			return err
+		}
+		delete(q.segments, s)
+		q.size -= size
+	}
+	return nil
+}
+
+// Len returns the number of samples which were appended to the queue but not
+// committed yet.
+func (q *Queue) Len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.samples
+}
+
+// Close closes the queue. Batches which were not committed yet are kept on
+// disk and replayed when the queue is opened again.
+func (q *Queue) Close() error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	q.cond.Broadcast()
+	if q.reader != nil {
+		q.reader.Close()
+	}
+	return q.head.Close()
+}
+
+// Describe implements prometheus.Collector.
+func (q *Queue) Describe(ch chan<- *prometheus.Desc) {
+	ch <- q.pendingSamplesDesc
+	ch <- q.sizeBytesDesc
+	ch <- q.oldestAgeDesc
+}
+
+// Collect implements prometheus.Collector.
+func (q *Queue) Collect(ch chan<- prometheus.Metric) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	var age float64
+	if len(q.pending) > 0 {
+		age = time.Since(q.pending[0].appended).Seconds()
+	}
+	ch <- prometheus.MustNewConstMetric(q.pendingSamplesDesc, prometheus.GaugeValue, float64(q.samples))
+	ch <- prometheus.MustNewConstMetric(q.sizeBytesDesc, prometheus.GaugeValue, float64(q.size))
+	ch <- prometheus.MustNewConstMetric(q.oldestAgeDesc, prometheus.GaugeValue, age)
+}
+
+// samplesToProto converts samples into a write request, grouping samples of
+// the same series.
+func samplesToProto(samples model.Samples) *prompb.WriteRequest {
+	req := &prompb.WriteRequest{}
+	series := map[model.Fingerprint]int{}
+	for _, s := range samples {
+		fp := s.Metric.Fingerprint()
+		i, ok := series[fp]
+		if !ok {
+			labels := make([]prompb.Label, 0, len(s.Metric))
+			for l, v := range s.Metric {
+				labels = append(labels, prompb.Label{Name: string(l), Value: string(v)})
+			}
+			i = len(req.Timeseries)
+			series[fp] = i
+			req.Timeseries = append(req.Timeseries, prompb.TimeSeries{Labels: labels})
+		}
+		req.Timeseries[i].Samples = append(req.Timeseries[i].Samples, prompb.Sample{
+			Value:     float64(s.Value),
+			Timestamp: int64(s.Timestamp),
+		})
+	}
+	return req
+}
+
+// ProtoToSamples returns the float samples of the series of a write request.
+func ProtoToSamples(req *prompb.WriteRequest) model.Samples {
+	var samples model.Samples
+	for _, ts := range req.Timeseries {
+		metric := make(model.Metric, len(ts.Labels))
+		for _, l := range ts.Labels {
+			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		}
+
+		for _, s := range ts.Samples {
+			samples = append(samples, &model.Sample{
+				Metric:    metric,
+				Value:     model.SampleValue(s.Value),
+				Timestamp: model.Time(s.Timestamp),
+			})
+		}
+	}
+	return samples
+}
@@ -0,0 +1,181 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func testSamples(n int, start model.Time) model.Samples {
+	samples := make(model.Samples, 0, n)
+	for i := 0; i < n; i++ {
+		samples = append(samples, &model.Sample{
+			Metric: model.Metric{
+				model.MetricNameLabel: "test_metric",
+				"instance":            model.LabelValue(string('a' + rune(i%3))),
+			},
+			Value:     model.SampleValue(i),
+			Timestamp: start + model.Time(i),
+		})
+	}
+	return samples
+}
+
+func openTestQueue(t *testing.T, dir string, maxSize int64) *Queue {
+	q, err := Open(nil, dir, "test", maxSize, 512)
+	if err != nil {
+		t.Fatalf("Error opening queue: %s", err)
+	}
+	return q
+}
+
+// expectSamples checks that the same samples are returned, ignoring the
+// order in which series are grouped.
+func expectSamples(t *testing.T, expected, actual model.Samples) {
+	exp := map[model.Fingerprint]model.Samples{}
+	for _, s := range expected {
+		exp[s.Metric.Fingerprint()] = append(exp[s.Metric.Fingerprint()], s)
+	}
+	act := map[model.Fingerprint]model.Samples{}
+	for _, s := range actual {
+		act[s.Metric.Fingerprint()] = append(act[s.Metric.Fingerprint()], s)
+	}
+	if !reflect.DeepEqual(exp, act) {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestQueueReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := openTestQueue(t, dir, 1<<20)
+	var batches []model.Samples
+	for i := 0; i < 10; i++ {
+		b := testSamples(5, model.Time(i*100))
+		if err := q.Append(b); err != nil {
+			t.Fatalf("Error appending samples: %s", err)
+		}
+		batches = append(batches, b)
+	}
+
+	// Consume some batches, then reopen the queue.
+	for i := 0; i < 4; i++ {
+		samples, err := q.Next()
+		if err != nil {
+			t.Fatalf("Error reading samples: %s", err)
+		}
+		expectSamples(t, batches[i], samples)
+		if err := q.Commit(); err != nil {
+			t.Fatalf("Error committing samples: %s", err)
+		}
+	}
+	// An uncommitted batch must be replayed.
+	if _, err := q.Next(); err != nil {
+		t.Fatalf("Error reading samples: %s", err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatalf("Error closing queue: %s", err)
+	}
+
+	q = openTestQueue(t, dir, 1<<20)
+	defer q.Close()
+	if q.Len() != 30 {
+		t.Fatalf("Expected 30 pending samples after replay, got %d", q.Len())
+	}
+	for i := 4; i < 10; i++ {
+		samples, err := q.Next()
+		if err != nil {
+			t.Fatalf("Error reading samples: %s", err)
+		}
+		expectSamples(t, batches[i], samples)
+		if err := q.Commit(); err != nil {
+			t.Fatalf("Error committing samples: %s", err)
+		}
+	}
+
+	// All but the current head segment must have been removed.
+	files, err := filepath.Glob(filepath.Join(dir, "0*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("Expected only the head segment to remain, got %v", files)
+	}
+	if q.size != 0 || q.Len() != 0 {
+		t.Errorf("Expected empty queue, got %d bytes and %d samples", q.size, q.Len())
+	}
+}
+
+func TestQueueTruncatesTornRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := openTestQueue(t, dir, 1<<20)
+	first := testSamples(2, 0)
+	if err := q.Append(first); err != nil {
+		t.Fatalf("Error appending samples: %s", err)
+	}
+	if err := q.Append(testSamples(2, 100)); err != nil {
+		t.Fatalf("Error appending samples: %s", err)
+	}
+	seg := q.segmentPath(q.headSeg)
+	size := q.segments[q.headSeg]
+	q.Close()
+
+	// Simulate a crash in the middle of writing the second record.
+	if err := os.Truncate(seg, size-3); err != nil {
+		t.Fatal(err)
+	}
+
+	q = openTestQueue(t, dir, 1<<20)
+	defer q.Close()
+	if len(q.pending) != 1 {
+		t.Fatalf("Expected 1 pending batch, got %d", len(q.pending))
+	}
+	samples, err := q.Next()
+	if err != nil {
+		t.Fatalf("Error reading samples: %s", err)
+	}
+	expectSamples(t, first, samples)
+}
+
+func TestQueueFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := openTestQueue(t, dir, 200)
+	defer q.Close()
+	if err := q.Append(testSamples(2, 0)); err != nil {
+		t.Fatalf("Error appending samples: %s", err)
+	}
+	if err := q.Append(testSamples(20, 0)); err != ErrFull {
+		t.Fatalf("Expected ErrFull, got %v", err)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"exemplar"
+)
+
+// readLimitError is implemented by errors of reads which were rejected for
+// exceeding a read limit of a storage.
+type readLimitError interface {
+	ReadLimit() string
+}
+
+// exceedsReadLimit returns whether err rejected a read for exceeding a read
+// limit.
+func exceedsReadLimit(err error) bool {
+	_, ok := errors.Cause(err).(readLimitError)
+	return ok
+}
+
+// readErrorStatus returns the HTTP status of a failed read request. Reads
+// exceeding a read limit fail the same way when retried, so they are
+// answered with 422 rather than 500.
+func readErrorStatus(err error) int {
+	if exceedsReadLimit(err) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+// readAll sends the read request to all readers concurrently and merges
+// their responses. If partial is true, readers which fail are skipped and
+// the results of the remaining ones are returned; otherwise the first
+// failure fails the whole request. Reads exceeding a read limit always fail
+// the whole request, as the results would be incomplete.
+func readAll(logger log.Logger, readers []reader, req *prompb.ReadRequest, partial bool) (*prompb.ReadResponse, error) {
+	if len(readers) == 0 {
+		return nil, errors.New("no readers configured")
+	}
+
+	type result struct {
+		resp *prompb.ReadResponse
+		err  error
+	}
+	results := make([]result, len(readers))
+
+	var wg sync.WaitGroup
+	for i, r := range readers {
+		wg.Add(1)
+		go func(i int, r reader) {
+			defer wg.Done()
+			resp, err := r.Read(req)
+			results[i] = result{resp: resp, err: err}
+		}(i, r)
+	}
+	wg.Wait()
+
+	var (
+		resps    []*prompb.ReadResponse
+		firstErr error
+	)
+	for i, res := range results {
+		if res.err == nil {
+			resps = append(resps, res.resp)
+			continue
+		}
+		name := readers[i].Name()
+		failedReads.WithLabelValues(name).Inc()
+		err := errors.Wrapf(res.err, "error reading from %s", name)
+		if !partial || exceedsReadLimit(res.err) {
+			return nil, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		level.Warn(logger).Log("msg", "Error executing query, returning partial results", "storage", name, "err", res.err)
+	}
+	if len(resps) == 0 {
+		return nil, firstErr
+	}
+	return mergeResponses(resps), nil
+}
+
+// mergeResponses merges the results of several read responses. Results are
+// merged by query index, series with identical label sets are combined and
+// samples with duplicate timestamps are only kept once.
+func mergeResponses(resps []*prompb.ReadResponse) *prompb.ReadResponse {
+	if len(resps) == 1 {
+		return resps[0]
+	}
+
+	numResults := 0
+	for _, resp := range resps {
+		if len(resp.Results) > numResults {
+			numResults = len(resp.Results)
+		}
+	}
+
+	merged := &prompb.ReadResponse{
+		Results: make([]*prompb.QueryResult, 0, numResults),
+	}
+	for i := 0; i < numResults; i++ {
+		labelsToSeries := map[string]*prompb.TimeSeries{}
+		for _, resp := range resps {
+			if i >= len(resp.Results) {
+				continue
+			}
+			for _, ts := range resp.Results[i].Timeseries {
+				k := labelsKey(ts.Labels)
+				if s, ok := labelsToSeries[k]; ok {
+					s.Samples = mergeSamples(s.Samples, ts.Samples)
+					continue
+				}
+				labelsToSeries[k] = &prompb.TimeSeries{
+					Labels:  ts.Labels,
+					Samples: ts.Samples,
+				}
+			}
+		}
+
+		keys := make([]string, 0, len(labelsToSeries))
+		for k := range labelsToSeries {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		result := &prompb.QueryResult{
+			Timeseries: make([]*prompb.TimeSeries, 0, len(keys)),
+		}
+		for _, k := range keys {
+			result.Timeseries = append(result.Timeseries, labelsToSeries[k])
+		}
+		merged.Results = append(merged.Results, result)
+	}
+	return merged
+}
+
+// labelsKey returns a string uniquely identifying a label set, independent
+// of the order of the labels.
+func labelsKey(labels []prompb.Label) string {
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		// 0xff cannot occur in valid UTF-8 sequences, so use it
+		// as a separator here.
+		pairs = append(pairs, l.Name+"\xff"+l.Value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xff")
+}
+
+// mergeSamples merges two lists of sample pairs and removes duplicate
+// timestamps. It assumes that both lists are sorted by timestamp.
+func mergeSamples(a, b []prompb.Sample) []prompb.Sample {
+	result := make([]prompb.Sample, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i].Timestamp < b[j].Timestamp {
+			result = append(result, a[i])
+			i++
+		} else if a[i].Timestamp > b[j].Timestamp {
+			result = append(result, b[j])
+			j++
+		} else {
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	result = append(result, b[j:]...)
+	return result
+}
+
+// readStream passes the series of the queries of a read request to send one
+// by one, along with the index of their query, as r returns them if it
+// supports it, or after reading all series of a query otherwise.
+func readStream(r reader, req *prompb.ReadRequest, send func(int, *prompb.TimeSeries) error) error {
+	if sr, ok := r.(streamReader); ok {
+		return sr.ReadStream(req, send)
+	}
+	for i, q := range req.Queries {
+		resp, err := r.Read(&prompb.ReadRequest{Queries: []*prompb.Query{q}})
+		if err != nil {
+			return err
+		}
+		for _, res := range resp.Results {
+			for _, ts := range res.Timeseries {
+				if err := send(i, ts); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// errExemplarsNotReadable is returned by readExemplars for readers which
+// don't return exemplars.
+var errExemplarsNotReadable = errors.New("reading exemplars is not supported")
+
+// readExemplars reads exemplars from r if it returns them, and returns
+// errExemplarsNotReadable otherwise.
+func readExemplars(r reader, q *prompb.Query) ([]exemplar.Series, error) {
+	er, ok := r.(exemplarReader)
+	if !ok {
+		return nil, errExemplarsNotReadable
+	}
+	return er.ReadExemplars(q)
+}
+
+// queryExemplars reads exemplars from all readers which return them
+// concurrently and merges them. Failures are handled like in readAll.
+func queryExemplars(logger log.Logger, readers []reader, q *prompb.Query, partial bool) ([]exemplar.Series, error) {
+	results := make([][]exemplar.Series, len(readers))
+	errs := make([]error, len(readers))
+
+	var wg sync.WaitGroup
+	for i, r := range readers {
+		wg.Add(1)
+		go func(i int, r reader) {
+			defer wg.Done()
+			results[i], errs[i] = readExemplars(r, q)
+		}(i, r)
+	}
+	wg.Wait()
+
+	var (
+		series   [][]exemplar.Series
+		firstErr error
+	)
+	for i, err := range errs {
+		switch err {
+		case nil:
+			series = append(series, results[i])
+			continue
+		case errExemplarsNotReadable:
+			continue
+		}
+		name := readers[i].Name()
+		failedReads.WithLabelValues(name).Inc()
+		err = errors.Wrapf(err, "error reading exemplars from %s", name)
+		if !partial {
+			return nil, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		level.Warn(logger).Log("msg", "Error querying exemplars, returning partial results", "storage", name, "err", errs[i])
+	}
+	if len(series) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+	return exemplar.Merge(series...), nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"exemplar"
+)
+
+type fakeReader struct {
+	name string
+	resp *prompb.ReadResponse
+	err  error
+}
+
+func (r *fakeReader) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	return r.resp, r.err
+}
+
+func (r *fakeReader) Name() string {
+	return r.name
+}
+
+func TestReadAllMergesResults(t *testing.T) {
+	oldCluster := &fakeReader{
+		name: "old",
+		resp: &prompb.ReadResponse{
+			Results: []*prompb.QueryResult{{
+				Timeseries: []*prompb.TimeSeries{
+					{
+						Labels: []prompb.Label{
+							{Name: "job", Value: "a"},
+							{Name: "__name__", Value: "up"},
+						},
+						Samples: []prompb.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}},
+					},
+					{
+						Labels:  []prompb.Label{{Name: "__name__", Value: "only_old"}},
+						Samples: []prompb.Sample{{Timestamp: 1, Value: 10}},
+					},
+				},
+			}},
+		},
+	}
+	newCluster := &fakeReader{
+		name: "new",
+		resp: &prompb.ReadResponse{
+			Results: []*prompb.QueryResult{{
+				Timeseries: []*prompb.TimeSeries{
+					{
+						Labels: []prompb.Label{
+							{Name: "__name__", Value: "up"},
+							{Name: "job", Value: "a"},
+						},
+						Samples: []prompb.Sample{{Timestamp: 2, Value: 2}, {Timestamp: 3, Value: 3}},
+					},
+				},
+			}},
+		},
+	}
+
+	resp, err := readAll(log.NewNopLogger(), []reader{oldCluster, newCluster}, &prompb.ReadRequest{}, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected := &prompb.ReadResponse{
+		Results: []*prompb.QueryResult{{
+			Timeseries: []*prompb.TimeSeries{
+				{
+					Labels:  []prompb.Label{{Name: "__name__", Value: "only_old"}},
+					Samples: []prompb.Sample{{Timestamp: 1, Value: 10}},
+				},
+				{
+					Labels: []prompb.Label{
+						{Name: "job", Value: "a"},
+						{Name: "__name__", Value: "up"},
+					},
+					Samples: []prompb.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}, {Timestamp: 3, Value: 3}},
+				},
+			},
+		}},
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Errorf("Expected %v, got %v", expected, resp)
+	}
+}
+
+func TestReadAllPartialFailure(t *testing.T) {
+	ok := &fakeReader{
+		name: "ok",
+		resp: &prompb.ReadResponse{
+			Results: []*prompb.QueryResult{{
+				Timeseries: []*prompb.TimeSeries{{
+					Labels:  []prompb.Label{{Name: "__name__", Value: "up"}},
+					Samples: []prompb.Sample{{Timestamp: 1, Value: 1}},
+				}},
+			}},
+		},
+	}
+	broken := &fakeReader{name: "broken", err: errors.New("connection refused")}
+	readers := []reader{ok, broken}
+
+	if _, err := readAll(log.NewNopLogger(), readers, &prompb.ReadRequest{}, false); err == nil {
+		t.Fatal("Expected error when partial responses are disabled, got none")
+	}
+
+	resp, err := readAll(log.NewNopLogger(), readers, &prompb.ReadRequest{}, true)
+	if err != nil {
+		t.Fatalf("Unexpected error with partial responses enabled: %s", err)
+	}
+	if !reflect.DeepEqual(resp, ok.resp) {
+		t.Errorf("Expected %v, got %v", ok.resp, resp)
+	}
+
+	if _, err := readAll(log.NewNopLogger(), []reader{broken}, &prompb.ReadRequest{}, true); err == nil {
+		t.Fatal("Expected error when all readers fail, got none")
+	}
+}
+
+type limitError string
+
+func (e limitError) Error() string     { return string(e) }
+func (e limitError) ReadLimit() string { return "series" }
+
+func TestReadAllLimitExceeded(t *testing.T) {
+	ok := &fakeReader{name: "ok", resp: &prompb.ReadResponse{Results: []*prompb.QueryResult{{}}}}
+	limited := &fakeReader{name: "limited", err: limitError("query returns more than the limit of 10 series")}
+
+	// Even with partial responses, the whole request fails.
+	_, err := readAll(log.NewNopLogger(), []reader{ok, limited}, &prompb.ReadRequest{}, true)
+	if err == nil {
+		t.Fatal("Expected error for exceeded limit, got none")
+	}
+	if status := readErrorStatus(err); status != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422, got %d", status)
+	}
+	if status := readErrorStatus(errors.New("connection refused")); status != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d", status)
+	}
+}
+
+type fakeExemplarReader struct {
+	fakeReader
+	series []exemplar.Series
+}
+
+func (r *fakeExemplarReader) ReadExemplars(q *prompb.Query) ([]exemplar.Series, error) {
+	return r.series, r.err
+}
+
+func TestQueryExemplars(t *testing.T) {
+	up := model.LabelSet{"__name__": "up"}
+	readers := []reader{
+		// Readers without exemplar support are skipped.
+		namedReader{reader: &fakeReader{name: "graphite"}, name: "graphite"},
+		namedReader{reader: &fakeExemplarReader{
+			fakeReader: fakeReader{name: "influxdb"},
+			series:     []exemplar.Series{{SeriesLabels: up, Exemplars: []exemplar.Exemplar{{Value: 1, Timestamp: 1000}}}},
+		}, name: "influxdb"},
+		namedReader{reader: &fakeExemplarReader{fakeReader: fakeReader{name: "broken", err: errors.New("timeout")}}, name: "broken"},
+	}
+
+	if _, err := queryExemplars(log.NewNopLogger(), readers, &prompb.Query{}, false); err == nil {
+		t.Fatal("Expected error without partial responses, got none")
+	}
+
+	series, err := queryExemplars(log.NewNopLogger(), readers, &prompb.Query{}, true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []exemplar.Series{{SeriesLabels: up, Exemplars: []exemplar.Exemplar{{Value: 1, Timestamp: 1000}}}}
+	if !reflect.DeepEqual(series, expected) {
+		t.Errorf("Expected %v, got %v", expected, series)
+	}
+}
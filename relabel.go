@@ -0,0 +1,152 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
+
+	"exemplar"
+	"histogram"
+	"metadata"
+)
+
+// relabelWriter applies the write relabeling of a remote storage to the
+// samples before they are written.
+type relabelWriter struct {
+	writer
+	configs []*relabel.Config
+}
+
+// newRelabelWriter returns a writer which relabels samples with the given
+// configs before writing them to w, or w itself if there are no configs.
+func newRelabelWriter(w writer, configs []*relabel.Config) writer {
+	if len(configs) == 0 {
+		return w
+	}
+	return relabelWriter{writer: w, configs: configs}
+}
+
+// Write relabels the samples and writes the ones which weren't dropped.
+func (w relabelWriter) Write(samples model.Samples) error {
+	relabeled := relabelSamples(samples, w.configs)
+	if dropped := len(samples) - len(relabeled); dropped > 0 {
+		droppedSamples.WithLabelValues(w.Name()).Add(float64(dropped))
+	}
+	if len(relabeled) == 0 {
+		return nil
+	}
+	return w.writer.Write(relabeled)
+}
+
+// WriteHistograms relabels the native histograms and writes the ones which
+// weren't dropped.
+func (w relabelWriter) WriteHistograms(histograms []histogram.Sample) error {
+	cache := map[model.Fingerprint]model.Metric{}
+	relabeled := make([]histogram.Sample, 0, len(histograms))
+	for _, h := range histograms {
+		fp := h.Metric.Fingerprint()
+		metric, ok := cache[fp]
+		if !ok {
+			metric = relabelMetric(h.Metric, w.configs)
+			cache[fp] = metric
+		}
+		if metric == nil {
+			continue
+		}
+		h.Metric = metric
+		relabeled = append(relabeled, h)
+	}
+	if dropped := len(histograms) - len(relabeled); dropped > 0 {
+		droppedSamples.WithLabelValues(w.Name()).Add(float64(dropped))
+	}
+	return writeHistograms(w.writer, relabeled)
+}
+
+// WriteExemplars relabels the series of the exemplars and writes the
+// exemplars of the ones which weren't dropped.
+func (w relabelWriter) WriteExemplars(series []exemplar.Series) error {
+	relabeled := make([]exemplar.Series, 0, len(series))
+	for _, s := range series {
+		metric := relabelMetric(model.Metric(s.SeriesLabels), w.configs)
+		if metric == nil {
+			continue
+		}
+		s.SeriesLabels = model.LabelSet(metric)
+		relabeled = append(relabeled, s)
+	}
+	return writeExemplars(w.writer, relabeled)
+}
+
+// WriteMetadata relabels the names of the metric families and writes the
+// metadata of the ones which weren't dropped. Only relabeling rules on the
+// metric name apply, as metadata has no other labels.
+func (w relabelWriter) WriteMetadata(families []metadata.Family) error {
+	relabeled := make([]metadata.Family, 0, len(families))
+	for _, f := range families {
+		metric := relabelMetric(model.Metric{model.MetricNameLabel: model.LabelValue(f.Name)}, w.configs)
+		if metric == nil || metric[model.MetricNameLabel] == "" {
+			continue
+		}
+		f.Name = string(metric[model.MetricNameLabel])
+		relabeled = append(relabeled, f)
+	}
+	return writeMetadata(w.writer, relabeled)
+}
+
+// relabelSamples returns the samples with their metrics relabeled by the
+// given configs. Samples whose metric is dropped are left out. The input
+// samples are not modified.
+func relabelSamples(samples model.Samples, configs []*relabel.Config) model.Samples {
+	// Samples of the same series share their metric, so only relabel each
+	// series once.
+	cache := map[model.Fingerprint]model.Metric{}
+	result := make(model.Samples, 0, len(samples))
+	for _, s := range samples {
+		fp := s.Metric.Fingerprint()
+		metric, ok := cache[fp]
+		if !ok {
+			metric = relabelMetric(s.Metric, configs)
+			cache[fp] = metric
+		}
+		if metric == nil {
+			continue
+		}
+		result = append(result, &model.Sample{
+			Metric:    metric,
+			Value:     s.Value,
+			Timestamp: s.Timestamp,
+		})
+	}
+	return result
+}
+
+// relabelMetric relabels a metric, returning nil if it is dropped.
+func relabelMetric(m model.Metric, configs []*relabel.Config) model.Metric {
+	ls := make(labels.Labels, 0, len(m))
+	for l, v := range m {
+		ls = append(ls, labels.Label{Name: string(l), Value: string(v)})
+	}
+	ls = relabel.Process(labels.New(ls...), configs...)
+	if ls == nil {
+		return nil
+	}
+	metric := make(model.Metric, len(ls))
+	for _, l := range ls {
+		metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+	}
+	return metric
+}
@@ -0,0 +1,171 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+
+	"github.com/prometheus/prometheus/pkg/relabel"
+
+	"histogram"
+	"metadata"
+)
+
+func TestRelabelWriter(t *testing.T) {
+	var configs []*relabel.Config
+	if err := yaml.UnmarshalStrict([]byte(`
+- source_labels: [__name__]
+  regex: go_.*
+  action: drop
+- regex: instance
+  action: labeldrop
+- source_labels: [job]
+  target_label: service
+`), &configs); err != nil {
+		t.Fatal(err)
+	}
+
+	up := model.Metric{model.MetricNameLabel: "up", "job": "node", "instance": "a:9100"}
+	samples := model.Samples{
+		{Metric: up, Value: 1, Timestamp: 1},
+		{Metric: model.Metric{model.MetricNameLabel: "go_goroutines", "job": "node"}, Value: 10, Timestamp: 1},
+		{Metric: up, Value: 0, Timestamp: 2},
+	}
+
+	var (
+		written model.Samples
+		calls   int
+	)
+	w := newRelabelWriter(writerFunc(func(s model.Samples) error {
+		written = s
+		calls++
+		return nil
+	}), configs)
+	if err := w.Write(samples); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	relabeled := model.Metric{model.MetricNameLabel: "up", "job": "node", "service": "node"}
+	expected := model.Samples{
+		{Metric: relabeled, Value: 1, Timestamp: 1},
+		{Metric: relabeled, Value: 0, Timestamp: 2},
+	}
+	if !reflect.DeepEqual(written, expected) {
+		t.Errorf("Expected %v, got %v", expected, written)
+	}
+	if _, ok := up["service"]; ok || up["instance"] != "a:9100" {
+		t.Errorf("Input metric was modified: %v", up)
+	}
+
+	calls = 0
+	if err := w.Write(samples[1:2]); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if calls != 0 {
+		t.Errorf("Expected no write when all samples are dropped, got %d calls", calls)
+	}
+}
+
+func TestRelabelWriterHistograms(t *testing.T) {
+	var configs []*relabel.Config
+	if err := yaml.UnmarshalStrict([]byte(`
+- source_labels: [__name__]
+  regex: go_.*
+  action: drop
+- regex: instance
+  action: labeldrop
+`), &configs); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &histogram.Histogram{Schema: -53, Count: 1, PositiveSpans: []histogram.Span{{Offset: 0, Length: 1}}, PositiveBuckets: []float64{1}}
+	fw := &fakeWriter{}
+	w := newRelabelWriter(fw, configs).(histogramWriter)
+	if err := w.WriteHistograms([]histogram.Sample{
+		{Metric: model.Metric{model.MetricNameLabel: "rpc_seconds", "instance": "a:9100"}, Histogram: h},
+		{Metric: model.Metric{model.MetricNameLabel: "go_gc_seconds"}, Histogram: h},
+	}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// The fake writer doesn't store native histograms, so it gets the
+	// relabeled classic histogram.
+	expected := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "rpc_seconds_bucket", model.BucketLabel: "+Inf"}, Value: 1},
+		{Metric: model.Metric{model.MetricNameLabel: "rpc_seconds_sum"}, Value: 0},
+		{Metric: model.Metric{model.MetricNameLabel: "rpc_seconds_count"}, Value: 1},
+	}
+	if !reflect.DeepEqual(fw.written, expected) {
+		t.Errorf("Expected %v, got %v", expected, fw.written)
+	}
+}
+
+type fakeMetadataWriter struct {
+	fakeWriter
+	families []metadata.Family
+}
+
+func (w *fakeMetadataWriter) WriteMetadata(families []metadata.Family) error {
+	w.families = append(w.families, families...)
+	return nil
+}
+
+func TestRelabelWriterMetadata(t *testing.T) {
+	var configs []*relabel.Config
+	if err := yaml.UnmarshalStrict([]byte(`
+- source_labels: [__name__]
+  regex: go_.*
+  action: drop
+- source_labels: [__name__]
+  regex: (.*)
+  target_label: __name__
+  replacement: app_$1
+`), &configs); err != nil {
+		t.Fatal(err)
+	}
+
+	fw := &fakeMetadataWriter{}
+	w := newRelabelWriter(fw, configs).(metadataWriter)
+	if err := w.WriteMetadata([]metadata.Family{
+		{Name: "up", Metadata: metadata.Metadata{Type: "gauge"}},
+		{Name: "go_goroutines", Metadata: metadata.Metadata{Type: "gauge"}},
+	}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []metadata.Family{{Name: "app_up", Metadata: metadata.Metadata{Type: "gauge"}}}
+	if !reflect.DeepEqual(fw.families, expected) {
+		t.Errorf("Expected %v, got %v", expected, fw.families)
+	}
+}
+
+func TestNewRelabelWriterWithoutConfigs(t *testing.T) {
+	fw := &fakeWriter{}
+	if w := newRelabelWriter(fw, nil); w != writer(fw) {
+		t.Errorf("Expected writer to be returned as is, got %v", w)
+	}
+}
+
+type writerFunc func(model.Samples) error
+
+func (f writerFunc) Write(samples model.Samples) error {
+	return f(samples)
+}
+
+func (f writerFunc) Name() string {
+	return "func"
+}
@@ -0,0 +1,704 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"exemplar"
+	"histogram"
+	"metadata"
+	"queue"
+)
+
+// remoteStorage holds the clients of a remote storage built from its
+// configuration.
+type remoteStorage struct {
+	config    storageConfig
+	writer    writer
+	reader    reader
+	collector prometheus.Collector
+	// closer, if set, releases the resources of the clients once the
+	// remote storage is no longer used.
+	closer io.Closer
+
+	// refs counts the storage sets holding the remote storage.
+	refs int64
+}
+
+// close releases the resources of the clients of the remote storage.
+func (rs *remoteStorage) close(logger log.Logger) {
+	if rs.closer == nil {
+		return
+	}
+	if err := rs.closer.Close(); err != nil {
+		level.Warn(logger).Log("msg", "Failed to close remote storage", "storage", rs.config.name(), "err", err)
+	}
+}
+
+// storageSet is a set of remote storages along with the writers and readers
+// requests use them with. Requests hold the set while they use it, so that
+// the storages of a set which was replaced are only closed once the requests
+// which started before are done.
+type storageSet struct {
+	logger   log.Logger
+	storages []*remoteStorage
+	writers  []writer
+	readers  []reader
+	// refs counts the requests holding the set, plus one until the set is
+	// replaced.
+	refs int64
+	// used is the time in Unix nanoseconds at which the set of a tenant
+	// was last acquired.
+	used int64
+}
+
+func newStorageSet(logger log.Logger, storages []*remoteStorage, writers []writer, readers []reader) *storageSet {
+	for _, rs := range storages {
+		atomic.AddInt64(&rs.refs, 1)
+	}
+	return &storageSet{
+		logger:   logger,
+		storages: storages,
+		writers:  writers,
+		readers:  readers,
+		refs:     1,
+	}
+}
+
+// acquire holds the set for a request. It must only be called while the set
+// is in use, that is while holding the mutex of the storages it belongs to.
+func (set *storageSet) acquire() *storageSet {
+	atomic.AddInt64(&set.refs, 1)
+	return set
+}
+
+// release releases the set once a request is done with it, or once it was
+// replaced. The remote storages which are no longer held by any set are
+// closed when the set is released for the last time.
+func (set *storageSet) release() {
+	if atomic.AddInt64(&set.refs, -1) > 0 {
+		return
+	}
+	for _, rs := range set.storages {
+		if atomic.AddInt64(&rs.refs, -1) == 0 {
+			rs.close(set.logger)
+		}
+	}
+}
+
+// namedWriter overrides the name of a writer with the configured name of its
+// remote storage.
+type namedWriter struct {
+	writer
+	name string
+}
+
+func (w namedWriter) Name() string {
+	return w.name
+}
+
+func (w namedWriter) WriteHistograms(histograms []histogram.Sample) error {
+	return writeHistograms(w.writer, histograms)
+}
+
+func (w namedWriter) WriteExemplars(series []exemplar.Series) error {
+	return writeExemplars(w.writer, series)
+}
+
+func (w namedWriter) WriteMetadata(families []metadata.Family) error {
+	return writeMetadata(w.writer, families)
+}
+
+// namedReader overrides the name of a reader with the configured name of its
+// remote storage.
+type namedReader struct {
+	reader
+	name string
+}
+
+func (r namedReader) Name() string {
+	return r.name
+}
+
+func (r namedReader) ReadStream(req *prompb.ReadRequest, send func(int, *prompb.TimeSeries) error) error {
+	return readStream(r.reader, req, send)
+}
+
+func (r namedReader) ReadExemplars(q *prompb.Query) ([]exemplar.Series, error) {
+	return readExemplars(r.reader, q)
+}
+
+// storages holds the remote storages currently in use. The storages are
+// rebuilt when the configuration is reloaded, while requests which are in
+// flight keep using the storages they started with until they are done.
+type storages struct {
+	logger log.Logger
+	cfg    *config
+	// cache, if set, caches the results of the readers.
+	cache *readCache
+
+	// reloadMtx serializes reloads, mtx protects the fields below.
+	reloadMtx sync.Mutex
+	mtx       sync.RWMutex
+	fc        *fileConfig
+	byName    map[string]*remoteStorage
+	current   *storageSet
+	queues    map[queueKey]*queue.Queue
+	// tenants holds the storages of each tenant, which are built from the
+	// current configuration when the tenant is first seen.
+	tenants map[string]*storageSet
+}
+
+func newStorages(logger log.Logger, cfg *config, cache *readCache) *storages {
+	return &storages{
+		logger:  logger,
+		cfg:     cfg,
+		cache:   cache,
+		fc:      &fileConfig{},
+		byName:  map[string]*remoteStorage{},
+		current: newStorageSet(logger, nil, nil, nil),
+		queues:  map[queueKey]*queue.Queue{},
+		tenants: map[string]*storageSet{},
+	}
+}
+
+// queueKey identifies the on-disk queue of a remote storage for a tenant,
+// which is empty for the queues of requests without a tenant.
+type queueKey struct {
+	name   string
+	tenant string
+}
+
+// forTenant returns the storages of a tenant, or the ones currently in use if
+// tenant is empty. The set must be released once the request is done with
+// it.
+func (s *storages) forTenant(tenant string) (*storageSet, error) {
+	s.mtx.RLock()
+	set, ok := s.current, true
+	if tenant != "" {
+		set, ok = s.tenants[tenant]
+	}
+	if ok {
+		set.acquire()
+		atomic.StoreInt64(&set.used, time.Now().UnixNano())
+	}
+	s.mtx.RUnlock()
+	if ok {
+		return set, nil
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if set, ok := s.tenants[tenant]; ok {
+		atomic.StoreInt64(&set.used, time.Now().UnixNano())
+		return set.acquire(), nil
+	}
+	if s.cfg.tenantMaxActive > 0 && len(s.tenants) >= s.cfg.tenantMaxActive {
+		s.evictTenant()
+	}
+	var built []*remoteStorage
+	for _, sc := range s.fc.storages() {
+		tsc, err := sc.forTenant(tenant, s.fc.Tenants[tenant])
+		if err == nil {
+			var rs *remoteStorage
+			if rs, err = tsc.build(s.logger); err == nil {
+				built = append(built, rs)
+				continue
+			}
+			err = errors.Wrapf(err, "failed to build remote storages of tenant %q", tenant)
+		}
+		for _, rs := range built {
+			rs.close(s.logger)
+		}
+		return nil, err
+	}
+	var (
+		writers []writer
+		readers []reader
+	)
+	for _, rs := range built {
+		if s.cfg.queueDir == "" {
+			writers = append(writers, rs.writer)
+			continue
+		}
+		k := queueKey{name: rs.config.name(), tenant: tenant}
+		q, ok := s.queues[k]
+		if !ok {
+			var err error
+			if q, err = s.openQueue(k); err != nil {
+				for _, rs := range built {
+					rs.close(s.logger)
+				}
+				return nil, err
+			}
+			s.queues[k] = q
+			s.startQueue(k, q)
+		}
+		writers = append(writers, &queuedWriter{writer: rs.writer, queue: q})
+	}
+	for _, rs := range built {
+		if rs.reader != nil {
+			readers = append(readers, s.cachedReader(tenant, rs))
+		}
+		if rs.collector != nil {
+			if err := storageRegisterer(rs.config.name(), tenant).Register(rs.collector); err != nil {
+				level.Warn(s.logger).Log("msg", "Failed to register metrics of remote storage", "storage", rs.config.name(), "tenant", tenant, "err", err)
+			}
+		}
+	}
+	set = newStorageSet(s.logger, built, writers, readers)
+	set.used = time.Now().UnixNano()
+	s.tenants[tenant] = set
+	return set.acquire(), nil
+}
+
+// evictTenant removes the storages of the least recently seen tenant. They
+// are closed once the requests using them are done, and created again when
+// the tenant is next seen. The queues of the tenant are removed as well if
+// they are empty and no request uses them, otherwise they keep being
+// drained. It must be called with mtx held.
+func (s *storages) evictTenant() {
+	var (
+		oldest string
+		used   int64
+	)
+	for tenant, set := range s.tenants {
+		if u := atomic.LoadInt64(&set.used); oldest == "" || u < used {
+			oldest, used = tenant, u
+		}
+	}
+	if oldest == "" {
+		return
+	}
+	level.Debug(s.logger).Log("msg", "Closing remote storages of least recently seen tenant", "tenant", oldest)
+	set := s.tenants[oldest]
+	if atomic.LoadInt64(&set.refs) == 1 {
+		for k, q := range s.queues {
+			if k.tenant == oldest && q.Len() == 0 {
+				delete(s.queues, k)
+				s.removeQueue(k, q)
+			}
+		}
+	}
+	s.removeTenant(oldest, set)
+	delete(s.tenants, oldest)
+}
+
+// removeTenant unregisters the metrics of the remote storages of a tenant
+// which are no longer in use, and releases them.
+func (s *storages) removeTenant(tenant string, set *storageSet) {
+	for _, rs := range set.storages {
+		if rs.collector != nil {
+			storageRegisterer(rs.config.name(), tenant).Unregister(rs.collector)
+		}
+	}
+	set.release()
+}
+
+// readLimitedConfig is implemented by the configurations of remote storages
+// which may limit their reads.
+type readLimitedConfig interface {
+	readLimited() bool
+}
+
+// cachedReader returns the reader of a remote storage of a tenant, behind
+// the read cache if there is one. The reads of storages with read limits
+// aren't cached, as the results served from the cache wouldn't be counted
+// against the limits.
+func (s *storages) cachedReader(tenant string, rs *remoteStorage) reader {
+	if s.cache == nil {
+		return rs.reader
+	}
+	if lc, ok := rs.config.(readLimitedConfig); ok && lc.readLimited() {
+		return rs.reader
+	}
+	scope, err := cacheScope(tenant, rs.config)
+	if err != nil {
+		level.Warn(s.logger).Log("msg", "Failed to identify cached read results, not caching them", "storage", rs.config.name(), "tenant", tenant, "err", err)
+		return rs.reader
+	}
+	cr := cachingReader{reader: rs.reader, cache: s.cache, scope: scope}
+	if s.cfg.queueDir != "" {
+		k := queueKey{name: rs.config.name(), tenant: tenant}
+		cr.queued = func() bool { return s.queueLen(k) > 0 }
+	}
+	return cr
+}
+
+// queueLen returns the number of samples in a queue which weren't sent yet.
+func (s *storages) queueLen(k queueKey) int {
+	s.mtx.RLock()
+	q, ok := s.queues[k]
+	s.mtx.RUnlock()
+	if !ok {
+		return 0
+	}
+	return q.Len()
+}
+
+// writer returns the current writer of the remote storage of a queue,
+// bypassing the queue, along with the set holding it, which must be released
+// once done with the writer. The writer is nil if there is no such storage.
+//
+// Draining the queue of a tenant doesn't count as seeing the tenant, as that
+// could evict the storages of active tenants over and over. The storages of
+// the tenant are used if they are active, otherwise the storage is built on
+// its own for the batch, without registering its metrics.
+func (s *storages) writer(k queueKey) (writer, *storageSet, error) {
+	s.mtx.RLock()
+	set, ok := s.current, true
+	if k.tenant != "" {
+		set, ok = s.tenants[k.tenant]
+	}
+	if ok {
+		set.acquire()
+	}
+	fc := s.fc
+	s.mtx.RUnlock()
+	if ok {
+		for _, rs := range set.storages {
+			if rs.config.name() == k.name {
+				return rs.writer, set, nil
+			}
+		}
+		set.release()
+		return nil, nil, nil
+	}
+
+	for _, sc := range fc.storages() {
+		if sc.name() != k.name {
+			continue
+		}
+		tsc, err := sc.forTenant(k.tenant, fc.Tenants[k.tenant])
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to build remote storage of tenant %q", k.tenant)
+		}
+		rs, err := tsc.build(s.logger)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to build remote storage of tenant %q", k.tenant)
+		}
+		return rs.writer, newStorageSet(s.logger, []*remoteStorage{rs}, nil, nil), nil
+	}
+	return nil, nil, nil
+}
+
+// reload reads the configuration file, or the command-line flags if there is
+// none, and applies it.
+func (s *storages) reload() (err error) {
+	defer func() {
+		if err != nil {
+			configSuccess.Set(0)
+			return
+		}
+		configSuccess.Set(1)
+		configSuccessTime.SetToCurrentTime()
+	}()
+
+	fc := fileConfigFromFlags(s.cfg)
+	if s.cfg.configFile != "" {
+		if fc, err = loadConfigFile(s.cfg.configFile, s.cfg.remoteTimeout); err != nil {
+			return err
+		}
+	}
+	return s.apply(fc)
+}
+
+// apply replaces the remote storages with the ones of the given
+// configuration. Storages whose configuration didn't change are kept as they
+// are. If any storage fails to build, the current ones are left in place.
+func (s *storages) apply(fc *fileConfig) error {
+	s.reloadMtx.Lock()
+	defer s.reloadMtx.Unlock()
+
+	var (
+		byName  = map[string]*remoteStorage{}
+		added   []*remoteStorage
+		inUse   []*remoteStorage
+		writers []writer
+		readers []reader
+	)
+	for _, sc := range fc.storages() {
+		name := sc.name()
+		rs, ok := s.byName[name]
+		if !ok || !reflect.DeepEqual(rs.config, sc) {
+			var err error
+			if rs, err = sc.build(s.logger); err != nil {
+				return err
+			}
+			added = append(added, rs)
+		}
+		byName[name] = rs
+		inUse = append(inUse, rs)
+		if rs.reader != nil {
+			readers = append(readers, s.cachedReader("", rs))
+		}
+	}
+
+	// Open the queues of new storages before touching anything else, so
+	// that a failure leaves the current storages in place.
+	queues := map[queueKey]*queue.Queue{}
+	opened := map[queueKey]*queue.Queue{}
+	if s.cfg.queueDir != "" {
+		for name := range byName {
+			k := queueKey{name: name}
+			s.mtx.RLock()
+			q, ok := s.queues[k]
+			s.mtx.RUnlock()
+			if !ok {
+				var err error
+				if q, err = s.openQueue(k); err != nil {
+					for _, q := range opened {
+						q.Close()
+					}
+					return err
+				}
+				opened[k] = q
+			}
+			queues[k] = q
+		}
+	}
+	for _, sc := range fc.storages() {
+		rs := byName[sc.name()]
+		if q, ok := queues[queueKey{name: sc.name()}]; ok {
+			writers = append(writers, &queuedWriter{writer: rs.writer, queue: q})
+		} else {
+			writers = append(writers, rs.writer)
+		}
+	}
+
+	// The storages of tenants are rebuilt from the new configuration when
+	// they are next used, while their queues are kept as long as their
+	// remote storage is. The replaced storages are closed once the
+	// requests using them are done.
+	set := newStorageSet(s.logger, inUse, writers, readers)
+	removedQueues := map[queueKey]*queue.Queue{}
+	s.mtx.Lock()
+	old, oldSet, oldTenants := s.byName, s.current, s.tenants
+	for k, q := range s.queues {
+		if _, ok := byName[k.name]; !ok {
+			removedQueues[k] = q
+		} else if k.tenant != "" {
+			queues[k] = q
+		}
+	}
+	s.fc, s.byName, s.current, s.queues = fc, byName, set, queues
+	s.tenants = map[string]*storageSet{}
+	s.mtx.Unlock()
+
+	for tenant, ts := range oldTenants {
+		s.removeTenant(tenant, ts)
+	}
+
+	for name, rs := range old {
+		if byName[name] != rs && rs.collector != nil {
+			storageRegisterer(name, "").Unregister(rs.collector)
+		}
+	}
+	oldSet.release()
+	for _, rs := range added {
+		if rs.collector != nil {
+			if err := storageRegisterer(rs.config.name(), "").Register(rs.collector); err != nil {
+				level.Warn(s.logger).Log("msg", "Failed to register metrics of remote storage", "storage", rs.config.name(), "err", err)
+			}
+		}
+	}
+	for k, q := range opened {
+		s.startQueue(k, q)
+	}
+	for k, q := range removedQueues {
+		s.closeQueue(k, q)
+	}
+	if s.cfg.queueDir != "" {
+		s.openTenantQueues()
+	}
+	return nil
+}
+
+// queuePath returns the directory of a queue. The queues of the tenants of a
+// remote storage are kept below its own queue, which ignores subdirectories.
+func (s *storages) queuePath(k queueKey) string {
+	if k.tenant == "" {
+		return filepath.Join(s.cfg.queueDir, k.name)
+	}
+	return filepath.Join(s.cfg.queueDir, k.name, "tenants", k.tenant)
+}
+
+// openQueue opens a queue, which must then be started with startQueue.
+func (s *storages) openQueue(k queueKey) (*queue.Queue, error) {
+	logger := log.With(s.logger, "queue", k.name)
+	if k.tenant != "" {
+		logger = log.With(logger, "tenant", k.tenant)
+	}
+	q, err := queue.Open(logger, s.queuePath(k), k.name, int64(s.cfg.queueMaxSize), int64(s.cfg.queueSegmentSize))
+	if err != nil {
+		if k.tenant != "" {
+			return nil, errors.Wrapf(err, "failed to open queue of %s for tenant %q", k.name, k.tenant)
+		}
+		return nil, errors.Wrapf(err, "failed to open queue of %s", k.name)
+	}
+	return q, nil
+}
+
+// startQueue registers the metrics of a queue and starts draining it.
+func (s *storages) startQueue(k queueKey, q *queue.Queue) {
+	if err := queueRegisterer(k.tenant).Register(q); err != nil {
+		level.Warn(s.logger).Log("msg", "Failed to register metrics of queue", "storage", k.name, "tenant", k.tenant, "err", err)
+	}
+	go s.drainQueue(k, q)
+}
+
+// closeQueue unregisters the metrics of a queue and closes it, which stops
+// draining it. Its samples are kept on disk.
+func (s *storages) closeQueue(k queueKey, q *queue.Queue) {
+	queueRegisterer(k.tenant).Unregister(q)
+	if err := q.Close(); err != nil {
+		level.Warn(s.logger).Log("msg", "Failed to close queue", "storage", k.name, "tenant", k.tenant, "err", err)
+	}
+}
+
+// removeQueue closes an empty queue of a tenant and removes it from disk.
+func (s *storages) removeQueue(k queueKey, q *queue.Queue) {
+	s.closeQueue(k, q)
+	if err := os.RemoveAll(s.queuePath(k)); err != nil {
+		level.Warn(s.logger).Log("msg", "Failed to remove queue", "storage", k.name, "tenant", k.tenant, "err", err)
+	}
+}
+
+// openTenantQueues opens the queues of tenants found on disk which aren't
+// open yet, so that the samples they hold are sent even if the tenant isn't
+// seen again. Empty queues are removed instead.
+func (s *storages) openTenantQueues() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for name := range s.byName {
+		dirs, err := ioutil.ReadDir(filepath.Join(s.cfg.queueDir, name, "tenants"))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				level.Warn(s.logger).Log("msg", "Failed to list queues of tenants", "storage", name, "err", err)
+			}
+			continue
+		}
+		for _, d := range dirs {
+			k := queueKey{name: name, tenant: d.Name()}
+			if _, ok := s.queues[k]; ok || !d.IsDir() {
+				continue
+			}
+			q, err := s.openQueue(k)
+			if err != nil {
+				level.Warn(s.logger).Log("msg", "Failed to open queue of tenant", "storage", name, "tenant", k.tenant, "err", err)
+				continue
+			}
+			if q.Len() == 0 {
+				q.Close()
+				if err := os.RemoveAll(s.queuePath(k)); err != nil {
+					level.Warn(s.logger).Log("msg", "Failed to remove queue", "storage", name, "tenant", k.tenant, "err", err)
+				}
+				continue
+			}
+			s.queues[k] = q
+			s.startQueue(k, q)
+		}
+	}
+}
+
+// storageRegisterer returns a registerer which labels the metrics of the
+// named remote storage and its tenant, so that several storages of the same
+// type can be registered at once. The tenant is empty for the storages of
+// requests without a tenant.
+func storageRegisterer(name, tenant string) prometheus.Registerer {
+	return prometheus.WrapRegistererWith(prometheus.Labels{"remote": name, "tenant": tenant}, prometheus.DefaultRegisterer)
+}
+
+// queueRegisterer returns a registerer which labels the metrics of queues
+// with their tenant. Queues label their metrics with their storage
+// themselves.
+func queueRegisterer(tenant string) prometheus.Registerer {
+	return prometheus.WrapRegistererWith(prometheus.Labels{"tenant": tenant}, prometheus.DefaultRegisterer)
+}
+
+// queuedWriter is a writer whose samples are stored in an on-disk queue
+// before being sent to the remote storage in the background.
+type queuedWriter struct {
+	writer
+	queue *queue.Queue
+}
+
+// errStorageRemoved is returned when sending queued samples to a remote
+// storage which was removed from the configuration.
+var errStorageRemoved = errors.New("remote storage was removed")
+
+// drainQueue sends the queued samples of a remote storage until the queue is
+// closed. Batches which fail with a recoverable error are retried until they
+// succeed, others are dropped.
+func (s *storages) drainQueue(k queueKey, q *queue.Queue) {
+	for {
+		samples, err := q.Next()
+		if err == queue.ErrClosed {
+			return
+		}
+		if err != nil {
+			level.Error(s.logger).Log("msg", "Error reading samples from queue, skipping batch", "err", err, "storage", k.name, "tenant", k.tenant)
+		} else if err := s.sendQueued(k, samples); err == errStorageRemoved {
+			// Keep the batch for when the storage is added again.
+			return
+		} else if err != nil {
+			level.Error(s.logger).Log("msg", "Dropping queued samples which failed with an unrecoverable error", "err", err, "storage", k.name, "tenant", k.tenant, "num_samples", len(samples))
+		}
+		if err := q.Commit(); err != nil {
+			level.Error(s.logger).Log("msg", "Error committing queued samples", "err", err, "storage", k.name, "tenant", k.tenant)
+		}
+	}
+}
+
+// sendQueued sends queued samples to the remote storage of a queue, retrying
+// recoverable errors until they succeed. The storage is looked up again for
+// every try, so that configuration changes apply to batches being retried.
+func (s *storages) sendQueued(k queueKey, samples model.Samples) error {
+	b := backoff{min: s.cfg.sendMinBackoff, max: s.cfg.sendMaxBackoff}
+	for {
+		w, set, err := s.writer(k)
+		if err != nil {
+			level.Warn(s.logger).Log("msg", "Failed to get remote storages for queued samples, retrying", "storage", k.name, "tenant", k.tenant, "err", err)
+			time.Sleep(b.next())
+			continue
+		}
+		if w == nil {
+			return errStorageRemoved
+		}
+		err = sendSamples(s.logger, w, samples)
+		set.release()
+		if err == nil || !isRecoverable(err) {
+			countSent(w, k.tenant, samples, err)
+			return err
+		}
+		retriedSamples.WithLabelValues(k.name).Add(float64(len(samples)))
+		time.Sleep(b.next())
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"queue"
+)
+
+// countingCloser counts how often it is closed.
+type countingCloser struct {
+	closed int
+}
+
+func (c *countingCloser) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestStorageSetRelease(t *testing.T) {
+	kept, removed := &countingCloser{}, &countingCloser{}
+	keptStorage, removedStorage := &remoteStorage{closer: kept}, &remoteStorage{closer: removed}
+
+	old := newStorageSet(log.NewNopLogger(), []*remoteStorage{keptStorage, removedStorage}, nil, nil)
+	// A request in flight while the set is replaced by one without the
+	// removed storage.
+	old.acquire()
+	current := newStorageSet(log.NewNopLogger(), []*remoteStorage{keptStorage}, nil, nil)
+	old.release()
+	if removed.closed != 0 {
+		t.Fatal("Expected the removed storage to stay open while a request uses it")
+	}
+
+	old.release()
+	if removed.closed != 1 || kept.closed != 0 {
+		t.Errorf("Expected only the removed storage to be closed, got %d and %d closes", removed.closed, kept.closed)
+	}
+
+	current.release()
+	if removed.closed != 1 || kept.closed != 1 {
+		t.Errorf("Expected each storage to be closed once, got %d and %d closes", removed.closed, kept.closed)
+	}
+}
+
+func TestTenantEviction(t *testing.T) {
+	s := newStorages(log.NewNopLogger(), &config{tenantMaxActive: 2}, nil)
+	err := s.apply(&fileConfig{OpenTSDB: []*opentsdbConfig{{Name: "tsdb", URL: "http://localhost:4242", TenantTag: "tenant"}}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	for _, tenant := range []string{"a", "b"} {
+		if _, err := s.forTenant(tenant); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	// b was seen least recently and still has a request in flight.
+	s.tenants["a"].used, s.tenants["b"].used = 2, 1
+	a, b := s.tenants["a"], s.tenants["b"]
+	a.release()
+
+	if _, err := s.forTenant("c"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, ok := s.tenants["b"]; ok || len(s.tenants) != 2 {
+		t.Fatalf("Expected b to be evicted, got tenants %v", s.tenants)
+	}
+	if b.storages[0].refs != 1 {
+		t.Fatalf("Expected the storage of b to stay open while it is used, got %d references", b.storages[0].refs)
+	}
+	b.release()
+	if b.storages[0].refs != 0 {
+		t.Errorf("Expected the storage of b to be closed, got %d references", b.storages[0].refs)
+	}
+
+	// b gets new storages when it is seen again.
+	set, err := s.forTenant("b")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if set == b {
+		t.Error("Expected new storages for b")
+	}
+}
+
+func TestTenantQueues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config{tenantMaxActive: 1, queueDir: dir, queueMaxSize: 1 << 20, queueSegmentSize: 1 << 16}
+	s := newStorages(log.NewNopLogger(), cfg, nil)
+	err = s.apply(&fileConfig{OpenTSDB: []*opentsdbConfig{{Name: "tsdb", URL: "http://localhost:4242", TenantTag: "tenant"}}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	set, err := s.forTenant("a")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	qw, ok := set.writers[0].(*queuedWriter)
+	if !ok {
+		t.Fatalf("Expected the writer of a tenant to be queued, got %T", set.writers[0])
+	}
+	queueDir := filepath.Join(dir, "tsdb", "tenants", "a")
+	if _, err := os.Stat(queueDir); err != nil {
+		t.Fatalf("Expected the queue of the tenant in %s: %s", queueDir, err)
+	}
+	set.release()
+
+	// The empty queue of a is removed along with its storages.
+	if _, err := s.forTenant("b"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, ok := s.queues[queueKey{name: "tsdb", tenant: "a"}]; ok {
+		t.Error("Expected the queue of a to be closed")
+	}
+	if _, err := qw.queue.Next(); err != queue.ErrClosed {
+		t.Errorf("Expected the queue of a to be closed, got %v", err)
+	}
+	if _, err := os.Stat(queueDir); !os.IsNotExist(err) {
+		t.Errorf("Expected the queue of a to be removed, got %v", err)
+	}
+}
+
+func TestDrainInactiveTenantQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Samples stay queued as long as OpenTSDB fails.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	cfg := &config{
+		tenantMaxActive:  1,
+		queueDir:         dir,
+		queueMaxSize:     1 << 20,
+		queueSegmentSize: 1 << 16,
+		sendMinBackoff:   time.Millisecond,
+		sendMaxBackoff:   10 * time.Millisecond,
+	}
+	s := newStorages(log.NewNopLogger(), cfg, nil)
+	err = s.apply(&fileConfig{OpenTSDB: []*opentsdbConfig{{Name: "tsdb", URL: server.URL, TenantTag: "tenant"}}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.apply(&fileConfig{})
+
+	for _, tenant := range []string{"a", "b"} {
+		set, err := s.forTenant(tenant)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		samples := model.Samples{{Metric: model.Metric{model.MetricNameLabel: "up"}, Value: 1, Timestamp: 1000}}
+		if err := set.writers[0].(*queuedWriter).queue.Append(samples); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		set.release()
+	}
+
+	s.mtx.RLock()
+	b := s.tenants["b"]
+	used := b.used
+	s.mtx.RUnlock()
+
+	// Sending the queued samples of a leaves b active.
+	w, set, err := s.writer(queueKey{name: "tsdb", tenant: "a"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if w == nil {
+		t.Fatal("Expected a writer for the queue of a")
+	}
+	set.release()
+
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if len(s.tenants) != 1 || s.tenants["b"] != b {
+		t.Errorf("Expected the storages of b to stay active, got %v", s.tenants)
+	}
+	if b.used != used {
+		t.Error("Expected draining queues not to count as seeing b")
+	}
+}
+
+func TestCachedReaderWithReadLimits(t *testing.T) {
+	const hour = int64(time.Hour / time.Millisecond)
+	now := 100 * hour
+	cache, err := newReadCache(log.NewNopLogger(), time.Hour, 0, 1<<20, "", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cache.now = func() time.Time { return time.Unix(0, now*int64(time.Millisecond)) }
+	s := newStorages(log.NewNopLogger(), &config{}, cache)
+	r := &rangeReader{series: []*prompb.TimeSeries{minuteSeries("a", 90*hour, now)}, maxRange: 2 * hour}
+	rs := &remoteStorage{config: &influxdbConfig{Name: "influxdb", MaxReadRange: model.Duration(2 * time.Hour)}, reader: r}
+	matchers := []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}}
+
+	// Short queries fill the cache with all buckets of a long one.
+	scope, err := cacheScope("", rs.config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cr := cachingReader{reader: r, cache: cache, scope: scope}
+	for start := 90 * hour; start < 98*hour; start += hour {
+		q := &prompb.Query{StartTimestampMs: start, EndTimestampMs: start + hour - 1, Matchers: matchers}
+		if _, err := cr.Read(&prompb.ReadRequest{Queries: []*prompb.Query{q}}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+
+	// The long query isn't answered from the cache, but rejected by the
+	// time range limit of the storage.
+	if _, ok := s.cachedReader("", rs).(cachingReader); ok {
+		t.Error("Expected the reads of a storage with read limits not to be cached")
+	}
+	q := &prompb.Query{StartTimestampMs: 90 * hour, EndTimestampMs: 98*hour - 1, Matchers: matchers}
+	if _, err := s.cachedReader("", rs).Read(&prompb.ReadRequest{Queries: []*prompb.Query{q}}); !exceedsReadLimit(err) {
+		t.Errorf("Expected a read limit error, got %v", err)
+	}
+}
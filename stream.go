@@ -0,0 +1,208 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gogo/protobuf/proto"
+	"github.com/pkg/errors"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// streamedContentType is the content type of STREAMED_XOR_CHUNKS read
+// responses.
+const streamedContentType = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+
+// samplesPerChunk is the number of samples encoded into each chunk, like
+// the TSDB of Prometheus does.
+const samplesPerChunk = 120
+
+// acceptsStreamedChunks returns whether a read request accepts the
+// STREAMED_XOR_CHUNKS response type, which is then preferred.
+func acceptsStreamedChunks(req *prompb.ReadRequest) bool {
+	for _, t := range req.AcceptedResponseTypes {
+		if t == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+			return true
+		}
+	}
+	return false
+}
+
+// streamRead answers a read request with frames of XOR chunks. If there is a
+// single reader, series are written as the reader returns them; otherwise the
+// results of all readers are merged first, like in readAll.
+func streamRead(logger log.Logger, w http.ResponseWriter, readers []reader, req *prompb.ReadRequest, partial bool, maxBytesInFrame int) (err error) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("streaming is not supported by the response writer")
+	}
+	w.Header().Set("Content-Type", streamedContentType)
+	cw := &chunkedSeriesWriter{w: remote.NewChunkedWriter(w, f), maxBytes: maxBytesInFrame}
+	defer func() {
+		if err != nil && cw.started {
+			err = interruptedStreamError{err}
+		}
+	}()
+
+	if len(readers) == 1 {
+		// The whole request is passed to the reader, so that its read
+		// limits apply to all of its queries together.
+		err := readStream(readers[0], req, func(i int, ts *prompb.TimeSeries) error {
+			// Frames only hold series of a single query.
+			if int64(i) != cw.queryIndex {
+				if err := cw.flush(); err != nil {
+					return err
+				}
+				cw.queryIndex = int64(i)
+			}
+			return cw.write(ts)
+		})
+		if err != nil {
+			failedReads.WithLabelValues(readers[0].Name()).Inc()
+			return errors.Wrapf(err, "error reading from %s", readers[0].Name())
+		}
+		return cw.flush()
+	}
+
+	for i, q := range req.Queries {
+		cw.queryIndex = int64(i)
+		resp, err := readAll(logger, readers, &prompb.ReadRequest{Queries: []*prompb.Query{q}}, partial)
+		if err != nil {
+			return err
+		}
+		for _, res := range resp.Results {
+			for _, ts := range res.Timeseries {
+				if err := cw.write(ts); err != nil {
+					return err
+				}
+			}
+		}
+		// Frames only hold series of a single query.
+		if err := cw.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interruptedStreamError is returned by streamRead for errors which occur
+// once frames were written, when the response can no longer be replaced by
+// an error.
+type interruptedStreamError struct {
+	error
+}
+
+// chunkedSeriesWriter encodes series into XOR chunks and writes them in
+// ChunkedReadResponse frames of at most maxBytes. A frame may end in the
+// middle of a series, whose remaining chunks start the next frame. Frames
+// hold at least one chunk, so a single chunk may exceed maxBytes.
+type chunkedSeriesWriter struct {
+	w          io.Writer
+	maxBytes   int
+	queryIndex int64
+	// started is set once the first frame is written.
+	started bool
+
+	frame      prompb.ChunkedReadResponse
+	frameBytes int
+}
+
+func (cw *chunkedSeriesWriter) write(ts *prompb.TimeSeries) error {
+	chunks, err := encodeChunks(ts.Samples)
+	if err != nil {
+		return err
+	}
+
+	labels := append([]prompb.Label{}, ts.Labels...)
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	labelsBytes := 0
+	for _, l := range labels {
+		labelsBytes += l.Size()
+	}
+
+	var cs *prompb.ChunkedSeries
+	for _, c := range chunks {
+		size := c.Size()
+		if cs == nil {
+			size += labelsBytes
+		}
+		if cw.frameBytes > 0 && cw.frameBytes+size > cw.maxBytes {
+			if err := cw.flush(); err != nil {
+				return err
+			}
+			cs = nil
+		}
+		if cs == nil {
+			cs = &prompb.ChunkedSeries{Labels: labels}
+			cw.frame.ChunkedSeries = append(cw.frame.ChunkedSeries, cs)
+			cw.frameBytes += labelsBytes
+		}
+		cs.Chunks = append(cs.Chunks, c)
+		cw.frameBytes += c.Size()
+	}
+	return nil
+}
+
+// flush writes the current frame, if it holds any series.
+func (cw *chunkedSeriesWriter) flush() error {
+	if len(cw.frame.ChunkedSeries) == 0 {
+		return nil
+	}
+	cw.frame.QueryIndex = cw.queryIndex
+	b, err := proto.Marshal(&cw.frame)
+	if err != nil {
+		return err
+	}
+	cw.started = true
+	if _, err := cw.w.Write(b); err != nil {
+		return err
+	}
+	cw.frame = prompb.ChunkedReadResponse{}
+	cw.frameBytes = 0
+	return nil
+}
+
+// encodeChunks encodes samples, sorted by timestamp, into XOR chunks.
+func encodeChunks(samples []prompb.Sample) ([]prompb.Chunk, error) {
+	var chunks []prompb.Chunk
+	for len(samples) > 0 {
+		n := len(samples)
+		if n > samplesPerChunk {
+			n = samplesPerChunk
+		}
+		c := chunkenc.NewXORChunk()
+		app, err := c.Appender()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range samples[:n] {
+			app.Append(s.Timestamp, s.Value)
+		}
+		chunks = append(chunks, prompb.Chunk{
+			MinTimeMs: samples[0].Timestamp,
+			MaxTimeMs: samples[n-1].Timestamp,
+			Type:      prompb.Chunk_XOR,
+			Data:      c.Bytes(),
+		})
+		samples = samples[n:]
+	}
+	return chunks, nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// decodeChunks returns the samples encoded in XOR chunks.
+func decodeChunks(t *testing.T, chunks []prompb.Chunk) []prompb.Sample {
+	var samples []prompb.Sample
+	for _, c := range chunks {
+		if c.Type != prompb.Chunk_XOR {
+			t.Fatalf("Unexpected chunk encoding %v", c.Type)
+		}
+		xor, err := chunkenc.FromData(chunkenc.EncXOR, c.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		it := xor.Iterator(nil)
+		for it.Next() {
+			ts, v := it.At()
+			samples = append(samples, prompb.Sample{Timestamp: ts, Value: v})
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if c.MinTimeMs != samples[len(samples)-xor.NumSamples()].Timestamp || c.MaxTimeMs != samples[len(samples)-1].Timestamp {
+			t.Errorf("Unexpected time range [%d, %d] of chunk", c.MinTimeMs, c.MaxTimeMs)
+		}
+	}
+	return samples
+}
+
+func testSamples(n int) []prompb.Sample {
+	samples := make([]prompb.Sample, 0, n)
+	for i := 0; i < n; i++ {
+		samples = append(samples, prompb.Sample{Timestamp: int64(i) * 15000, Value: float64(i) / 2})
+	}
+	return samples
+}
+
+func TestEncodeChunks(t *testing.T) {
+	samples := testSamples(300)
+	chunks, err := encodeChunks(samples)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(chunks) != 3 {
+		t.Errorf("Expected 3 chunks, got %d", len(chunks))
+	}
+	if got := decodeChunks(t, chunks); !reflect.DeepEqual(got, samples) {
+		t.Errorf("Expected %v, got %v", samples, got)
+	}
+}
+
+// readFrames decodes the frames of a streamed read response.
+func readFrames(t *testing.T, r io.Reader) []*prompb.ChunkedReadResponse {
+	var frames []*prompb.ChunkedReadResponse
+	cr := remote.NewChunkedReader(r, 1<<20, nil)
+	for {
+		frame := &prompb.ChunkedReadResponse{}
+		err := cr.NextProto(frame)
+		if err == io.EOF {
+			return frames
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func TestStreamRead(t *testing.T) {
+	samples := testSamples(500)
+	r := &fakeReader{
+		name: "influxdb",
+		resp: &prompb.ReadResponse{
+			Results: []*prompb.QueryResult{{Timeseries: []*prompb.TimeSeries{
+				{Labels: []prompb.Label{{Name: "job", Value: "a"}, {Name: "__name__", Value: "up"}}, Samples: samples},
+				{Labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "b"}}, Samples: samples[:1]},
+			}}},
+		},
+	}
+	req := &prompb.ReadRequest{
+		Queries:               []*prompb.Query{{}, {}},
+		AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{prompb.ReadRequest_STREAMED_XOR_CHUNKS},
+	}
+	if !acceptsStreamedChunks(req) {
+		t.Fatal("Expected the request to accept streamed chunks")
+	}
+
+	// Limit frames to about two chunks.
+	chunks, _ := encodeChunks(samples[:samplesPerChunk])
+	w := httptest.NewRecorder()
+	if err := streamRead(log.NewNopLogger(), w, []reader{r}, req, false, 2*chunks[0].Size()+50); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != streamedContentType {
+		t.Errorf("Expected content type %q, got %q", streamedContentType, ct)
+	}
+
+	frames := readFrames(t, w.Body)
+	for i, q := range []int64{0, 1} {
+		var (
+			queryFrames int
+			series      = map[string][]prompb.Sample{}
+			previous    string
+		)
+		for _, f := range frames {
+			if f.QueryIndex != q {
+				continue
+			}
+			queryFrames++
+			for _, cs := range f.ChunkedSeries {
+				if cs.Labels[0].Name != "__name__" {
+					t.Errorf("Expected sorted labels, got %v", cs.Labels)
+				}
+				job := cs.Labels[1].Value
+				if job < previous {
+					t.Errorf("Series %s was continued after series %s", job, previous)
+				}
+				previous = job
+				series[job] = append(series[job], decodeChunks(t, cs.Chunks)...)
+			}
+		}
+		// 5 chunks of job a and 1 of job b, with at most two chunks
+		// per frame.
+		if queryFrames != 3 {
+			t.Errorf("Expected 3 frames for query %d, got %d", i, queryFrames)
+		}
+		if !reflect.DeepEqual(series["a"], samples) || !reflect.DeepEqual(series["b"], samples[:1]) {
+			t.Errorf("Unexpected samples for query %d", i)
+		}
+	}
+}
+
+func TestStreamReadMergesReaders(t *testing.T) {
+	labels := []prompb.Label{{Name: "__name__", Value: "up"}}
+	readers := []reader{
+		&fakeReader{name: "old", resp: &prompb.ReadResponse{Results: []*prompb.QueryResult{{Timeseries: []*prompb.TimeSeries{
+			{Labels: labels, Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}}},
+		}}}}},
+		&fakeReader{name: "new", resp: &prompb.ReadResponse{Results: []*prompb.QueryResult{{Timeseries: []*prompb.TimeSeries{
+			{Labels: labels, Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 1}}},
+		}}}}},
+	}
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{{}}}
+
+	w := httptest.NewRecorder()
+	if err := streamRead(log.NewNopLogger(), w, readers, req, false, 1<<20); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	frames := readFrames(t, w.Body)
+	if len(frames) != 1 || len(frames[0].ChunkedSeries) != 1 {
+		t.Fatalf("Expected a single series, got %v", frames)
+	}
+	expected := []prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 1}}
+	if got := decodeChunks(t, frames[0].ChunkedSeries[0].Chunks); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+// streamingReader streams the series of its fakeReader for every query and
+// records the requests it receives.
+type streamingReader struct {
+	fakeReader
+	reqs []*prompb.ReadRequest
+	// err, if set, is returned once all series were sent.
+	err error
+}
+
+func (r *streamingReader) ReadStream(req *prompb.ReadRequest, send func(int, *prompb.TimeSeries) error) error {
+	r.reqs = append(r.reqs, req)
+	for i := range req.Queries {
+		for _, ts := range r.resp.Results[0].Timeseries {
+			if err := send(i, ts); err != nil {
+				return err
+			}
+		}
+	}
+	return r.err
+}
+
+func TestStreamReadPassesWholeRequest(t *testing.T) {
+	r := &streamingReader{fakeReader: fakeReader{
+		name: "influxdb",
+		resp: &prompb.ReadResponse{Results: []*prompb.QueryResult{{Timeseries: []*prompb.TimeSeries{
+			{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}, Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}}},
+		}}}},
+	}}
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{{}, {}}}
+
+	w := httptest.NewRecorder()
+	if err := streamRead(log.NewNopLogger(), w, []reader{r}, req, false, 1<<20); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// The reader gets all queries at once, so that its limits apply to
+	// them together.
+	if len(r.reqs) != 1 || r.reqs[0] != req {
+		t.Errorf("Expected the reader to get the whole request once, got %v", r.reqs)
+	}
+	frames := readFrames(t, w.Body)
+	if len(frames) != 2 || frames[0].QueryIndex != 0 || frames[1].QueryIndex != 1 {
+		t.Errorf("Expected a frame for each query, got %v", frames)
+	}
+}
+
+func TestStreamReadInterrupted(t *testing.T) {
+	series := []*prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}, Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}}},
+	}
+	for _, test := range []struct {
+		queries     int
+		interrupted bool
+	}{
+		// The error occurs before the frame of the single query is
+		// written, so the response can still be an error.
+		{queries: 1, interrupted: false},
+		// The frame of the first query was written before the error.
+		{queries: 2, interrupted: true},
+	} {
+		r := &streamingReader{
+			fakeReader: fakeReader{name: "influxdb", resp: &prompb.ReadResponse{Results: []*prompb.QueryResult{{Timeseries: series}}}},
+			err:        errors.New("connection reset"),
+		}
+		req := &prompb.ReadRequest{Queries: make([]*prompb.Query, test.queries)}
+		for i := range req.Queries {
+			req.Queries[i] = &prompb.Query{}
+		}
+
+		err := streamRead(log.NewNopLogger(), httptest.NewRecorder(), []reader{r}, req, false, 1<<20)
+		if err == nil {
+			t.Fatalf("%d queries: expected an error, got none", test.queries)
+		}
+		if _, ok := err.(interruptedStreamError); ok != test.interrupted {
+			t.Errorf("%d queries: expected interrupted stream %v, got error %#v", test.queries, test.interrupted, err)
+		}
+	}
+}
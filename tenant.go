@@ -0,0 +1,128 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"metadata"
+)
+
+// Tenant IDs are used in database, bucket and Graphite metric names, so they
+// are restricted to characters which are safe in all of them.
+var tenantIDRE = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// requestTenant returns the tenant of a request, given by the configured
+// tenant header. Requests without a tenant belong to the default storages,
+// unless a tenant is required.
+func requestTenant(r *http.Request, cfg *config) (string, error) {
+	if cfg.tenantHeader == "" {
+		return "", nil
+	}
+	tenant := r.Header.Get(cfg.tenantHeader)
+	if tenant == "" {
+		if cfg.tenantRequired {
+			return "", errors.Errorf("missing tenant in %s header", cfg.tenantHeader)
+		}
+		return "", nil
+	}
+	if !tenantIDRE.MatchString(tenant) {
+		return "", errors.Errorf("invalid tenant ID %q", tenant)
+	}
+	return tenant, nil
+}
+
+// tenantTagReader restricts the queries of a reader to the series of a
+// tenant, which carry the tenant ID in a tag, and removes that tag from the
+// returned series. With an empty tenant, only series without the tag are
+// returned.
+type tenantTagReader struct {
+	reader
+	tag    string
+	tenant string
+}
+
+func (r tenantTagReader) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	treq := *req
+	treq.Queries = make([]*prompb.Query, 0, len(req.Queries))
+	for _, q := range req.Queries {
+		tq := *q
+		tq.Matchers = append([]*prompb.LabelMatcher{}, q.Matchers...)
+		tq.Matchers = append(tq.Matchers, &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: r.tag, Value: r.tenant})
+		treq.Queries = append(treq.Queries, &tq)
+	}
+
+	resp, err := r.reader.Read(&treq)
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range resp.Results {
+		for _, ts := range res.Timeseries {
+			labels := ts.Labels[:0]
+			for _, l := range ts.Labels {
+				if l.Name != r.tag {
+					labels = append(labels, l)
+				}
+			}
+			ts.Labels = labels
+		}
+	}
+	return resp, nil
+}
+
+// metadataCaches keeps the metadata received from each tenant apart. Only
+// the caches of the most recently seen tenants are kept.
+type metadataCaches struct {
+	mtx sync.Mutex
+	max int
+	// order holds the caches, the most recently used first.
+	order    *list.List
+	byTenant map[string]*list.Element
+}
+
+type tenantMetadata struct {
+	tenant string
+	cache  *metadata.Cache
+}
+
+// newMetadataCaches returns caches for the metadata of at most max tenants,
+// or of any number of tenants if max is 0.
+func newMetadataCaches(max int) *metadataCaches {
+	return &metadataCaches{max: max, order: list.New(), byTenant: map[string]*list.Element{}}
+}
+
+// get returns the metadata cache of a tenant, creating it if needed.
+func (c *metadataCaches) get(tenant string) *metadata.Cache {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if e, ok := c.byTenant[tenant]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*tenantMetadata).cache
+	}
+	tm := &tenantMetadata{tenant: tenant, cache: metadata.NewCache()}
+	c.byTenant[tenant] = c.order.PushFront(tm)
+	if c.max > 0 && c.order.Len() > c.max {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.byTenant, e.Value.(*tenantMetadata).tenant)
+	}
+	return tm.cache
+}
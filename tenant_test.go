@@ -0,0 +1,141 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestRequestTenant(t *testing.T) {
+	for _, tc := range []struct {
+		cfg      config
+		header   string
+		expected string
+		err      bool
+	}{
+		{cfg: config{}, header: "team-a", expected: ""},
+		{cfg: config{tenantHeader: "X-Scope-OrgID"}, header: "team-a", expected: "team-a"},
+		{cfg: config{tenantHeader: "X-Scope-OrgID"}, header: "", expected: ""},
+		{cfg: config{tenantHeader: "X-Scope-OrgID", tenantRequired: true}, header: "", err: true},
+		{cfg: config{tenantHeader: "X-Scope-OrgID"}, header: "../team-a", err: true},
+	} {
+		r := httptest.NewRequest("POST", "/write", nil)
+		if tc.header != "" {
+			r.Header.Set("X-Scope-OrgID", tc.header)
+		}
+		tenant, err := requestTenant(r, &tc.cfg)
+		if tc.err {
+			if err == nil {
+				t.Errorf("Expected error for %q with %+v, got none", tc.header, tc.cfg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %q with %+v: %s", tc.header, tc.cfg, err)
+		}
+		if tenant != tc.expected {
+			t.Errorf("Expected tenant %q for %q with %+v, got %q", tc.expected, tc.header, tc.cfg, tenant)
+		}
+	}
+}
+
+// queryRecorder records the read request it received and returns a series
+// with the labels of its equality matchers.
+type queryRecorder struct {
+	req *prompb.ReadRequest
+}
+
+func (r *queryRecorder) Name() string { return "recorder" }
+
+func (r *queryRecorder) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	r.req = req
+	resp := &prompb.ReadResponse{}
+	for _, q := range req.Queries {
+		ts := &prompb.TimeSeries{}
+		for _, m := range q.Matchers {
+			ts.Labels = append(ts.Labels, prompb.Label{Name: m.Name, Value: m.Value})
+		}
+		resp.Results = append(resp.Results, &prompb.QueryResult{Timeseries: []*prompb.TimeSeries{ts}})
+	}
+	return resp, nil
+}
+
+func TestTenantTagReader(t *testing.T) {
+	matchers := []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}}
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{{Matchers: matchers}}}
+	rec := &queryRecorder{}
+	r := tenantTagReader{reader: rec, tag: "tenant", tenant: "team-a"}
+
+	resp, err := r.Read(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expectedMatchers := []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+		{Type: prompb.LabelMatcher_EQ, Name: "tenant", Value: "team-a"},
+	}
+	if !reflect.DeepEqual(rec.req.Queries[0].Matchers, expectedMatchers) {
+		t.Errorf("Expected matchers %v, got %v", expectedMatchers, rec.req.Queries[0].Matchers)
+	}
+	if len(req.Queries[0].Matchers) != 1 {
+		t.Errorf("Expected the original query to be left as it is, got %v", req.Queries[0].Matchers)
+	}
+	expectedLabels := []prompb.Label{{Name: "__name__", Value: "up"}}
+	if got := resp.Results[0].Timeseries[0].Labels; !reflect.DeepEqual(got, expectedLabels) {
+		t.Errorf("Expected labels %v, got %v", expectedLabels, got)
+	}
+}
+
+func TestMetadataCaches(t *testing.T) {
+	c := newMetadataCaches(2)
+	a := c.get("a")
+	if c.get("a") != a {
+		t.Fatal("Expected the same cache for a tenant")
+	}
+	c.get("b")
+	// a is used more recently than b, which is dropped for c.
+	c.get("a")
+	c.get("c")
+	if _, ok := c.byTenant["b"]; ok || len(c.byTenant) != 2 {
+		t.Errorf("Expected the cache of b to be dropped, got %d caches", len(c.byTenant))
+	}
+	if c.get("a") != a {
+		t.Error("Expected the cache of a to be kept")
+	}
+}
+
+func TestTenantTagReaderWithoutTenant(t *testing.T) {
+	rec := &queryRecorder{}
+	r := tenantTagReader{reader: rec, tag: "tenant"}
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{{
+		Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+	}}}
+	if _, err := r.Read(req); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// The series of tenants are excluded.
+	expectedMatchers := []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+		{Type: prompb.LabelMatcher_EQ, Name: "tenant", Value: ""},
+	}
+	if !reflect.DeepEqual(rec.req.Queries[0].Matchers, expectedMatchers) {
+		t.Errorf("Expected matchers %v, got %v", expectedMatchers, rec.req.Queries[0].Matchers)
+	}
+}
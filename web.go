@@ -0,0 +1,259 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// webConfig is the format of the web configuration file, which follows the
+// one of the Prometheus exporter toolkit.
+type webConfig struct {
+	TLSConfig *webTLSConfig `yaml:"tls_server_config,omitempty"`
+}
+
+// webTLSConfig configures TLS for the HTTP listener.
+type webTLSConfig struct {
+	CertFile     string        `yaml:"cert_file"`
+	KeyFile      string        `yaml:"key_file"`
+	ClientAuth   string        `yaml:"client_auth_type,omitempty"`
+	ClientCAFile string        `yaml:"client_ca_file,omitempty"`
+	MinVersion   tlsVersion    `yaml:"min_version,omitempty"`
+	CipherSuites []cipherSuite `yaml:"cipher_suites,omitempty"`
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// tlsVersion is a TLS version given by its name, like TLS12.
+type tlsVersion uint16
+
+var tlsVersions = map[string]tlsVersion{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+func (v *tlsVersion) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	version, ok := tlsVersions[s]
+	if !ok {
+		return errors.Errorf("unknown TLS version %q", s)
+	}
+	*v = version
+	return nil
+}
+
+// cipherSuite is a TLS cipher suite given by its name, like
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+type cipherSuite uint16
+
+func (c *cipherSuite) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if cs.Name == s {
+			*c = cipherSuite(cs.ID)
+			return nil
+		}
+	}
+	return errors.Errorf("unknown cipher suite %q", s)
+}
+
+// loadWebConfig reads and validates the web configuration file.
+func loadWebConfig(filename string) (*webConfig, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	wc := &webConfig{}
+	if err := yaml.UnmarshalStrict(b, wc); err != nil {
+		return nil, errors.Wrapf(err, "error parsing %s", filename)
+	}
+	if err := wc.validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid web configuration in %s", filename)
+	}
+	return wc, nil
+}
+
+func (wc *webConfig) validate() error {
+	c := wc.TLSConfig
+	if c == nil {
+		return nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return errors.New("missing cert_file or key_file")
+	}
+	clientAuth, ok := clientAuthTypes[c.ClientAuth]
+	if !ok {
+		return errors.Errorf("invalid client_auth_type %q", c.ClientAuth)
+	}
+	verify := clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert
+	if verify && c.ClientCAFile == "" {
+		return errors.Errorf("client_auth_type %s requires client_ca_file", c.ClientAuth)
+	}
+	if !verify && c.ClientCAFile != "" {
+		return errors.Errorf("client_ca_file requires client_auth_type VerifyClientCertIfGiven or RequireAndVerifyClientCert")
+	}
+	return nil
+}
+
+// tlsReloader builds the TLS configuration of every connection from the
+// files of the web configuration, which are read again once they change.
+type tlsReloader struct {
+	logger log.Logger
+	c      *webTLSConfig
+
+	mtx      sync.Mutex
+	modTimes map[string]time.Time
+	config   *tls.Config
+}
+
+func newTLSReloader(logger log.Logger, c *webTLSConfig) (*tlsReloader, error) {
+	r := &tlsReloader{logger: logger, c: c}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// files returns the files the TLS configuration is built from.
+func (r *tlsReloader) files() []string {
+	files := []string{r.c.CertFile, r.c.KeyFile}
+	if r.c.ClientCAFile != "" {
+		files = append(files, r.c.ClientCAFile)
+	}
+	return files
+}
+
+// reload reads the files again if any of them changed since they were last
+// read, and returns whether they did.
+func (r *tlsReloader) reload() (bool, error) {
+	modTimes := map[string]time.Time{}
+	changed := r.config == nil
+	for _, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return false, err
+		}
+		modTimes[f] = fi.ModTime()
+		if !fi.ModTime().Equal(r.modTimes[f]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.c.CertFile, r.c.KeyFile)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to load certificate")
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuthTypes[r.c.ClientAuth],
+		MinVersion:   tls.VersionTLS12,
+	}
+	if r.c.MinVersion != 0 {
+		config.MinVersion = uint16(r.c.MinVersion)
+	}
+	for _, cs := range r.c.CipherSuites {
+		config.CipherSuites = append(config.CipherSuites, uint16(cs))
+	}
+	if r.c.ClientCAFile != "" {
+		b, err := ioutil.ReadFile(r.c.ClientCAFile)
+		if err != nil {
+			return false, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(b) {
+			return false, errors.Errorf("no certificates in %s", r.c.ClientCAFile)
+		}
+	}
+	r.config, r.modTimes = config, modTimes
+	return true, nil
+}
+
+// getConfigForClient returns the TLS configuration for a new connection. If
+// the files changed but can't be read, the previous configuration is kept.
+func (r *tlsReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	changed, err := r.reload()
+	if err != nil {
+		level.Error(r.logger).Log("msg", "Failed to reload TLS configuration, keeping the previous one", "err", err)
+	} else if changed {
+		level.Info(r.logger).Log("msg", "Reloaded TLS configuration")
+	}
+	return r.config, nil
+}
+
+// listenAndServe serves h on the configured address, using TLS if the web
+// configuration file enables it.
+func listenAndServe(logger log.Logger, cfg *config, h http.Handler) error {
+	if cfg.webConfigFile == "" {
+		return http.ListenAndServe(cfg.listenAddr, h)
+	}
+	wc, err := loadWebConfig(cfg.webConfigFile)
+	if err != nil {
+		return err
+	}
+	if wc.TLSConfig == nil {
+		return http.ListenAndServe(cfg.listenAddr, h)
+	}
+	r, err := newTLSReloader(logger, wc.TLSConfig)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Addr:    cfg.listenAddr,
+		Handler: h,
+		TLSConfig: &tls.Config{
+			// The certificate is served by the configuration returned
+			// for each connection, but the server requires one to be
+			// configured upfront.
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				r.mtx.Lock()
+				defer r.mtx.Unlock()
+				return &r.config.Certificates[0], nil
+			},
+			GetConfigForClient: r.getConfigForClient,
+		},
+	}
+	level.Info(logger).Log("msg", "TLS is enabled", "file", cfg.webConfigFile)
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,147 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// writeKeyPair writes a certificate and its key to PEM files in dir.
+func writeKeyPair(t *testing.T, dir string) *x509.Certificate {
+	cert, key := newCert(t, nil, nil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, block := range map[string]*pem.Block{
+		"cert.pem": {Type: "CERTIFICATE", Bytes: cert.Raw},
+		"key.pem":  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cert
+}
+
+func TestLoadWebConfig(t *testing.T) {
+	filename := writeConfigFile(t, `
+tls_server_config:
+  cert_file: cert.pem
+  key_file: key.pem
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: ca.pem
+  min_version: TLS13
+  cipher_suites:
+    - TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+`)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	wc, err := loadWebConfig(filename)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if wc.TLSConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("Expected TLS 1.3, got %x", wc.TLSConfig.MinVersion)
+	}
+	if len(wc.TLSConfig.CipherSuites) != 1 || uint16(wc.TLSConfig.CipherSuites[0]) != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("Unexpected cipher suites %v", wc.TLSConfig.CipherSuites)
+	}
+}
+
+func TestLoadWebConfigInvalid(t *testing.T) {
+	for _, content := range []string{
+		// Unknown field.
+		"tls_server_config:\n  cert: cert.pem\n",
+		// Missing key.
+		"tls_server_config:\n  cert_file: cert.pem\n",
+		// Unknown TLS version.
+		"tls_server_config:\n  cert_file: cert.pem\n  key_file: key.pem\n  min_version: SSL3\n",
+		// Unknown cipher suite.
+		"tls_server_config:\n  cert_file: cert.pem\n  key_file: key.pem\n  cipher_suites: [ROT13]\n",
+		// Verification without client CA.
+		"tls_server_config:\n  cert_file: cert.pem\n  key_file: key.pem\n  client_auth_type: RequireAndVerifyClientCert\n",
+		// Unknown client auth type.
+		"tls_server_config:\n  cert_file: cert.pem\n  key_file: key.pem\n  client_auth_type: Maybe\n",
+	} {
+		filename := writeConfigFile(t, content)
+		if _, err := loadWebConfig(filename); err == nil {
+			t.Errorf("Expected error for %q, got none", content)
+		}
+		os.RemoveAll(filepath.Dir(filename))
+	}
+}
+
+func TestTLSReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "web_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := writeKeyPair(t, dir)
+	r, err := newTLSReloader(log.NewNopLogger(), &webTLSConfig{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	config, _ := r.getConfigForClient(nil)
+	if !first.Equal(leaf(t, config)) {
+		t.Error("Expected the first certificate to be served")
+	}
+	if config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("Expected TLS 1.2 by default, got %x", config.MinVersion)
+	}
+
+	// Make sure that the modification times change.
+	second := writeKeyPair(t, dir)
+	later := time.Now().Add(time.Minute)
+	for _, name := range []string{"cert.pem", "key.pem"} {
+		if err := os.Chtimes(filepath.Join(dir, name), later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config, _ = r.getConfigForClient(nil)
+	if !second.Equal(leaf(t, config)) {
+		t.Error("Expected the changed certificate to be served")
+	}
+
+	// A broken key keeps the previous configuration in place.
+	if err := ioutil.WriteFile(filepath.Join(dir, "key.pem"), []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, _ = r.getConfigForClient(nil)
+	if !second.Equal(leaf(t, config)) {
+		t.Error("Expected the previous certificate to be served")
+	}
+}
+
+func leaf(t *testing.T, config *tls.Config) *x509.Certificate {
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
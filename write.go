@@ -0,0 +1,246 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+
+	"exemplar"
+	"histogram"
+	"metadata"
+	"queue"
+)
+
+// sendSamples makes a single attempt at sending samples to w.
+func sendSamples(logger log.Logger, w writer, samples model.Samples) error {
+	begin := time.Now()
+	err := w.Write(samples)
+	sentBatchDuration.WithLabelValues(w.Name()).Observe(time.Since(begin).Seconds())
+	if err != nil {
+		level.Warn(logger).Log("msg", "Error sending samples to remote storage", "err", err, "storage", w.Name(), "num_samples", len(samples))
+	}
+	return err
+}
+
+// countSent counts samples of a tenant as sent to w, and as failed if err,
+// the error of the last attempt at sending them, is not nil.
+func countSent(w writer, tenant string, samples model.Samples, err error) {
+	if err != nil {
+		failedSamples.WithLabelValues(w.Name()).Add(float64(len(samples)))
+	}
+	sentSamples.WithLabelValues(w.Name(), tenant).Add(float64(len(samples)))
+}
+
+// sendSamplesWithRetry sends the samples of a tenant to w, retrying
+// recoverable errors with exponential backoff up to the configured number of
+// times.
+func sendSamplesWithRetry(logger log.Logger, cfg *config, w writer, tenant string, samples model.Samples) error {
+	b := backoff{min: cfg.sendMinBackoff, max: cfg.sendMaxBackoff}
+	for try := 0; ; try++ {
+		err := sendSamples(logger, w, samples)
+		if err == nil || !isRecoverable(err) || try >= cfg.sendMaxRetries {
+			countSent(w, tenant, samples, err)
+			return err
+		}
+		retriedSamples.WithLabelValues(w.Name()).Add(float64(len(samples)))
+		time.Sleep(b.next())
+	}
+}
+
+// isRecoverable returns whether an error returned by a writer may not occur
+// again when retrying the write. Clients mark such errors by implementing
+// Recoverable, network errors and timeouts are always considered
+// recoverable.
+func isRecoverable(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case interface {
+		Recoverable() bool
+	}:
+		return e.Recoverable()
+	case net.Error:
+		return true
+	}
+	return err == queue.ErrFull
+}
+
+// writeError combines the errors of all writers for a write request into the
+// HTTP status code to respond with and a single error. Recoverable errors
+// take precedence, so that Prometheus retries the request.
+func writeError(errs []error) (int, error) {
+	var (
+		msgs        []string
+		recoverable bool
+	)
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		msgs = append(msgs, err.Error())
+		if isRecoverable(err) {
+			recoverable = true
+		}
+	}
+	if len(msgs) == 0 {
+		return http.StatusOK, nil
+	}
+	err := errors.New(strings.Join(msgs, "; "))
+	if recoverable {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusBadRequest, err
+}
+
+// backoff computes exponentially increasing durations between min and max,
+// with random jitter to spread out retries of concurrent requests.
+type backoff struct {
+	min, max time.Duration
+	cur      time.Duration
+}
+
+// next returns the time to wait before the next retry.
+func (b *backoff) next() time.Duration {
+	switch {
+	case b.cur == 0:
+		b.cur = b.min
+	case b.cur < b.max:
+		b.cur *= 2
+	}
+	if b.cur > b.max {
+		b.cur = b.max
+	}
+	if b.cur <= 1 {
+		return b.cur
+	}
+	// Wait at least half of the current backoff.
+	half := b.cur / 2
+	return half + time.Duration(rand.Int63n(int64(b.cur-half)))
+}
+
+func enqueueSamples(logger log.Logger, w *queuedWriter, samples model.Samples) error {
+	err := w.queue.Append(samples)
+	if err != nil {
+		level.Warn(logger).Log("msg", "Error queueing samples", "err", err, "storage", w.Name(), "num_samples", len(samples))
+		failedSamples.WithLabelValues(w.Name()).Add(float64(len(samples)))
+	}
+	return err
+}
+
+// writeHistograms writes native histograms to w, as classic histograms
+// unless w stores them natively. The histograms must have been checked with
+// validHistograms.
+func writeHistograms(w writer, histograms []histogram.Sample) error {
+	if len(histograms) == 0 {
+		return nil
+	}
+	if hw, ok := w.(histogramWriter); ok {
+		return hw.WriteHistograms(histograms)
+	}
+	samples, _ := histogram.Expand(histograms)
+	return w.Write(samples)
+}
+
+// withClassicHistograms returns the samples followed by the series of the
+// classic histograms equivalent to the native histograms.
+func withClassicHistograms(samples model.Samples, histograms []histogram.Sample) model.Samples {
+	if len(histograms) == 0 {
+		return samples
+	}
+	classic, _ := histogram.Expand(histograms)
+	result := make(model.Samples, 0, len(samples)+len(classic))
+	return append(append(result, samples...), classic...)
+}
+
+// histogramSender writes the native histograms of a write request along
+// with its samples, so that both are retried together.
+type histogramSender struct {
+	writer
+	histograms []histogram.Sample
+}
+
+func (w histogramSender) Write(samples model.Samples) error {
+	if len(samples) > 0 {
+		if err := w.writer.Write(samples); err != nil {
+			return err
+		}
+	}
+	return writeHistograms(w.writer, w.histograms)
+}
+
+// errExemplarsUnsupported is returned by writeExemplars for writers which
+// don't store exemplars.
+var errExemplarsUnsupported = errors.New("exemplars are not supported")
+
+// writeExemplars writes exemplars to w if it stores them, and returns
+// errExemplarsUnsupported otherwise.
+func writeExemplars(w writer, series []exemplar.Series) error {
+	ew, ok := w.(exemplarWriter)
+	if !ok {
+		return errExemplarsUnsupported
+	}
+	if len(series) == 0 {
+		return nil
+	}
+	return ew.WriteExemplars(series)
+}
+
+// sendExemplars writes the exemplars of a write request to w and returns
+// whether w stores them.
+func sendExemplars(logger log.Logger, w writer, series []exemplar.Series) (bool, error) {
+	err := writeExemplars(w, series)
+	if err == errExemplarsUnsupported {
+		return false, nil
+	}
+	if err != nil {
+		level.Warn(logger).Log("msg", "Error sending exemplars to remote storage", "err", err, "storage", w.Name(), "num_exemplars", countExemplars(series))
+		return false, err
+	}
+	return true, nil
+}
+
+// countExemplars returns the number of exemplars of all series.
+func countExemplars(series []exemplar.Series) int {
+	n := 0
+	for _, s := range series {
+		n += len(s.Exemplars)
+	}
+	return n
+}
+
+// writeMetadata writes the metadata of metric families to w if it stores
+// metadata, otherwise the metadata is dropped.
+func writeMetadata(w writer, families []metadata.Family) error {
+	mw, ok := w.(metadataWriter)
+	if !ok || len(families) == 0 {
+		return nil
+	}
+	return mw.WriteMetadata(families)
+}
+
+// sendMetadata writes the metadata of a write request to w.
+func sendMetadata(logger log.Logger, w writer, families []metadata.Family) error {
+	err := writeMetadata(w, families)
+	if err != nil {
+		level.Warn(logger).Log("msg", "Error sending metadata to remote storage", "err", err, "storage", w.Name(), "num_families", len(families))
+	}
+	return err
+}
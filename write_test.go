@@ -0,0 +1,175 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+
+	"histogram"
+)
+
+type recoverable struct {
+	error
+}
+
+func (recoverable) Recoverable() bool {
+	return true
+}
+
+type fakeWriter struct {
+	errs    []error
+	calls   int
+	written model.Samples
+}
+
+func (w *fakeWriter) Write(samples model.Samples) error {
+	w.calls++
+	w.written = append(w.written, samples...)
+	if len(w.errs) == 0 {
+		return nil
+	}
+	err := w.errs[0]
+	w.errs = w.errs[1:]
+	return err
+}
+
+func (w *fakeWriter) Name() string {
+	return "fake"
+}
+
+func TestSendSamplesWithRetry(t *testing.T) {
+	cfg := &config{sendMinBackoff: time.Millisecond, sendMaxBackoff: 2 * time.Millisecond, sendMaxRetries: 3}
+	samples := model.Samples{{Metric: model.Metric{model.MetricNameLabel: "up"}, Value: 1}}
+
+	w := &fakeWriter{errs: []error{recoverable{errors.New("503")}, &net.OpError{Op: "dial", Err: errors.New("refused")}}}
+	if err := sendSamplesWithRetry(log.NewNopLogger(), cfg, w, "", samples); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if w.calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", w.calls)
+	}
+
+	w = &fakeWriter{errs: []error{errors.New("bad data"), nil}}
+	if err := sendSamplesWithRetry(log.NewNopLogger(), cfg, w, "", samples); err == nil {
+		t.Fatal("Expected unrecoverable error, got none")
+	}
+	if w.calls != 1 {
+		t.Errorf("Expected unrecoverable error not to be retried, got %d calls", w.calls)
+	}
+
+	w = &fakeWriter{errs: []error{recoverable{errors.New("503")}, recoverable{errors.New("503")}, recoverable{errors.New("503")}}}
+	cfg.sendMaxRetries = 2
+	sent := testutil.ToFloat64(sentSamples.WithLabelValues("fake", ""))
+	failed := testutil.ToFloat64(failedSamples.WithLabelValues("fake"))
+	if err := sendSamplesWithRetry(log.NewNopLogger(), cfg, w, "", samples); err == nil {
+		t.Fatal("Expected error after exhausting retries, got none")
+	}
+	if w.calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", w.calls)
+	}
+	// The samples are counted once, not for every try.
+	if got := testutil.ToFloat64(sentSamples.WithLabelValues("fake", "")) - sent; got != 1 {
+		t.Errorf("Expected 1 sent sample, got %v", got)
+	}
+	if got := testutil.ToFloat64(failedSamples.WithLabelValues("fake")) - failed; got != 1 {
+		t.Errorf("Expected 1 failed sample, got %v", got)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	for _, c := range []struct {
+		errs []error
+		code int
+	}{
+		{errs: []error{nil, nil}, code: http.StatusOK},
+		{errs: []error{nil, errors.New("bad data")}, code: http.StatusBadRequest},
+		{errs: []error{errors.New("bad data"), recoverable{errors.New("503")}}, code: http.StatusInternalServerError},
+		{errs: []error{errors.Wrap(&net.OpError{Op: "dial", Err: errors.New("refused")}, "graphite")}, code: http.StatusInternalServerError},
+	} {
+		code, err := writeError(c.errs)
+		if code != c.code {
+			t.Errorf("Expected status %d for %v, got %d", c.code, c.errs, code)
+		}
+		if (err == nil) != (c.code == http.StatusOK) {
+			t.Errorf("Unexpected error %v for %v", err, c.errs)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := backoff{min: 100 * time.Millisecond, max: time.Second}
+	for i, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		d := b.next()
+		if d < max/2 || d > max {
+			t.Errorf("%d. Expected backoff between %s and %s, got %s", i, max/2, max, d)
+		}
+	}
+}
+
+type fakeHistogramWriter struct {
+	fakeWriter
+	histograms []histogram.Sample
+}
+
+func (w *fakeHistogramWriter) WriteHistograms(histograms []histogram.Sample) error {
+	w.histograms = append(w.histograms, histograms...)
+	return nil
+}
+
+func TestHistogramSender(t *testing.T) {
+	samples := model.Samples{{Metric: model.Metric{model.MetricNameLabel: "up"}, Value: 1}}
+	histograms := []histogram.Sample{{
+		Metric:    model.Metric{model.MetricNameLabel: "rpc_seconds"},
+		Histogram: &histogram.Histogram{Schema: -53, Count: 2, Sum: 3, PositiveSpans: []histogram.Span{{Offset: 0, Length: 1}}, PositiveBuckets: []float64{2}},
+	}}
+
+	// Writers without native histogram support get classic histograms.
+	w := &fakeWriter{}
+	if err := (histogramSender{writer: namedWriter{writer: w, name: "fake"}, histograms: histograms}).Write(samples); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := model.Samples{
+		samples[0],
+		{Metric: model.Metric{model.MetricNameLabel: "rpc_seconds_bucket", model.BucketLabel: "+Inf"}, Value: 2},
+		{Metric: model.Metric{model.MetricNameLabel: "rpc_seconds_sum"}, Value: 3},
+		{Metric: model.Metric{model.MetricNameLabel: "rpc_seconds_count"}, Value: 2},
+	}
+	if !reflect.DeepEqual(w.written, expected) {
+		t.Errorf("Expected %v, got %v", expected, w.written)
+	}
+	if got := withClassicHistograms(samples, histograms); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	hw := &fakeHistogramWriter{}
+	if err := (histogramSender{writer: namedWriter{writer: hw, name: "fake"}, histograms: histograms}).Write(samples); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(hw.written, samples) {
+		t.Errorf("Expected samples %v, got %v", samples, hw.written)
+	}
+	if !reflect.DeepEqual(hw.histograms, histograms) {
+		t.Errorf("Expected histograms %v, got %v", histograms, hw.histograms)
+	}
+}
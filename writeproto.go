@@ -0,0 +1,297 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/gogo/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"exemplar"
+	"histogram"
+	"metadata"
+	"queue"
+	"writev2"
+)
+
+// Headers of the remote write protocol.
+const (
+	remoteWriteVersionHeader = "X-Prometheus-Remote-Write-Version"
+
+	samplesWrittenHeader    = "X-Prometheus-Remote-Write-Samples-Written"
+	histogramsWrittenHeader = "X-Prometheus-Remote-Write-Histograms-Written"
+	exemplarsWrittenHeader  = "X-Prometheus-Remote-Write-Exemplars-Written"
+)
+
+// writeProtoV1 is the protobuf message name of remote write 1.0 requests.
+const writeProtoV1 = "prometheus.WriteRequest"
+
+// errUnsupportedMediaType is returned for requests in a format the adapter
+// doesn't understand, which senders must not retry.
+var errUnsupportedMediaType = errors.New("unsupported content type")
+
+// writeProto returns the protobuf message of a write request. It is given
+// by the proto parameter of the Content-Type. Without it, remote write 2.0
+// senders are recognized by their version header, anything else is a 1.0
+// request.
+func writeProto(r *http.Request) (string, error) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return writeProtoV1, nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/x-protobuf" {
+		return "", errors.Wrapf(errUnsupportedMediaType, "%q", contentType)
+	}
+	switch params["proto"] {
+	case writeProtoV1, writev2.ContentType:
+		return params["proto"], nil
+	case "":
+		if strings.HasPrefix(r.Header.Get(remoteWriteVersionHeader), "2.") {
+			return writev2.ContentType, nil
+		}
+		return writeProtoV1, nil
+	}
+	return "", errors.Wrapf(errUnsupportedMediaType, "%q", contentType)
+}
+
+// writeStats counts what a remote write 2.0 request carried.
+type writeStats struct {
+	samples    int
+	histograms int
+	exemplars  int
+}
+
+// setWrittenHeaders reports to remote write 2.0 senders how much of the
+// request was written.
+func setWrittenHeaders(h http.Header, s writeStats) {
+	h.Set(samplesWrittenHeader, strconv.Itoa(s.samples))
+	h.Set(histogramsWrittenHeader, strconv.Itoa(s.histograms))
+	h.Set(exemplarsWrittenHeader, strconv.Itoa(s.exemplars))
+}
+
+// writeRequest is what the adapter stores of a write request.
+type writeRequest struct {
+	samples    model.Samples
+	histograms []histogram.Sample
+	exemplars  []exemplar.Series
+	metadata   []metadata.Family
+}
+
+// decodeWriteRequest decodes the uncompressed body of a write request in
+// the given protocol.
+func decodeWriteRequest(msg string, buf []byte) (*writeRequest, error) {
+	if msg == writev2.ContentType {
+		var req writev2.Request
+		if err := req.Unmarshal(buf); err != nil {
+			return nil, err
+		}
+		return fromV2(&req)
+	}
+
+	var req prompb.WriteRequest
+	if err := proto.Unmarshal(buf, &req); err != nil {
+		return nil, err
+	}
+	// The native histograms are decoded by the adapter itself, so that it
+	// doesn't depend on a version of Prometheus which knows them.
+	histograms, err := writev2.V1Histograms(buf)
+	if err != nil {
+		return nil, err
+	}
+	return fromProto(&req, histograms), nil
+}
+
+// fromProto returns the float samples, native histograms and exemplars of
+// the series of a remote write 1.0 request, and its metadata. The native
+// histograms of each series are passed separately, in the order of the
+// series.
+func fromProto(req *prompb.WriteRequest, histograms [][]writev2.Histogram) *writeRequest {
+	var wr writeRequest
+	for _, m := range req.Metadata {
+		wr.metadata = append(wr.metadata, metadata.Family{
+			Name: m.MetricFamilyName,
+			Metadata: metadata.Metadata{
+				Type: metadata.TypeName(int32(m.Type)),
+				Help: m.Help,
+				Unit: m.Unit,
+			},
+		})
+	}
+	wr.samples = queue.ProtoToSamples(req)
+	for i, ts := range req.Timeseries {
+		var hs []writev2.Histogram
+		if i < len(histograms) {
+			hs = histograms[i]
+		}
+		if len(hs) == 0 && len(ts.Exemplars) == 0 {
+			continue
+		}
+		metric := make(model.Metric, len(ts.Labels))
+		for _, l := range ts.Labels {
+			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		}
+
+		for j := range hs {
+			h := &hs[j]
+			wr.histograms = append(wr.histograms, histogram.Sample{
+				Metric:    metric,
+				Histogram: v2Histogram(h),
+				Timestamp: model.Time(h.Timestamp),
+			})
+		}
+		if len(ts.Exemplars) > 0 {
+			series := exemplar.Series{SeriesLabels: model.LabelSet(metric)}
+			for _, e := range ts.Exemplars {
+				labels := make(model.LabelSet, len(e.Labels))
+				for _, l := range e.Labels {
+					labels[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+				}
+				series.Exemplars = append(series.Exemplars, exemplar.Exemplar{
+					Labels:    labels,
+					Value:     model.SampleValue(e.Value),
+					Timestamp: model.Time(e.Timestamp),
+				})
+			}
+			wr.exemplars = append(wr.exemplars, series)
+		}
+	}
+	return &wr
+}
+
+// fromV2 resolves the labels of the series of a remote write 2.0 request
+// and returns their float samples, native histograms, exemplars and
+// metadata. Created timestamps are not stored.
+func fromV2(req *writev2.Request) (*writeRequest, error) {
+	var wr writeRequest
+	// Every series carries the metadata of its family, only keep it once.
+	families := map[string]bool{}
+	for _, ts := range req.Timeseries {
+		metric, err := req.Metric(ts.LabelsRefs)
+		if err != nil {
+			return nil, err
+		}
+		name := string(metric[model.MetricNameLabel])
+		if ts.Metadata != (writev2.Metadata{}) && !families[name] {
+			m, err := v2Metadata(req, ts.Metadata)
+			if err != nil {
+				return nil, err
+			}
+			wr.metadata = append(wr.metadata, metadata.Family{Name: name, Metadata: m})
+			families[name] = true
+		}
+		for _, s := range ts.Samples {
+			wr.samples = append(wr.samples, &model.Sample{
+				Metric:    metric,
+				Value:     model.SampleValue(s.Value),
+				Timestamp: model.Time(s.Timestamp),
+			})
+		}
+		for i := range ts.Histograms {
+			h := &ts.Histograms[i]
+			wr.histograms = append(wr.histograms, histogram.Sample{
+				Metric:    metric,
+				Histogram: v2Histogram(h),
+				Timestamp: model.Time(h.Timestamp),
+			})
+		}
+		if len(ts.Exemplars) > 0 {
+			series := exemplar.Series{SeriesLabels: model.LabelSet(metric)}
+			for _, e := range ts.Exemplars {
+				labels, err := req.Metric(e.LabelsRefs)
+				if err != nil {
+					return nil, errors.Wrap(err, "invalid exemplar labels")
+				}
+				series.Exemplars = append(series.Exemplars, exemplar.Exemplar{
+					Labels:    model.LabelSet(labels),
+					Value:     model.SampleValue(e.Value),
+					Timestamp: model.Time(e.Timestamp),
+				})
+			}
+			wr.exemplars = append(wr.exemplars, series)
+		}
+	}
+	return &wr, nil
+}
+
+// v2Metadata resolves the help and unit of remote write 2.0 metadata.
+func v2Metadata(req *writev2.Request, m writev2.Metadata) (metadata.Metadata, error) {
+	help, err := req.Symbol(m.HelpRef)
+	if err != nil {
+		return metadata.Metadata{}, errors.Wrap(err, "invalid metadata help")
+	}
+	unit, err := req.Symbol(m.UnitRef)
+	if err != nil {
+		return metadata.Metadata{}, errors.Wrap(err, "invalid metadata unit")
+	}
+	return metadata.Metadata{Type: metadata.TypeName(int32(m.Type)), Help: help, Unit: unit}, nil
+}
+
+// v2Histogram converts a native histogram, which remote write 1.0 and 2.0
+// encode the same way, into absolute counts.
+func v2Histogram(h *writev2.Histogram) *histogram.Histogram {
+	r := &histogram.Histogram{
+		Schema:        h.Schema,
+		ZeroThreshold: h.ZeroThreshold,
+		Sum:           h.Sum,
+		PositiveSpans: v2Spans(h.PositiveSpans),
+		NegativeSpans: v2Spans(h.NegativeSpans),
+		CustomValues:  h.CustomValues,
+	}
+	if h.IsFloat {
+		r.Count = h.CountFloat
+		r.ZeroCount = h.ZeroCountFloat
+		r.PositiveBuckets = h.PositiveCounts
+		r.NegativeBuckets = h.NegativeCounts
+	} else {
+		r.Count = float64(h.CountInt)
+		r.ZeroCount = float64(h.ZeroCountInt)
+		r.PositiveBuckets = histogram.CountsFromDeltas(h.PositiveDeltas)
+		r.NegativeBuckets = histogram.CountsFromDeltas(h.NegativeDeltas)
+	}
+	return r
+}
+
+func v2Spans(spans []writev2.BucketSpan) []histogram.Span {
+	result := make([]histogram.Span, 0, len(spans))
+	for _, s := range spans {
+		result = append(result, histogram.Span{Offset: s.Offset, Length: s.Length})
+	}
+	return result
+}
+
+// validHistograms returns the histograms which can be converted into
+// classic histograms. The others are logged and counted as invalid, so that
+// writers only see histograms they are able to translate.
+func validHistograms(logger log.Logger, histograms []histogram.Sample) []histogram.Sample {
+	valid := make([]histogram.Sample, 0, len(histograms))
+	for _, h := range histograms {
+		if _, err := h.Histogram.ClassicBuckets(); err != nil {
+			level.Warn(logger).Log("msg", "Dropping histogram which can't be converted", "metric", h.Metric, "err", err)
+			invalidHistograms.Inc()
+			continue
+		}
+		valid = append(valid, h)
+	}
+	return valid
+}
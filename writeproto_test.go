@@ -0,0 +1,216 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"exemplar"
+	"histogram"
+	"metadata"
+	"writev2"
+)
+
+func TestWriteProto(t *testing.T) {
+	for _, c := range []struct {
+		contentType string
+		version     string
+		expected    string
+		unsupported bool
+	}{
+		{contentType: "", expected: writeProtoV1},
+		{contentType: "application/x-protobuf", version: "0.1.0", expected: writeProtoV1},
+		{contentType: "application/x-protobuf;proto=prometheus.WriteRequest", expected: writeProtoV1},
+		{contentType: "application/x-protobuf;proto=io.prometheus.write.v2.Request", version: "2.0.0", expected: writev2.ContentType},
+		{contentType: "application/x-protobuf", version: "2.0.0", expected: writev2.ContentType},
+		{contentType: "application/x-protobuf;proto=io.prometheus.write.v3.Request", unsupported: true},
+		{contentType: "application/json", unsupported: true},
+	} {
+		r, err := http.NewRequest("POST", "/write", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", c.contentType)
+		r.Header.Set(remoteWriteVersionHeader, c.version)
+
+		msg, err := writeProto(r)
+		if c.unsupported {
+			if errors.Cause(err) != errUnsupportedMediaType {
+				t.Errorf("Expected unsupported content type for %q, got %v", c.contentType, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %s", c.contentType, err)
+		}
+		if msg != c.expected {
+			t.Errorf("Expected %s for %q, got %s", c.expected, c.contentType, msg)
+		}
+	}
+}
+
+func TestDecodeWriteRequestV2(t *testing.T) {
+	req := writev2.Request{
+		Symbols: []string{"", "__name__", "up", "job", "node", "trace_id", "abc", "Whether the target is up."},
+		Timeseries: []writev2.TimeSeries{
+			{
+				LabelsRefs: []uint32{1, 2, 3, 4},
+				Samples:    []writev2.Sample{{Value: 1, Timestamp: 1000}, {Value: 0, Timestamp: 2000}},
+				Exemplars:  []writev2.Exemplar{{LabelsRefs: []uint32{5, 6}, Value: 1, Timestamp: 1000}},
+				Metadata:   writev2.Metadata{Type: writev2.MetricTypeGauge, HelpRef: 7},
+			},
+			{
+				LabelsRefs: []uint32{1, 2},
+				Histograms: []writev2.Histogram{{
+					CountInt:       3,
+					Sum:            2,
+					PositiveSpans:  []writev2.BucketSpan{{Offset: 0, Length: 2}},
+					PositiveDeltas: []int64{1, 1},
+					Timestamp:      1000,
+				}},
+				// Metadata of the same family is only returned once.
+				Metadata: writev2.Metadata{Type: writev2.MetricTypeHistogram},
+			},
+		},
+	}
+	wr, err := decodeWriteRequest(writev2.ContentType, req.Marshal())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	metric := model.Metric{"__name__": "up", "job": "node"}
+	expected := model.Samples{
+		{Metric: metric, Value: 1, Timestamp: 1000},
+		{Metric: metric, Value: 0, Timestamp: 2000},
+	}
+	if !reflect.DeepEqual(wr.samples, expected) {
+		t.Errorf("Expected %v, got %v", expected, wr.samples)
+	}
+	expectedHistograms := []histogram.Sample{{
+		Metric:    model.Metric{"__name__": "up"},
+		Timestamp: 1000,
+		Histogram: &histogram.Histogram{
+			Count:           3,
+			Sum:             2,
+			PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+			PositiveBuckets: []float64{1, 2},
+			NegativeSpans:   []histogram.Span{},
+			NegativeBuckets: []float64{},
+		},
+	}}
+	if !reflect.DeepEqual(wr.histograms, expectedHistograms) {
+		t.Errorf("Expected %+v, got %+v", expectedHistograms, wr.histograms)
+	}
+	expectedExemplars := []exemplar.Series{{
+		SeriesLabels: model.LabelSet{"__name__": "up", "job": "node"},
+		Exemplars:    []exemplar.Exemplar{{Labels: model.LabelSet{"trace_id": "abc"}, Value: 1, Timestamp: 1000}},
+	}}
+	if !reflect.DeepEqual(wr.exemplars, expectedExemplars) {
+		t.Errorf("Expected %v, got %v", expectedExemplars, wr.exemplars)
+	}
+	expectedMetadata := []metadata.Family{{Name: "up", Metadata: metadata.Metadata{Type: "gauge", Help: "Whether the target is up."}}}
+	if !reflect.DeepEqual(wr.metadata, expectedMetadata) {
+		t.Errorf("Expected %v, got %v", expectedMetadata, wr.metadata)
+	}
+
+	req.Timeseries[0].LabelsRefs = []uint32{1, 8}
+	if _, err := decodeWriteRequest(writev2.ContentType, req.Marshal()); err == nil {
+		t.Error("Expected error for invalid symbol reference, got none")
+	}
+}
+
+func TestFromProto(t *testing.T) {
+	wr := fromProto(&prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+			Exemplars: []prompb.Exemplar{{
+				Labels:    []prompb.Label{{Name: "trace_id", Value: "abc"}},
+				Value:     1,
+				Timestamp: 1000,
+			}},
+		}},
+		Metadata: []prompb.MetricMetadata{{
+			Type:             prompb.MetricMetadata_COUNTER,
+			MetricFamilyName: "http_requests_total",
+			Help:             "Total number of HTTP requests.",
+		}},
+	}, nil)
+	expected := &writeRequest{
+		samples: model.Samples{{Metric: model.Metric{"__name__": "up"}, Value: 1, Timestamp: 1000}},
+		exemplars: []exemplar.Series{{
+			SeriesLabels: model.LabelSet{"__name__": "up"},
+			Exemplars:    []exemplar.Exemplar{{Labels: model.LabelSet{"trace_id": "abc"}, Value: 1, Timestamp: 1000}},
+		}},
+		metadata: []metadata.Family{{
+			Name:     "http_requests_total",
+			Metadata: metadata.Metadata{Type: "counter", Help: "Total number of HTTP requests."},
+		}},
+	}
+	if !reflect.DeepEqual(wr, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, wr)
+	}
+}
+
+func TestFromProtoHistograms(t *testing.T) {
+	wr := fromProto(&prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{Labels: []prompb.Label{{Name: "__name__", Value: "rpc_seconds"}}},
+			{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}},
+		},
+	}, [][]writev2.Histogram{{{
+		IsFloat:        true,
+		CountFloat:     2,
+		Schema:         -53,
+		Sum:            1,
+		PositiveSpans:  []writev2.BucketSpan{{Offset: 0, Length: 2}},
+		PositiveCounts: []float64{0.5, 1.5},
+		CustomValues:   []float64{0.25},
+		Timestamp:      1000,
+	}}})
+	if len(wr.histograms) != 1 {
+		t.Fatalf("Expected 1 histogram, got %d", len(wr.histograms))
+	}
+	h := wr.histograms[0]
+	if h.Metric["__name__"] != "rpc_seconds" || h.Timestamp != 1000 {
+		t.Errorf("Unexpected histogram %v at %v", h.Metric, h.Timestamp)
+	}
+	buckets, err := h.Histogram.ClassicBuckets()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []histogram.Bucket{{UpperBound: 0.25, Count: 0.5}, {UpperBound: math.Inf(1), Count: 2}}
+	if !reflect.DeepEqual(buckets, expected) {
+		t.Errorf("Expected %v, got %v", expected, buckets)
+	}
+}
+
+func TestValidHistograms(t *testing.T) {
+	histograms := []histogram.Sample{
+		{Metric: model.Metric{"__name__": "valid"}, Histogram: &histogram.Histogram{Count: 1}},
+		{Metric: model.Metric{"__name__": "invalid"}, Histogram: &histogram.Histogram{Schema: 42}},
+	}
+	valid := validHistograms(log.NewNopLogger(), histograms)
+	if !reflect.DeepEqual(valid, histograms[:1]) {
+		t.Errorf("Expected %v, got %v", histograms[:1], valid)
+	}
+}
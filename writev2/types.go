@@ -0,0 +1,562 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package writev2 decodes requests of the Prometheus remote write protocol
+// 2.0, which are io.prometheus.write.v2.Request protobuf messages.
+// https://prometheus.io/docs/specs/remote_write_spec_2_0/
+package writev2
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// ContentType is the protobuf message name of requests, as used in the
+// proto parameter of their Content-Type.
+const ContentType = "io.prometheus.write.v2.Request"
+
+// Request is a remote write 2.0 request. Strings, like label names and
+// values, are interned in the symbol table and referenced by their index.
+type Request struct {
+	Symbols    []string
+	Timeseries []TimeSeries
+}
+
+// TimeSeries is a series with its samples, native histograms, exemplars and
+// metadata.
+type TimeSeries struct {
+	// LabelsRefs are pairs of references to the name and value of each
+	// label.
+	LabelsRefs []uint32
+	Samples    []Sample
+	Histograms []Histogram
+	Exemplars  []Exemplar
+	Metadata   Metadata
+	// CreatedTimestamp is the time in milliseconds at which a counter,
+	// histogram or summary was created, or 0 if it's unknown.
+	CreatedTimestamp int64
+}
+
+// Sample is a float sample, with a timestamp in milliseconds.
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// Exemplar is an exemplar with its own labels, like a trace ID.
+type Exemplar struct {
+	LabelsRefs []uint32
+	Value      float64
+	Timestamp  int64
+}
+
+// MetricType is the type of the metric a series belongs to.
+type MetricType int32
+
+// Metric types.
+const (
+	MetricTypeUnspecified MetricType = iota
+	MetricTypeCounter
+	MetricTypeGauge
+	MetricTypeHistogram
+	MetricTypeGaugeHistogram
+	MetricTypeSummary
+	MetricTypeInfo
+	MetricTypeStateset
+)
+
+// Metadata describes the metric a series belongs to.
+type Metadata struct {
+	Type    MetricType
+	HelpRef uint32
+	UnitRef uint32
+}
+
+// ResetHint tells whether a native histogram is a counter reset.
+type ResetHint int32
+
+// Reset hints.
+const (
+	ResetHintUnknown ResetHint = iota
+	ResetHintYes
+	ResetHintNo
+	ResetHintGauge
+)
+
+// Histogram is a native histogram. Integer histograms encode their bucket
+// counts as deltas to the previous bucket, float histograms as absolute
+// counts.
+type Histogram struct {
+	// IsFloat selects the float counts and CountFloat, ZeroCountFloat and
+	// the Counts of the buckets over their integer counterparts.
+	IsFloat        bool
+	CountInt       uint64
+	CountFloat     float64
+	Sum            float64
+	Schema         int32
+	ZeroThreshold  float64
+	ZeroCountInt   uint64
+	ZeroCountFloat float64
+
+	NegativeSpans  []BucketSpan
+	NegativeDeltas []int64
+	NegativeCounts []float64
+	PositiveSpans  []BucketSpan
+	PositiveDeltas []int64
+	PositiveCounts []float64
+
+	ResetHint ResetHint
+	Timestamp int64
+	// CustomValues are the upper bounds of the buckets of histograms with
+	// custom buckets (schema -53).
+	CustomValues []float64
+}
+
+// BucketSpan is a run of consecutive buckets. Offset is the gap to the end
+// of the previous span, or the index of the first bucket for the first span.
+type BucketSpan struct {
+	Offset int32
+	Length uint32
+}
+
+// Symbol returns the string with the given reference.
+func (r *Request) Symbol(ref uint32) (string, error) {
+	if int(ref) >= len(r.Symbols) {
+		return "", errors.Errorf("symbol reference %d out of range, %d symbols", ref, len(r.Symbols))
+	}
+	return r.Symbols[ref], nil
+}
+
+// Metric resolves pairs of label references into a metric.
+func (r *Request) Metric(refs []uint32) (model.Metric, error) {
+	if len(refs)%2 != 0 {
+		return nil, errors.Errorf("odd number of label references %d", len(refs))
+	}
+	m := make(model.Metric, len(refs)/2)
+	for i := 0; i < len(refs); i += 2 {
+		name, err := r.Symbol(refs[i])
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.Symbol(refs[i+1])
+		if err != nil {
+			return nil, err
+		}
+		m[model.LabelName(name)] = model.LabelValue(value)
+	}
+	return m, nil
+}
+
+// Unmarshal decodes a request from its protobuf encoding. Unknown fields
+// are skipped.
+func (r *Request) Unmarshal(b []byte) error {
+	*r = Request{}
+	d := decoder{buf: b}
+	for !d.done() {
+		num, wt, err := d.field()
+		if err != nil {
+			return err
+		}
+		switch {
+		case num == 4 && wt == wireBytes:
+			s, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			r.Symbols = append(r.Symbols, string(s))
+		case num == 5 && wt == wireBytes:
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			var ts TimeSeries
+			if err := ts.unmarshal(b); err != nil {
+				return errors.Wrap(err, "error decoding series")
+			}
+			r.Timeseries = append(r.Timeseries, ts)
+		default:
+			if err := d.skip(wt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ts *TimeSeries) unmarshal(b []byte) error {
+	d := decoder{buf: b}
+	for !d.done() {
+		num, wt, err := d.field()
+		if err != nil {
+			return err
+		}
+		switch {
+		case num == 1:
+			refs, err := d.uvarints(wt, nil)
+			if err != nil {
+				return err
+			}
+			ts.LabelsRefs = appendRefs(ts.LabelsRefs, refs)
+		case num == 2 && wt == wireBytes:
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			var s Sample
+			if err := s.unmarshal(b); err != nil {
+				return err
+			}
+			ts.Samples = append(ts.Samples, s)
+		case num == 3 && wt == wireBytes:
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			var h Histogram
+			if err := h.unmarshal(b); err != nil {
+				return err
+			}
+			ts.Histograms = append(ts.Histograms, h)
+		case num == 4 && wt == wireBytes:
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			var e Exemplar
+			if err := e.unmarshal(b); err != nil {
+				return err
+			}
+			ts.Exemplars = append(ts.Exemplars, e)
+		case num == 5 && wt == wireBytes:
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			if err := ts.Metadata.unmarshal(b); err != nil {
+				return err
+			}
+		case num == 6 && wt == wireVarint:
+			v, err := d.varint()
+			if err != nil {
+				return err
+			}
+			ts.CreatedTimestamp = int64(v)
+		default:
+			if err := d.skip(wt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Sample) unmarshal(b []byte) error {
+	d := decoder{buf: b}
+	for !d.done() {
+		num, wt, err := d.field()
+		if err != nil {
+			return err
+		}
+		switch {
+		case num == 1 && wt == wireFixed64:
+			if s.Value, err = d.double(); err != nil {
+				return err
+			}
+		case num == 2 && wt == wireVarint:
+			v, err := d.varint()
+			if err != nil {
+				return err
+			}
+			s.Timestamp = int64(v)
+		default:
+			if err := d.skip(wt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *Exemplar) unmarshal(b []byte) error {
+	d := decoder{buf: b}
+	for !d.done() {
+		num, wt, err := d.field()
+		if err != nil {
+			return err
+		}
+		switch {
+		case num == 1:
+			refs, err := d.uvarints(wt, nil)
+			if err != nil {
+				return err
+			}
+			e.LabelsRefs = appendRefs(e.LabelsRefs, refs)
+		case num == 2 && wt == wireFixed64:
+			if e.Value, err = d.double(); err != nil {
+				return err
+			}
+		case num == 3 && wt == wireVarint:
+			v, err := d.varint()
+			if err != nil {
+				return err
+			}
+			e.Timestamp = int64(v)
+		default:
+			if err := d.skip(wt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Metadata) unmarshal(b []byte) error {
+	d := decoder{buf: b}
+	for !d.done() {
+		num, wt, err := d.field()
+		if err != nil {
+			return err
+		}
+		if wt != wireVarint {
+			if err := d.skip(wt); err != nil {
+				return err
+			}
+			continue
+		}
+		v, err := d.varint()
+		if err != nil {
+			return err
+		}
+		switch num {
+		case 1:
+			m.Type = MetricType(v)
+		case 3:
+			m.HelpRef = uint32(v)
+		case 4:
+			m.UnitRef = uint32(v)
+		}
+	}
+	return nil
+}
+
+// unmarshal decodes a histogram, which is a float histogram if any of the
+// float fields of its oneofs is set. Senders may leave out the count, or set
+// it as an integer, so all of them are considered.
+func (h *Histogram) unmarshal(b []byte) error {
+	d := decoder{buf: b}
+	for !d.done() {
+		num, wt, err := d.field()
+		if err != nil {
+			return err
+		}
+		switch {
+		case num == 1 && wt == wireVarint:
+			h.CountInt, err = d.varint()
+		case num == 2 && wt == wireFixed64:
+			h.IsFloat = true
+			h.CountFloat, err = d.double()
+		case num == 3 && wt == wireFixed64:
+			h.Sum, err = d.double()
+		case num == 4 && wt == wireVarint:
+			var v int64
+			v, err = d.zigzag()
+			h.Schema = int32(v)
+		case num == 5 && wt == wireFixed64:
+			h.ZeroThreshold, err = d.double()
+		case num == 6 && wt == wireVarint:
+			h.ZeroCountInt, err = d.varint()
+		case num == 7 && wt == wireFixed64:
+			h.IsFloat = true
+			h.ZeroCountFloat, err = d.double()
+		case num == 8 && wt == wireBytes:
+			h.NegativeSpans, err = d.appendSpan(h.NegativeSpans)
+		case num == 9:
+			h.NegativeDeltas, err = d.appendDeltas(wt, h.NegativeDeltas)
+		case num == 10:
+			h.NegativeCounts, err = d.doubles(wt, h.NegativeCounts)
+			h.IsFloat = h.IsFloat || len(h.NegativeCounts) > 0
+		case num == 11 && wt == wireBytes:
+			h.PositiveSpans, err = d.appendSpan(h.PositiveSpans)
+		case num == 12:
+			h.PositiveDeltas, err = d.appendDeltas(wt, h.PositiveDeltas)
+		case num == 13:
+			h.PositiveCounts, err = d.doubles(wt, h.PositiveCounts)
+			h.IsFloat = h.IsFloat || len(h.PositiveCounts) > 0
+		case num == 14 && wt == wireVarint:
+			var v uint64
+			v, err = d.varint()
+			h.ResetHint = ResetHint(v)
+		case num == 15 && wt == wireVarint:
+			var v uint64
+			v, err = d.varint()
+			h.Timestamp = int64(v)
+		case num == 16:
+			h.CustomValues, err = d.doubles(wt, h.CustomValues)
+		default:
+			err = d.skip(wt)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *decoder) appendSpan(spans []BucketSpan) ([]BucketSpan, error) {
+	b, err := d.bytes()
+	if err != nil {
+		return nil, err
+	}
+	var s BucketSpan
+	sd := decoder{buf: b}
+	for !sd.done() {
+		num, wt, err := sd.field()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case num == 1 && wt == wireVarint:
+			v, err := sd.zigzag()
+			if err != nil {
+				return nil, err
+			}
+			s.Offset = int32(v)
+		case num == 2 && wt == wireVarint:
+			v, err := sd.varint()
+			if err != nil {
+				return nil, err
+			}
+			s.Length = uint32(v)
+		default:
+			if err := sd.skip(wt); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return append(spans, s), nil
+}
+
+// appendDeltas reads a repeated sint64 field.
+func (d *decoder) appendDeltas(wt int, deltas []int64) ([]int64, error) {
+	vs, err := d.uvarints(wt, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vs {
+		deltas = append(deltas, int64(v>>1)^-int64(v&1))
+	}
+	return deltas, nil
+}
+
+func appendRefs(refs []uint32, vs []uint64) []uint32 {
+	for _, v := range vs {
+		refs = append(refs, uint32(v))
+	}
+	return refs
+}
+
+// Marshal encodes the request in its protobuf encoding.
+func (r *Request) Marshal() []byte {
+	var e encoder
+	for _, s := range r.Symbols {
+		e.bytesField(4, []byte(s))
+	}
+	for _, ts := range r.Timeseries {
+		e.bytesField(5, ts.marshal())
+	}
+	return e.buf
+}
+
+func (ts *TimeSeries) marshal() []byte {
+	var e encoder
+	e.packedUvarints(1, refsToUvarints(ts.LabelsRefs))
+	for _, s := range ts.Samples {
+		var se encoder
+		se.doubleField(1, s.Value)
+		se.varintField(2, uint64(s.Timestamp))
+		e.bytesField(2, se.buf)
+	}
+	for _, h := range ts.Histograms {
+		e.bytesField(3, h.marshal())
+	}
+	for _, ex := range ts.Exemplars {
+		var ee encoder
+		ee.packedUvarints(1, refsToUvarints(ex.LabelsRefs))
+		ee.doubleField(2, ex.Value)
+		ee.varintField(3, uint64(ex.Timestamp))
+		e.bytesField(4, ee.buf)
+	}
+	var me encoder
+	me.varintField(1, uint64(ts.Metadata.Type))
+	me.varintField(3, uint64(ts.Metadata.HelpRef))
+	me.varintField(4, uint64(ts.Metadata.UnitRef))
+	e.bytesField(5, me.buf)
+	e.varintField(6, uint64(ts.CreatedTimestamp))
+	return e.buf
+}
+
+func (h *Histogram) marshal() []byte {
+	var e encoder
+	if h.IsFloat {
+		e.key(2, wireFixed64)
+		e.double(h.CountFloat)
+	} else {
+		e.key(1, wireVarint)
+		e.varint(h.CountInt)
+	}
+	e.doubleField(3, h.Sum)
+	e.zigzagField(4, int64(h.Schema))
+	e.doubleField(5, h.ZeroThreshold)
+	if h.IsFloat {
+		e.key(7, wireFixed64)
+		e.double(h.ZeroCountFloat)
+	} else {
+		e.key(6, wireVarint)
+		e.varint(h.ZeroCountInt)
+	}
+	marshalSpans(&e, 8, h.NegativeSpans)
+	e.packedUvarints(9, deltasToUvarints(h.NegativeDeltas))
+	e.packedDoubles(10, h.NegativeCounts)
+	marshalSpans(&e, 11, h.PositiveSpans)
+	e.packedUvarints(12, deltasToUvarints(h.PositiveDeltas))
+	e.packedDoubles(13, h.PositiveCounts)
+	e.varintField(14, uint64(h.ResetHint))
+	e.varintField(15, uint64(h.Timestamp))
+	e.packedDoubles(16, h.CustomValues)
+	return e.buf
+}
+
+func marshalSpans(e *encoder, num int, spans []BucketSpan) {
+	for _, s := range spans {
+		var se encoder
+		se.zigzagField(1, int64(s.Offset))
+		se.varintField(2, uint64(s.Length))
+		e.bytesField(num, se.buf)
+	}
+}
+
+func refsToUvarints(refs []uint32) []uint64 {
+	vs := make([]uint64, len(refs))
+	for i, r := range refs {
+		vs[i] = uint64(r)
+	}
+	return vs
+}
+
+func deltasToUvarints(deltas []int64) []uint64 {
+	vs := make([]uint64, len(deltas))
+	for i, d := range deltas {
+		vs[i] = uint64(d<<1) ^ uint64(d>>63)
+	}
+	return vs
+}
@@ -0,0 +1,230 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writev2
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestUnmarshal(t *testing.T) {
+	// Request{Symbols: ["", "__name__", "up"], Timeseries: [{LabelsRefs: [1, 2],
+	// Samples: [{Value: 1, Timestamp: 1000}]}]}, as encoded by protoc, with
+	// an unknown field appended to the series.
+	b := []byte{
+		0x22, 0x00,
+		0x22, 0x08, '_', '_', 'n', 'a', 'm', 'e', '_', '_',
+		0x22, 0x02, 'u', 'p',
+		0x2a, 0x15,
+		0x0a, 0x02, 0x01, 0x02,
+		0x12, 0x0c, 0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf0, 0x3f, 0x10, 0xe8, 0x07,
+		0xf8, 0x01, 0x01,
+	}
+	var req Request
+	if err := req.Unmarshal(b); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := Request{
+		Symbols: []string{"", "__name__", "up"},
+		Timeseries: []TimeSeries{{
+			LabelsRefs: []uint32{1, 2},
+			Samples:    []Sample{{Value: 1, Timestamp: 1000}},
+		}},
+	}
+	if !reflect.DeepEqual(req, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, req)
+	}
+
+	m, err := req.Metric(req.Timeseries[0].LabelsRefs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if expected := (model.Metric{"__name__": "up"}); !reflect.DeepEqual(m, expected) {
+		t.Errorf("Expected metric %v, got %v", expected, m)
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	for _, b := range [][]byte{
+		// Truncated symbol.
+		{0x22, 0x08, '_', '_'},
+		// Truncated sample value.
+		{0x2a, 0x04, 0x12, 0x02, 0x09, 0x00},
+		// Field number 0.
+		{0x02, 0x00},
+	} {
+		var req Request
+		if err := req.Unmarshal(b); err == nil {
+			t.Errorf("Expected error for %x, got none", b)
+		}
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	req := Request{
+		Symbols: []string{"", "__name__", "rpc_seconds", "help", "trace_id", "abc"},
+		Timeseries: []TimeSeries{
+			{
+				LabelsRefs:       []uint32{1, 2},
+				Samples:          []Sample{{Value: -0.5, Timestamp: 1000}, {Value: 2, Timestamp: 2000}},
+				Exemplars:        []Exemplar{{LabelsRefs: []uint32{4, 5}, Value: 0.1, Timestamp: 1500}},
+				Metadata:         Metadata{Type: MetricTypeCounter, HelpRef: 3},
+				CreatedTimestamp: 500,
+			},
+			{
+				LabelsRefs: []uint32{1, 2},
+				Histograms: []Histogram{
+					{
+						CountInt:       5,
+						Sum:            12.5,
+						Schema:         -1,
+						ZeroThreshold:  0.001,
+						ZeroCountInt:   1,
+						NegativeSpans:  []BucketSpan{{Offset: -2, Length: 1}},
+						NegativeDeltas: []int64{1},
+						PositiveSpans:  []BucketSpan{{Offset: 0, Length: 2}, {Offset: 3, Length: 1}},
+						PositiveDeltas: []int64{1, -1, 2},
+						ResetHint:      ResetHintNo,
+						Timestamp:      1000,
+					},
+					{
+						IsFloat:        true,
+						CountFloat:     3,
+						Sum:            4,
+						Schema:         -53,
+						PositiveSpans:  []BucketSpan{{Offset: 0, Length: 2}},
+						PositiveCounts: []float64{1, 2},
+						CustomValues:   []float64{0.5, 1},
+						Timestamp:      2000,
+					},
+				},
+			},
+		},
+	}
+	var decoded Request
+	if err := decoded.Unmarshal(req.Marshal()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(decoded, req) {
+		t.Errorf("Expected %+v, got %+v", req, decoded)
+	}
+}
+
+func TestUnmarshalFloatHistogram(t *testing.T) {
+	// Float histograms are told apart by any of their float fields, even
+	// without count_float.
+	var zeroCount encoder
+	zeroCount.doubleField(3, 4)
+	zeroCount.key(7, wireFixed64)
+	zeroCount.double(0)
+
+	var counts encoder
+	counts.varintField(1, 3)
+	marshalSpans(&counts, 11, []BucketSpan{{Offset: 0, Length: 2}})
+	counts.packedDoubles(13, []float64{1, 2})
+
+	var deltas encoder
+	marshalSpans(&deltas, 11, []BucketSpan{{Offset: 0, Length: 2}})
+	deltas.packedUvarints(12, deltasToUvarints([]int64{1, 1}))
+
+	for _, test := range []struct {
+		name     string
+		b        []byte
+		expected Histogram
+	}{
+		{
+			name:     "zero_count_float",
+			b:        zeroCount.buf,
+			expected: Histogram{IsFloat: true, Sum: 4},
+		},
+		{
+			name: "positive_counts",
+			b:    counts.buf,
+			expected: Histogram{
+				IsFloat:        true,
+				CountInt:       3,
+				PositiveSpans:  []BucketSpan{{Offset: 0, Length: 2}},
+				PositiveCounts: []float64{1, 2},
+			},
+		},
+		{
+			name: "positive_deltas",
+			b:    deltas.buf,
+			expected: Histogram{
+				PositiveSpans:  []BucketSpan{{Offset: 0, Length: 2}},
+				PositiveDeltas: []int64{1, 1},
+			},
+		},
+	} {
+		var h Histogram
+		if err := h.unmarshal(test.b); err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+		if !reflect.DeepEqual(h, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, h)
+		}
+	}
+}
+
+func TestMetricInvalidRefs(t *testing.T) {
+	req := Request{Symbols: []string{"", "__name__"}}
+	if _, err := req.Metric([]uint32{1, 2}); err == nil {
+		t.Error("Expected error for out of range reference, got none")
+	}
+	if _, err := req.Metric([]uint32{1}); err == nil {
+		t.Error("Expected error for odd number of references, got none")
+	}
+}
+
+func TestV1Histograms(t *testing.T) {
+	h := Histogram{
+		IsFloat:        true,
+		CountFloat:     3,
+		Sum:            4,
+		Schema:         -53,
+		PositiveSpans:  []BucketSpan{{Offset: 0, Length: 2}},
+		PositiveCounts: []float64{1, 2},
+		CustomValues:   []float64{0.5, 1},
+		Timestamp:      2000,
+	}
+	var label encoder
+	label.bytesField(1, []byte("__name__"))
+	label.bytesField(2, []byte("rpc_seconds"))
+
+	// A series with a histogram, followed by one with a sample only, and
+	// the metadata of the request.
+	var withHistogram, withSample, sample, req encoder
+	withHistogram.bytesField(1, label.buf)
+	withHistogram.bytesField(4, h.marshal())
+	sample.doubleField(1, 1)
+	withSample.bytesField(1, label.buf)
+	withSample.bytesField(2, sample.buf)
+	req.bytesField(1, withHistogram.buf)
+	req.bytesField(1, withSample.buf)
+	req.bytesField(3, label.buf)
+
+	histograms, err := V1Histograms(req.buf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if expected := [][]Histogram{{h}, nil}; !reflect.DeepEqual(histograms, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, histograms)
+	}
+
+	if _, err := V1Histograms(req.buf[:len(req.buf)-1]); err == nil {
+		t.Error("Expected error for truncated request, got none")
+	}
+}
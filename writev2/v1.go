@@ -0,0 +1,77 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writev2
+
+import "github.com/pkg/errors"
+
+// V1Histograms decodes the native histograms of the series of a remote write
+// 1.0 request, a prometheus.WriteRequest protobuf message. Remote write 1.0
+// encodes them the same way as 2.0, but older versions of its generated
+// types don't know about them. The histograms of each series are returned
+// in the order of the series, with nil for series without histograms.
+func V1Histograms(b []byte) ([][]Histogram, error) {
+	var series [][]Histogram
+	d := decoder{buf: b}
+	for !d.done() {
+		num, wt, err := d.field()
+		if err != nil {
+			return nil, err
+		}
+		if num != 1 || wt != wireBytes {
+			if err := d.skip(wt); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		b, err := d.bytes()
+		if err != nil {
+			return nil, err
+		}
+		histograms, err := v1SeriesHistograms(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "error decoding series")
+		}
+		series = append(series, histograms)
+	}
+	return series, nil
+}
+
+// v1SeriesHistograms decodes the native histograms of a
+// prometheus.TimeSeries message.
+func v1SeriesHistograms(b []byte) ([]Histogram, error) {
+	var histograms []Histogram
+	d := decoder{buf: b}
+	for !d.done() {
+		num, wt, err := d.field()
+		if err != nil {
+			return nil, err
+		}
+		if num != 4 || wt != wireBytes {
+			if err := d.skip(wt); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		b, err := d.bytes()
+		if err != nil {
+			return nil, err
+		}
+		var h Histogram
+		if err := h.unmarshal(b); err != nil {
+			return nil, err
+		}
+		histograms = append(histograms, h)
+	}
+	return histograms, nil
+}
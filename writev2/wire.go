@@ -0,0 +1,233 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writev2
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Wire types of the protobuf encoding.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("truncated protobuf message")
+
+// decoder reads the fields of a protobuf message.
+type decoder struct {
+	buf []byte
+}
+
+func (d *decoder) done() bool {
+	return len(d.buf) == 0
+}
+
+// field reads the key of the next field.
+func (d *decoder) field() (num int, wireType int, err error) {
+	key, err := d.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	if key>>3 == 0 || key>>3 > math.MaxInt32 {
+		return 0, 0, errors.New("invalid protobuf field number")
+	}
+	return int(key >> 3), int(key & 7), nil
+}
+
+func (d *decoder) varint() (uint64, error) {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	d.buf = d.buf[n:]
+	return v, nil
+}
+
+// zigzag reads a varint of a sint32 or sint64 field.
+func (d *decoder) zigzag() (int64, error) {
+	v, err := d.varint()
+	return int64(v>>1) ^ -int64(v&1), err
+}
+
+func (d *decoder) double() (float64, error) {
+	if len(d.buf) < 8 {
+		return 0, errTruncated
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(d.buf))
+	d.buf = d.buf[8:]
+	return v, nil
+}
+
+func (d *decoder) bytes() ([]byte, error) {
+	n, err := d.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(d.buf)) {
+		return nil, errTruncated
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b, nil
+}
+
+// skip skips the value of a field which isn't known.
+func (d *decoder) skip(wireType int) error {
+	switch wireType {
+	case wireVarint:
+		_, err := d.varint()
+		return err
+	case wireFixed64:
+		if len(d.buf) < 8 {
+			return errTruncated
+		}
+		d.buf = d.buf[8:]
+	case wireBytes:
+		_, err := d.bytes()
+		return err
+	case wireFixed32:
+		if len(d.buf) < 4 {
+			return errTruncated
+		}
+		d.buf = d.buf[4:]
+	default:
+		return errors.New("unsupported protobuf wire type")
+	}
+	return nil
+}
+
+// uvarints reads a repeated varint field, which is either packed or a
+// single value.
+func (d *decoder) uvarints(wireType int, vs []uint64) ([]uint64, error) {
+	if wireType == wireVarint {
+		v, err := d.varint()
+		return append(vs, v), err
+	}
+	if wireType != wireBytes {
+		return nil, errors.New("unexpected wire type for repeated varint")
+	}
+	b, err := d.bytes()
+	if err != nil {
+		return nil, err
+	}
+	packed := decoder{buf: b}
+	for !packed.done() {
+		v, err := packed.varint()
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+// doubles reads a repeated double field, which is either packed or a
+// single value.
+func (d *decoder) doubles(wireType int, vs []float64) ([]float64, error) {
+	if wireType == wireFixed64 {
+		v, err := d.double()
+		return append(vs, v), err
+	}
+	if wireType != wireBytes {
+		return nil, errors.New("unexpected wire type for repeated double")
+	}
+	b, err := d.bytes()
+	if err != nil {
+		return nil, err
+	}
+	if len(b)%8 != 0 {
+		return nil, errTruncated
+	}
+	for i := 0; i < len(b); i += 8 {
+		vs = append(vs, math.Float64frombits(binary.LittleEndian.Uint64(b[i:])))
+	}
+	return vs, nil
+}
+
+// encoder writes the fields of a protobuf message. It is used to build
+// requests in tests and by clients of this package.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) key(num int, wireType int) {
+	e.varint(uint64(num)<<3 | uint64(wireType))
+}
+
+func (e *encoder) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	e.buf = append(e.buf, b[:n]...)
+}
+
+func (e *encoder) double(v float64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.varint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) varintField(num int, v uint64) {
+	if v != 0 {
+		e.key(num, wireVarint)
+		e.varint(v)
+	}
+}
+
+func (e *encoder) zigzagField(num int, v int64) {
+	e.varintField(num, uint64(v<<1)^uint64(v>>63))
+}
+
+func (e *encoder) doubleField(num int, v float64) {
+	if v != 0 || math.Signbit(v) {
+		e.key(num, wireFixed64)
+		e.double(v)
+	}
+}
+
+func (e *encoder) bytesField(num int, b []byte) {
+	e.key(num, wireBytes)
+	e.bytes(b)
+}
+
+func (e *encoder) packedUvarints(num int, vs []uint64) {
+	if len(vs) == 0 {
+		return
+	}
+	var packed encoder
+	for _, v := range vs {
+		packed.varint(v)
+	}
+	e.bytesField(num, packed.buf)
+}
+
+func (e *encoder) packedDoubles(num int, vs []float64) {
+	if len(vs) == 0 {
+		return
+	}
+	var packed encoder
+	for _, v := range vs {
+		packed.double(v)
+	}
+	e.bytesField(num, packed.buf)
+}